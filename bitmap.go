@@ -0,0 +1,306 @@
+package yiyidb
+
+import (
+	"errors"
+	"math/bits"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//位图: 按 bitChunkSize 字节分块存放 c+块序号 -> 块数据，全0块不存放，元数据记录块数
+//位序与redis一致，offset 0 为首字节最高位
+const (
+	bitChunkSub  byte = 'c'
+	bitChunkSize      = 1024
+	bitChunkBits      = bitChunkSize * 8
+)
+
+type BitOperation byte
+
+const (
+	BitAnd BitOperation = iota + 1
+	BitOr
+	BitXor
+	BitNot
+)
+
+func bitChunkPrefix(bitmap string) []byte {
+	return nsKey(nsBit, bitmap, []byte{bitChunkSub})
+}
+
+func bitChunkKey(bitmap string, idx uint64) []byte {
+	return append(bitChunkPrefix(bitmap), IdToKeyPure(idx)...)
+}
+
+func bitZero(chunk []byte) bool {
+	for _, b := range chunk {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func bitGet(chunk []byte, pos uint64) bool {
+	return chunk[pos>>3]&(0x80>>(pos&7)) != 0
+}
+
+//统计块内 [from, to] 位中1的个数
+func bitCountChunk(chunk []byte, from, to uint64) uint64 {
+	var n uint64
+	for pos := from; pos <= to; {
+		if pos&7 == 0 && pos+7 <= to {
+			n += uint64(bits.OnesCount8(chunk[pos>>3]))
+			pos += 8
+			continue
+		}
+		if bitGet(chunk, pos) {
+			n++
+		}
+		pos++
+	}
+	return n
+}
+
+//设置位，返回原值
+func (k *Kvdb) SetBit(bitmap string, offset uint64, value bool) (bool, error) {
+	k.Lock()
+	defer k.Unlock()
+	ck := bitChunkKey(bitmap, offset/bitChunkBits)
+	chunk, err := k.db.Get(ck, nil)
+	exists := err == nil
+	if !exists {
+		chunk = make([]byte, bitChunkSize)
+	}
+	pos := offset % bitChunkBits
+	old := bitGet(chunk, pos)
+	if old == value {
+		return old, nil
+	}
+	if value {
+		chunk[pos>>3] |= 0x80 >> (pos & 7)
+	} else {
+		chunk[pos>>3] &^= 0x80 >> (pos & 7)
+	}
+	batch := new(leveldb.Batch)
+	count := k.nsCount(nsBit, bitmap)
+	switch {
+	case bitZero(chunk):
+		batch.Delete(ck)
+		count--
+	case !exists:
+		batch.Put(ck, chunk)
+		count++
+	default:
+		batch.Put(ck, chunk)
+	}
+	k.nsSetCount(batch, nsBit, bitmap, count)
+	return old, k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) GetBit(bitmap string, offset uint64) (bool, error) {
+	chunk, err := k.db.Get(bitChunkKey(bitmap, offset/bitChunkBits), k.iteratorOpts)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bitGet(chunk, offset%bitChunkBits), nil
+}
+
+//统计位闭区间 [start, end] 中1的个数
+func (k *Kvdb) BitCount(bitmap string, start, end uint64) (uint64, error) {
+	if start > end {
+		return 0, nil
+	}
+	var n uint64
+	p := bitChunkPrefix(bitmap)
+	iter := k.db.NewIterator(&util.Range{Start: bitChunkKey(bitmap, start/bitChunkBits), Limit: util.BytesPrefix(p).Limit}, k.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		idx := KeyToIDPure(iter.Key()[len(p):])
+		if idx > end/bitChunkBits {
+			break
+		}
+		from, to := uint64(0), uint64(bitChunkBits-1)
+		if idx == start/bitChunkBits {
+			from = start % bitChunkBits
+		}
+		if idx == end/bitChunkBits {
+			to = end % bitChunkBits
+		}
+		n += bitCountChunk(iter.Value(), from, to)
+	}
+	return n, iter.Error()
+}
+
+//返回 start 起第一个值为 bit 的位置，查找1不存在时返回-1
+func (k *Kvdb) BitPos(bitmap string, bit bool, start uint64) (int64, error) {
+	p := bitChunkPrefix(bitmap)
+	iter := k.db.NewIterator(&util.Range{Start: bitChunkKey(bitmap, start/bitChunkBits), Limit: util.BytesPrefix(p).Limit}, k.iteratorOpts)
+	defer iter.Release()
+	pos := start
+	for iter.Next() {
+		idx := KeyToIDPure(iter.Key()[len(p):])
+		if !bit && idx > pos/bitChunkBits {
+			//中间缺失的块全为0
+			return int64(pos), nil
+		}
+		if idx*bitChunkBits > pos {
+			pos = idx * bitChunkBits
+		}
+		chunk := iter.Value()
+		for i := pos % bitChunkBits; i < bitChunkBits; i++ {
+			if bitGet(chunk, i) == bit {
+				return int64(idx*bitChunkBits + i), nil
+			}
+		}
+		pos = (idx + 1) * bitChunkBits
+	}
+	if err := iter.Error(); err != nil {
+		return -1, err
+	}
+	if bit {
+		return -1, nil
+	}
+	return int64(pos), nil
+}
+
+//位图运算结果写入 dest，按块归并不整体载入内存，NOT 只接受一个源位图并按其末块长度取反
+func (k *Kvdb) BitOp(op BitOperation, dest string, srcs ...string) error {
+	if len(srcs) == 0 {
+		return errors.New("srcs empty")
+	}
+	if op == BitNot && len(srcs) != 1 {
+		return errors.New("bitop not need one src")
+	}
+	if op < BitAnd || op > BitNot {
+		return errors.New("bitop unknown")
+	}
+	k.Lock()
+	defer k.Unlock()
+	snap, err := k.db.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	batch := new(leveldb.Batch)
+	iter := k.db.NewIterator(util.BytesPrefix(bitChunkPrefix(dest)), k.iteratorOpts)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	var count uint64
+	put := func(idx uint64, chunk []byte) {
+		if !bitZero(chunk) {
+			batch.Put(bitChunkKey(dest, idx), chunk)
+			count++
+		}
+	}
+
+	if op == BitNot {
+		p := bitChunkPrefix(srcs[0])
+		it := snap.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+		defer it.Release()
+		next := uint64(0)
+		for it.Next() {
+			idx := KeyToIDPure(it.Key()[len(p):])
+			for ; next < idx; next++ {
+				full := make([]byte, bitChunkSize)
+				for i := range full {
+					full[i] = 0xff
+				}
+				put(next, full)
+			}
+			chunk := make([]byte, bitChunkSize)
+			for i, b := range it.Value() {
+				chunk[i] = ^b
+			}
+			put(idx, chunk)
+			next = idx + 1
+		}
+		if err := it.Error(); err != nil {
+			return err
+		}
+	} else {
+		iters := make([]iterator.Iterator, len(srcs))
+		prefixes := make([][]byte, len(srcs))
+		valid := make([]bool, len(srcs))
+		for i, src := range srcs {
+			prefixes[i] = bitChunkPrefix(src)
+			iters[i] = snap.NewIterator(util.BytesPrefix(prefixes[i]), k.iteratorOpts)
+			defer iters[i].Release()
+			valid[i] = iters[i].Next()
+		}
+		for {
+			//取各源当前最小块序号
+			var min uint64
+			found := false
+			for i, it := range iters {
+				if !valid[i] {
+					continue
+				}
+				idx := KeyToIDPure(it.Key()[len(prefixes[i]):])
+				if !found || idx < min {
+					min, found = idx, true
+				}
+			}
+			if !found {
+				break
+			}
+			chunk := make([]byte, bitChunkSize)
+			for i, it := range iters {
+				var src []byte
+				if valid[i] && KeyToIDPure(it.Key()[len(prefixes[i]):]) == min {
+					src = it.Value()
+				}
+				for j := range chunk {
+					var b byte
+					if src != nil {
+						b = src[j]
+					}
+					switch {
+					case i == 0:
+						chunk[j] = b
+					case op == BitAnd:
+						chunk[j] &= b
+					case op == BitOr:
+						chunk[j] |= b
+					default:
+						chunk[j] ^= b
+					}
+				}
+				if src != nil {
+					valid[i] = it.Next()
+				}
+			}
+			put(min, chunk)
+		}
+		for _, it := range iters {
+			if err := it.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	k.nsSetCount(batch, nsBit, dest, count)
+	return k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) BitClear(bitmap string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsBit, bitmap)
+}
+
+//设置整个位图的超时秒数，<0 取消超时
+func (k *Kvdb) BitSetTTL(bitmap string, ttl int) error {
+	return k.expireNs(nsBit, bitmap, ttl)
+}
+
+func (k *Kvdb) BitGetTTL(bitmap string) (float64, error) {
+	return k.ttlNs(nsBit, bitmap)
+}
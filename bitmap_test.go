@@ -0,0 +1,77 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_Bitmap(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Drop()
+
+	for _, off := range []uint64{1, 7, 100, bitChunkBits + 3, 5 * bitChunkBits} {
+		old, err := kv.SetBit("dau", off, true)
+		assert.NoError(t, err)
+		assert.False(t, old)
+	}
+	old, _ := kv.SetBit("dau", 7, true)
+	assert.True(t, old)
+	v, _ := kv.GetBit("dau", 100)
+	assert.True(t, v)
+	v, _ = kv.GetBit("dau", 101)
+	assert.False(t, v)
+	v, _ = kv.GetBit("dau", 1<<40)
+	assert.False(t, v)
+
+	n, err := kv.BitCount("dau", 0, 1<<40)
+	assert.NoError(t, err)
+	assert.Equal(t, n, uint64(5))
+	n, _ = kv.BitCount("dau", 7, bitChunkBits+3)
+	assert.Equal(t, n, uint64(3))
+
+	pos, _ := kv.BitPos("dau", true, 8)
+	assert.Equal(t, pos, int64(100))
+	pos, _ = kv.BitPos("dau", true, 5*bitChunkBits+1)
+	assert.Equal(t, pos, int64(-1))
+	pos, _ = kv.BitPos("dau", false, 1)
+	assert.Equal(t, pos, int64(2))
+
+	//清零后空块被删除
+	kv.SetBit("dau", 5*bitChunkBits, false)
+	assert.Equal(t, kv.nsCount(nsBit, "dau"), uint64(2))
+
+	kv.SetBit("other", 7, true)
+	kv.SetBit("other", 8, true)
+	kv.SetBit("other", 3*bitChunkBits, true)
+
+	assert.NoError(t, kv.BitOp(BitAnd, "and", "dau", "other"))
+	n, _ = kv.BitCount("and", 0, 1<<40)
+	assert.Equal(t, n, uint64(1))
+	assert.NoError(t, kv.BitOp(BitOr, "or", "dau", "other"))
+	n, _ = kv.BitCount("or", 0, 1<<40)
+	assert.Equal(t, n, uint64(6))
+	assert.NoError(t, kv.BitOp(BitXor, "xor", "dau", "other"))
+	n, _ = kv.BitCount("xor", 0, 1<<40)
+	assert.Equal(t, n, uint64(5))
+	assert.NoError(t, kv.BitOp(BitNot, "not", "other"))
+	n, _ = kv.BitCount("not", 0, 1<<40)
+	assert.Equal(t, n, uint64(4*bitChunkBits-3))
+	assert.Error(t, kv.BitOp(BitNot, "not", "dau", "other"))
+
+	assert.NoError(t, kv.BitClear("dau"))
+	n, _ = kv.BitCount("dau", 0, 1<<40)
+	assert.Equal(t, n, uint64(0))
+}
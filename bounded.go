@@ -0,0 +1,446 @@
+package yiyidb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//容量限制，按条数及字节数，0表示不限制
+//延时消息到期时只移入放得下的部分，其余留在延时区等有空间后再移入
+type OverflowPolicy int
+
+const (
+	OverflowReject     OverflowPolicy = iota //返回 ErrFull
+	OverflowBlock                            //等待直到有空间
+	OverflowDropOldest                       //删除最旧的数据
+	OverflowSpill                            //写入溢出目录，有空间后按顺序移回
+)
+
+type Capacity struct {
+	MaxItems     uint64
+	MaxBytes     uint64
+	Policy       OverflowPolicy
+	BlockTimeout time.Duration //OverflowBlock 等待超时返回 ErrTimeout，0一直等待
+	SpillDir     string        //OverflowSpill 溢出数据目录
+	//占用比例(0~1)上穿 HighWatermark 及下穿 LowWatermark 时回调，HighWatermark 为0不回调
+	//回调在持有队列锁时执行，不能在回调中再调用该队列
+	HighWatermark float64
+	LowWatermark  float64
+	OnWatermark   func(ev WatermarkEvent)
+}
+
+type WatermarkEvent struct {
+	Chan  string
+	High  bool
+	Items uint64
+	Bytes uint64
+}
+
+var errNoSpace = errors.New("no space")
+
+const (
+	admitOk = iota
+	admitDrop
+	admitSpill
+)
+
+type bound struct {
+	Capacity
+	bytes uint64
+	high  bool
+}
+
+func newBound(c *Capacity) (*bound, error) {
+	if c.Policy == OverflowSpill && c.SpillDir == "" {
+		return nil, errors.New("spill dir required")
+	}
+	return &bound{Capacity: *c}, nil
+}
+
+func (b *bound) fits(items, bytes, n, size uint64) bool {
+	return (b.MaxItems == 0 || items+n <= b.MaxItems) && (b.MaxBytes == 0 || bytes+size <= b.MaxBytes)
+}
+
+//判断写入 n 条共 size 字节时的处理方式，pending 表示溢出目录中还有数据，需排在其后
+func (b *bound) admit(items, n, size uint64, pending bool) (int, error) {
+	//单次写入超过容量
+	if !b.fits(0, 0, n, size) {
+		return 0, ErrFull
+	}
+	if !pending && b.fits(items, b.bytes, n, size) {
+		return admitOk, nil
+	}
+	switch b.Policy {
+	case OverflowBlock:
+		return 0, errNoSpace
+	case OverflowDropOldest:
+		return admitDrop, nil
+	case OverflowSpill:
+		return admitSpill, nil
+	}
+	return 0, ErrFull
+}
+
+func (b *bound) usage(items uint64) float64 {
+	var u float64
+	if b.MaxItems > 0 {
+		u = float64(items) / float64(b.MaxItems)
+	}
+	if b.MaxBytes > 0 {
+		if v := float64(b.bytes) / float64(b.MaxBytes); v > u {
+			u = v
+		}
+	}
+	return u
+}
+
+func (b *bound) watermark(name string, items uint64) {
+	if b.HighWatermark <= 0 || b.OnWatermark == nil {
+		return
+	}
+	u := b.usage(items)
+	if !b.high && u >= b.HighWatermark {
+		b.high = true
+		b.OnWatermark(WatermarkEvent{Chan: name, High: true, Items: items, Bytes: b.bytes})
+	} else if b.high && u <= b.LowWatermark {
+		b.high = false
+		b.OnWatermark(WatermarkEvent{Chan: name, High: false, Items: items, Bytes: b.bytes})
+	}
+}
+
+//从队首开始删除直到能写入 n 条共 size 字节，返回删除的条数及字节数
+func (b *bound) dropOldest(db *leveldb.DB, batch *leveldb.Batch, r *util.Range, items, n, size uint64) (uint64, uint64, error) {
+	var dropped, bytes uint64
+	iter := db.NewIterator(r, nil)
+	defer iter.Release()
+	for !b.fits(items-dropped, b.bytes-bytes, n, size) && iter.Next() {
+		batch.Delete(iter.Key())
+		dropped++
+		bytes += uint64(len(iter.Value()))
+	}
+	return dropped, bytes, iter.Error()
+}
+
+func rangeBytes(db *leveldb.DB, r *util.Range) uint64 {
+	var n uint64
+	iter := db.NewIterator(r, nil)
+	for iter.Next() {
+		n += uint64(len(iter.Value()))
+	}
+	iter.Release()
+	return n
+}
+
+//OverflowBlock 时等待空间，try 返回 errNoSpace 表示需继续等待
+func waitSpace(space *waitQueue, name string, timeout time.Duration, try func() error) error {
+	err := try()
+	if err != errNoSpace {
+		return err
+	}
+	return space.blockTimeout(timeout, name, func() error {
+		if err := try(); err != errNoSpace {
+			return err
+		}
+		return ErrEmpty
+	})
+}
+
+//溢出目录中的数据没有 ID
+func spilledItems(values [][]byte) []*QueueItem {
+	items := make([]*QueueItem, len(values))
+	for i, v := range values {
+		items[i] = &QueueItem{Value: v}
+	}
+	return items
+}
+
+//设置容量限制，nil 取消限制，取消或改为其它策略时溢出目录中的数据全部移回
+func (q *Queue) SetCapacity(c *Capacity) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	var b *bound
+	if c != nil {
+		var err error
+		if b, err = newBound(c); err != nil {
+			return err
+		}
+	}
+	if q.spill != nil && (b == nil || b.Policy != OverflowSpill || b.SpillDir != q.spill.DataDir) {
+		q.bound = nil
+		if err := q.refill(); err != nil {
+			return err
+		}
+		if err := q.db.Delete(spillMarkKey("", q.spill.DataDir), nil); err != nil {
+			return err
+		}
+		q.spill.Close()
+		q.spill = nil
+	}
+	if b != nil && b.Policy == OverflowSpill && q.spill == nil {
+		spill, err := OpenQueue(b.SpillDir)
+		if err != nil {
+			return err
+		}
+		q.spill = spill
+	}
+	q.bound = b
+	if b != nil {
+		b.bytes = rangeBytes(q.db, &util.Range{Start: IdToKeyPure(q.head + 1), Limit: IdToKeyPure(q.tail + 1)})
+		b.watermark("", q.tail-q.head)
+	}
+	q.space.notify("", q.space.len(""))
+	return nil
+}
+
+//溢出目录中的数据条数
+func (q *Queue) SpillLength() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	if q.spill == nil {
+		return 0
+	}
+	return q.spill.Length()
+}
+
+func (q *Queue) blockTimeout() time.Duration {
+	q.RLock()
+	defer q.RUnlock()
+	if q.bound == nil {
+		return 0
+	}
+	return q.bound.BlockTimeout
+}
+
+//数据移出队列后更新占用，从溢出目录补充并唤醒等待空间的写入
+func (q *Queue) shrank(n, size uint64) {
+	if q.bound == nil {
+		return
+	}
+	q.bound.bytes -= size
+	q.refill()
+	q.bound.watermark("", q.tail-q.head)
+	//只释放字节时也唤醒一个等待者
+	if n == 0 {
+		n = 1
+	}
+	q.space.notify("", int(n))
+}
+
+//内部写入增加的占用
+func (q *Queue) grew(size uint64) {
+	if q.bound == nil {
+		return
+	}
+	q.bound.bytes += size
+	q.bound.watermark("", q.tail-q.head)
+}
+
+//移回的数据在同一 batch 中记录其在溢出目录中的 ID，写入队列后未及从溢出目录删除就崩溃时据此跳过，避免重复投递
+func spillMarkKey(name, dir string) []byte {
+	return nsKey(nsSeq, "spill", []byte(name+"\x00"+dir))
+}
+
+//溢出目录队首是否已移回过
+func spillMoved(db *leveldb.DB, mark []byte, id uint64) (bool, error) {
+	v, err := db.Get(mark, nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return KeyToIDPure(v) == id, nil
+}
+
+//按顺序把溢出目录中的数据移回队尾，先写入队列再从溢出目录删除
+func (q *Queue) refill() error {
+	if q.spill == nil {
+		return nil
+	}
+	moved := 0
+	defer func() {
+		q.waits.notify("", moved)
+	}()
+	mark := spillMarkKey("", q.spill.DataDir)
+	for {
+		item, err := q.spill.Peek()
+		if err == ErrEmpty {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if done, err := spillMoved(q.db, mark, item.ID); err != nil {
+			return err
+		} else if done {
+			if _, err := q.spill.Dequeue(); err != nil {
+				return err
+			}
+			continue
+		}
+		size := uint64(len(item.Value))
+		if q.bound != nil && !q.bound.fits(q.tail-q.head, q.bound.bytes, 1, size) {
+			return nil
+		}
+		batch := new(leveldb.Batch)
+		batch.Put(IdToKeyPure(q.tail+1), item.Value)
+		batch.Put(seqKey(""), IdToKeyPure(q.tail+1))
+		batch.Put(mark, IdToKeyPure(item.ID))
+		if err := q.db.Write(batch, nil); err != nil {
+			return err
+		}
+		q.tail++
+		moved++
+		if q.bound != nil {
+			q.bound.bytes += size
+		}
+		if _, err := q.spill.Dequeue(); err != nil {
+			return err
+		}
+	}
+}
+
+func (q *ChanQueue) SetCapacity(chname string, c *Capacity) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	var b *bound
+	if c != nil {
+		var err error
+		if b, err = newBound(c); err != nil {
+			return err
+		}
+	}
+	if old, ok := q.bounds[chname]; ok && old.Policy == OverflowSpill && (b == nil || b.Policy != OverflowSpill || b.SpillDir != old.SpillDir) {
+		delete(q.bounds, chname)
+		if err := q.refill(chname, q.spills[old.SpillDir]); err != nil {
+			return err
+		}
+		if err := q.db.Delete(spillMarkKey(chname, old.SpillDir), nil); err != nil {
+			return err
+		}
+	}
+	if b == nil {
+		delete(q.bounds, chname)
+		q.space.notify(chname, q.space.len(chname))
+		return nil
+	}
+	if b.Policy == OverflowSpill {
+		if _, ok := q.spills[b.SpillDir]; !ok {
+			spill, err := OpenChanQueue(b.SpillDir, 0)
+			if err != nil {
+				return err
+			}
+			q.spills[b.SpillDir] = spill
+		}
+	}
+	q.bounds[chname] = b
+	var items uint64
+	if mt, ok := q.mats[chname]; ok {
+		items = mt.count
+		b.bytes = mt.bytes
+	}
+	b.watermark(chname, items)
+	q.space.notify(chname, q.space.len(chname))
+	return nil
+}
+
+func (q *ChanQueue) SpillLength(chname string) uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	if spill := q.spillOf(chname); spill != nil {
+		l, _ := spill.Length(chname)
+		return l
+	}
+	return 0
+}
+
+func (q *ChanQueue) spillOf(chname string) *ChanQueue {
+	if b, ok := q.bounds[chname]; ok && b.Policy == OverflowSpill {
+		return q.spills[b.SpillDir]
+	}
+	return nil
+}
+
+func (q *ChanQueue) blockTimeout(chname string) time.Duration {
+	q.RLock()
+	defer q.RUnlock()
+	if b, ok := q.bounds[chname]; ok {
+		return b.BlockTimeout
+	}
+	return 0
+}
+
+func (q *ChanQueue) length(chname string) uint64 {
+	if mt, ok := q.mats[chname]; ok {
+		return mt.tail - mt.head
+	}
+	return 0
+}
+
+func (q *ChanQueue) shrank(chname string, n, size uint64) {
+	b, ok := q.bounds[chname]
+	if !ok {
+		return
+	}
+	b.bytes -= size
+	q.refill(chname, q.spillOf(chname))
+	b.watermark(chname, q.length(chname))
+	q.space.notify(chname, int(n))
+}
+
+func (q *ChanQueue) grew(chname string, size uint64) {
+	b, ok := q.bounds[chname]
+	if !ok {
+		return
+	}
+	b.bytes += size
+	b.watermark(chname, q.length(chname))
+}
+
+func (q *ChanQueue) refill(chname string, spill *ChanQueue) error {
+	if spill == nil {
+		return nil
+	}
+	mark := spillMarkKey(chname, spill.DataDir)
+	for {
+		item, err := spill.Peek(chname)
+		if err == ErrEmpty || err == errChanNotExist {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if done, err := spillMoved(q.db, mark, item.ID); err != nil {
+			return err
+		} else if done {
+			if _, err := spill.Dequeue(chname); err != nil {
+				return err
+			}
+			continue
+		}
+		size := uint64(len(item.Value))
+		b, bounded := q.bounds[chname]
+		if bounded && !b.fits(q.length(chname), b.bytes, 1, size) {
+			return nil
+		}
+		batch := new(leveldb.Batch)
+		done := q.appendBatch(batch, q.matOf(chname), [][]byte{item.Value})
+		batch.Put(mark, IdToKeyPure(item.ID))
+		if err := q.db.Write(batch, nil); err != nil {
+			return err
+		}
+		done()
+		if _, err := spill.Dequeue(chname); err != nil {
+			return err
+		}
+	}
+}
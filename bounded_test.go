@@ -0,0 +1,221 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_Capacity(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.EnqueueString("a")
+	q.EnqueueString("b")
+	events := make([]WatermarkEvent, 0)
+	assert.NoError(t, q.SetCapacity(&Capacity{MaxItems: 3, MaxBytes: 10, HighWatermark: 1, LowWatermark: 0.34, OnWatermark: func(ev WatermarkEvent) {
+		events = append(events, ev)
+	}}))
+
+	//拒绝
+	_, err = q.EnqueueString("c")
+	assert.NoError(t, err)
+	_, err = q.EnqueueString("d")
+	assert.Equal(t, err, ErrFull)
+	assert.Equal(t, q.EnqueueBatch([][]byte{[]byte("e")}), ErrFull)
+	_, err = q.Enqueue(make([]byte, 11))
+	assert.Equal(t, err, ErrFull)
+	assert.Equal(t, q.Length(), uint64(3))
+	q.Dequeue()
+	q.Dequeue()
+	assert.Equal(t, events, []WatermarkEvent{{High: true, Items: 3, Bytes: 3}, {High: false, Items: 1, Bytes: 1}})
+
+	//删除最旧
+	q.SetCapacity(&Capacity{MaxBytes: 4, Policy: OverflowDropOldest})
+	q.EnqueueString("dd")
+	q.EnqueueString("ee")
+	assert.Equal(t, q.Length(), uint64(2))
+	item, _ := q.Peek()
+	assert.Equal(t, item.ToString(), "dd")
+
+	//阻塞直到有空间
+	q.SetCapacity(&Capacity{MaxItems: 2, Policy: OverflowBlock, BlockTimeout: 50 * time.Millisecond})
+	_, err = q.EnqueueString("f")
+	assert.Equal(t, err, ErrTimeout)
+	q.SetCapacity(&Capacity{MaxItems: 2, Policy: OverflowBlock})
+	done := make(chan error)
+	go func() {
+		_, err := q.EnqueueString("f")
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.Dequeue()
+	assert.NoError(t, <-done)
+	items, _ := q.PeekRange(0, 10)
+	assert.Equal(t, logValues(items), []string{"ee", "f"})
+}
+
+func TestQueue_CapacityUpdate(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.EnqueueString("aa")
+	q.EnqueueString("bb")
+	q.EnqueueString("cc")
+	q.SetCapacity(&Capacity{MaxBytes: 7})
+
+	//变长超出容量时拒绝，变短时释放占用
+	_, err = q.UpdateString(2, "bbbbbb")
+	assert.Equal(t, err, ErrFull)
+	_, err = q.UpdateString(2, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, q.bound.bytes, uint64(5))
+	_, err = q.UpdateString(2, "bbb")
+	assert.NoError(t, err)
+	assert.Equal(t, q.bound.bytes, uint64(7))
+
+	//删除最旧时只删除更早的数据
+	q.SetCapacity(&Capacity{MaxBytes: 7, Policy: OverflowDropOldest})
+	_, err = q.UpdateString(3, "cccc")
+	assert.NoError(t, err)
+	assert.Equal(t, q.Length(), uint64(2))
+	assert.Equal(t, q.bound.bytes, uint64(7))
+	_, err = q.UpdateString(2, "bbbbb")
+	assert.Equal(t, err, ErrFull)
+
+	//到期的延时消息只移入放得下的部分
+	q.SetCapacity(&Capacity{MaxItems: 3})
+	q.EnqueueAt([]byte("d1"), time.Now().Add(-time.Second))
+	q.EnqueueAt([]byte("d2"), time.Now().Add(-time.Second))
+	assert.Equal(t, q.Length(), uint64(3))
+	assert.Equal(t, q.tail-q.head, uint64(2))
+	q.Dequeue()
+	assert.Equal(t, q.tail-q.head, uint64(2))
+	assert.Equal(t, q.Length(), uint64(3))
+	assert.Equal(t, q.EnqueueAt(make([]byte, 10), time.Now()), nil)
+	q.SetCapacity(&Capacity{MaxBytes: 8})
+	assert.Equal(t, q.EnqueueAt(make([]byte, 10), time.Now()), ErrFull)
+}
+
+func TestQueue_CapacitySpill(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+	spill := file + "_spill"
+	defer os.RemoveAll(spill)
+
+	assert.Error(t, q.SetCapacity(&Capacity{MaxItems: 2, Policy: OverflowSpill}))
+	assert.NoError(t, q.SetCapacity(&Capacity{MaxItems: 2, Policy: OverflowSpill, SpillDir: spill}))
+	for i := 1; i <= 5; i++ {
+		item, err := q.EnqueueString("v" + strconv.Itoa(i))
+		assert.NoError(t, err)
+		if i > 2 {
+			assert.Equal(t, item.ID, uint64(0))
+		}
+	}
+	assert.Equal(t, q.Length(), uint64(2))
+	assert.Equal(t, q.SpillLength(), uint64(3))
+
+	//溢出数据按顺序移回
+	item, _ := q.Dequeue()
+	assert.Equal(t, item.ToString(), "v1")
+	assert.Equal(t, q.SpillLength(), uint64(2))
+	q.EnqueueString("v6")
+	order := []string{"v2", "v3", "v4", "v5", "v6"}
+	for _, v := range order {
+		item, err = q.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, item.ToString(), v)
+	}
+
+	//取消限制时溢出数据全部移回
+	q.EnqueueString("v7")
+	q.EnqueueString("v8")
+	q.EnqueueString("v9")
+	assert.NoError(t, q.SetCapacity(nil))
+	assert.Equal(t, q.Length(), uint64(3))
+	assert.Equal(t, q.SpillLength(), uint64(0))
+}
+
+func TestQueue_CapacitySpillResume(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+	spill := file + "_spill"
+	defer os.RemoveAll(spill)
+
+	assert.NoError(t, q.SetCapacity(&Capacity{MaxItems: 1, Policy: OverflowSpill, SpillDir: spill}))
+	for _, v := range []string{"v1", "v2", "v3"} {
+		q.EnqueueString(v)
+	}
+	//模拟 v2 已写入队列但未从溢出目录删除时崩溃
+	head, err := q.spill.Peek()
+	assert.NoError(t, err)
+	assert.NoError(t, q.db.Put(spillMarkKey("", spill), IdToKeyPure(head.ID), nil))
+	item, _ := q.Dequeue()
+	assert.Equal(t, item.ToString(), "v1")
+	item, _ = q.Dequeue()
+	assert.Equal(t, item.ToString(), "v3")
+	assert.Equal(t, q.SpillLength(), uint64(0))
+}
+
+func TestChanQueue_Capacity(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+	spill := file + "_spill"
+	defer os.RemoveAll(spill)
+
+	events := make([]WatermarkEvent, 0)
+	assert.NoError(t, q.SetCapacity("up", &Capacity{MaxItems: 2, Policy: OverflowSpill, SpillDir: spill, HighWatermark: 1, OnWatermark: func(ev WatermarkEvent) {
+		events = append(events, ev)
+	}}))
+	q.SetCapacity("ctl", &Capacity{MaxItems: 1})
+	for i := 1; i <= 5; i++ {
+		q.Enqueue("up", []byte("u"+strconv.Itoa(i)))
+	}
+	_, err = q.Enqueue("ctl", []byte("c1"))
+	assert.NoError(t, err)
+	_, err = q.Enqueue("ctl", []byte("c2"))
+	assert.Equal(t, err, ErrFull)
+	q.Enqueue("free", []byte("f1"))
+	q.Enqueue("free", []byte("f2"))
+
+	l, _ := q.Length("up")
+	assert.Equal(t, l, uint64(2))
+	assert.Equal(t, q.SpillLength("up"), uint64(3))
+	items, err := q.DequeueBatch("up", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, logValues(items), []string{"u1", "u2"})
+	l, _ = q.Length("up")
+	assert.Equal(t, l, uint64(2))
+	assert.Equal(t, q.SpillLength("up"), uint64(1))
+	assert.NoError(t, q.Clear("up"))
+	assert.Equal(t, q.SpillLength("up"), uint64(0))
+	item, _ := q.Dequeue("up")
+	assert.Equal(t, item.ToString(), "u5")
+	l, _ = q.Length("free")
+	assert.Equal(t, l, uint64(2))
+	assert.Equal(t, events, []WatermarkEvent{{Chan: "up", High: true, Items: 2, Bytes: 4}, {Chan: "up", High: false, Items: 0, Bytes: 0}})
+}
@@ -0,0 +1,452 @@
+package yiyidb
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//分组子库，提供与Kvdb一致的接口，数据与同名Mix分组共用
+type Bucket struct {
+	kv     *Kvdb
+	Name   string
+	prefix []byte
+}
+
+type BucketStats struct {
+	Name     string
+	Keys     int
+	Bytes    int64
+	DiskSize int64
+}
+
+func (k *Kvdb) Bucket(name string) *Bucket {
+	return &Bucket{kv: k, Name: name, prefix: nsPrefix(nsMix, name)}
+}
+
+//列出所有非空分组，每个分组只定位一次，按名称排序
+func (k *Kvdb) Buckets() []string {
+	names := make([]string, 0)
+	iter := k.db.NewIterator(util.BytesPrefix([]byte{nsMarker, nsMix}), k.iteratorOpts)
+	defer iter.Release()
+	for ok := iter.First(); ok; {
+		_, name, _, valid := nsSplit(iter.Key())
+		if !valid {
+			ok = iter.Next()
+			continue
+		}
+		names = append(names, name)
+		ok = iter.Seek(util.BytesPrefix(nsPrefix(nsMix, name)).Limit)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (k *Kvdb) DropBucket(name string) error {
+	return k.Bucket(name).Drop()
+}
+
+func (k *Kvdb) RenameBucket(name, newName string) error {
+	return k.Bucket(name).Rename(newName)
+}
+
+func (b *Bucket) key(key []byte) []byte {
+	nk := make([]byte, len(b.prefix)+len(key))
+	copy(nk, b.prefix)
+	copy(nk[len(b.prefix):], key)
+	return nk
+}
+
+func (b *Bucket) codec() Codec {
+	return b.kv.mixCodec(b.Name)
+}
+
+func (b *Bucket) SetCodec(c Codec) {
+	b.kv.SetMixCodec(b.Name, c)
+}
+
+func (b *Bucket) Exists(key []byte) bool {
+	return b.kv.Exists(b.key(key))
+}
+
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	return b.kv.Get(b.key(key))
+}
+
+func (b *Bucket) GetObject(key []byte, value interface{}) error {
+	data, err := b.Get(key)
+	if err != nil {
+		return err
+	}
+	if reflect.ValueOf(value).Kind() != reflect.Ptr {
+		return errors.New("not ptr")
+	}
+	return decodeValue(data, b.codec(), value)
+}
+
+func (b *Bucket) GetJson(key []byte, value interface{}) error {
+	data, err := b.Get(key)
+	if err != nil {
+		return err
+	}
+	if reflect.ValueOf(value).Kind() != reflect.Ptr {
+		return errors.New("not ptr")
+	}
+	return decodeValue(data, Json, value)
+}
+
+func (b *Bucket) Put(key, value []byte, ttl int) error {
+	b.kv.mixMu.RLock()
+	defer b.kv.mixMu.RUnlock()
+	return b.kv.put(b.key(key), value, ttl)
+}
+
+func (b *Bucket) PutObject(key []byte, value interface{}, ttl int) error {
+	return b.PutObjectWith(key, value, ttl, b.codec())
+}
+
+func (b *Bucket) PutObjectWith(key []byte, value interface{}, ttl int, c Codec) error {
+	msg, err := encodeValue(c, value)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, msg, ttl)
+}
+
+func (b *Bucket) PutJson(key []byte, value interface{}, ttl int) error {
+	return b.PutObjectWith(key, value, ttl, Json)
+}
+
+func (b *Bucket) BatPutOrDel(items *[]BatItem) error {
+	b.kv.mixMu.RLock()
+	defer b.kv.mixMu.RUnlock()
+	nitems := make([]BatItem, len(*items))
+	for i, v := range *items {
+		v.Key = b.key(v.Key)
+		nitems[i] = v
+	}
+	return b.kv.batPutOrDel(&nitems)
+}
+
+func (b *Bucket) Del(key []byte) error {
+	b.kv.mixMu.RLock()
+	defer b.kv.mixMu.RUnlock()
+	return b.kv.Del(b.key(key))
+}
+
+func (b *Bucket) SetTTL(key []byte, ttl int) error {
+	b.kv.mixMu.RLock()
+	defer b.kv.mixMu.RUnlock()
+	return b.kv.SetTTL(b.key(key), ttl)
+}
+
+func (b *Bucket) GetTTL(key []byte) (float64, error) {
+	return b.kv.GetTTL(b.key(key))
+}
+
+func (b *Bucket) NilTTL(key []byte) error {
+	b.kv.mixMu.RLock()
+	defer b.kv.mixMu.RUnlock()
+	return b.kv.NilTTL(b.key(key))
+}
+
+//遍历 rg 范围内 key <= max(非空时) 且匹配 regx(非空时) 的记录
+func (b *Bucket) scan(rg *util.Range, min, max []byte, regx *regexp.Regexp, fn func(key, value []byte)) {
+	iter := b.kv.db.NewIterator(rg, b.kv.iteratorOpts)
+	defer iter.Release()
+	ok := iter.First()
+	if min != nil {
+		ok = iter.Seek(min)
+	}
+	for ; ok; ok = iter.Next() {
+		if max != nil && bytes.Compare(iter.Key(), max) > 0 {
+			break
+		}
+		key := iter.Key()[len(b.prefix):]
+		if regx != nil && !regx.Match(key) {
+			continue
+		}
+		fn(key, iter.Value())
+	}
+}
+
+func (b *Bucket) kvItems(rg *util.Range, min, max []byte, regx *regexp.Regexp) []KvItem {
+	result := make([]KvItem, 0)
+	b.scan(rg, min, max, regx, func(key, value []byte) {
+		item := KvItem{}
+		item.Key = make([]byte, len(key))
+		item.Value = make([]byte, len(value))
+		copy(item.Key, key)
+		copy(item.Value, value)
+		result = append(result, item)
+	})
+	return result
+}
+
+func (b *Bucket) objItems(rg *util.Range, min, max []byte, regx *regexp.Regexp, Ntype interface{}, c Codec) []KvItem {
+	nt := reflect.TypeOf(Ntype)
+	if nt.Kind() == reflect.Ptr {
+		nt = nt.Elem()
+	}
+	result := make([]KvItem, 0)
+	b.scan(rg, min, max, regx, func(key, value []byte) {
+		t := reflect.New(nt).Interface()
+		if err := decodeValue(value, c, t); err == nil {
+			item := KvItem{}
+			item.Key = make([]byte, len(key))
+			copy(item.Key, key)
+			item.Object = t
+			result = append(result, item)
+		}
+	})
+	return result
+}
+
+func (b *Bucket) keys(rg *util.Range, regx *regexp.Regexp) []string {
+	var keys []string
+	b.scan(rg, nil, nil, regx, func(key, value []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+func (b *Bucket) AllByObject(Ntype interface{}) []KvItem {
+	return b.objItems(util.BytesPrefix(b.prefix), nil, nil, nil, Ntype, b.codec())
+}
+
+func (b *Bucket) AllByJson(Ntype interface{}) []KvItem {
+	return b.objItems(util.BytesPrefix(b.prefix), nil, nil, nil, Ntype, Json)
+}
+
+func (b *Bucket) AllByKV() []KvItem {
+	return b.kvItems(util.BytesPrefix(b.prefix), nil, nil, nil)
+}
+
+func (b *Bucket) AllKeys() []string {
+	return b.keys(util.BytesPrefix(b.prefix), nil)
+}
+
+func (b *Bucket) RegexpKeys(exp string) ([]string, error) {
+	regx, err := regexp.Compile(exp)
+	if err != nil {
+		return nil, err
+	}
+	return b.keys(util.BytesPrefix(b.prefix), regx), nil
+}
+
+func (b *Bucket) RegexpByKV(exp string) ([]KvItem, error) {
+	regx, err := regexp.Compile(exp)
+	if err != nil {
+		return nil, err
+	}
+	return b.kvItems(util.BytesPrefix(b.prefix), nil, nil, regx), nil
+}
+
+func (b *Bucket) RegexpByObject(exp string, Ntype interface{}) ([]KvItem, error) {
+	regx, err := regexp.Compile(exp)
+	if err != nil {
+		return nil, err
+	}
+	return b.objItems(util.BytesPrefix(b.prefix), nil, nil, regx, Ntype, b.codec()), nil
+}
+
+func (b *Bucket) KeyStartDels(key []byte) error {
+	b.kv.mixMu.RLock()
+	defer b.kv.mixMu.RUnlock()
+	return b.kv.KeyStartDels(b.key(key))
+}
+
+func (b *Bucket) KeyStartKeys(key []byte) []string {
+	return b.keys(util.BytesPrefix(b.key(key)), nil)
+}
+
+func (b *Bucket) KeyStart(key []byte) ([]KvItem, error) {
+	if len(key) > b.kv.maxkv {
+		return nil, errors.New("out of len")
+	}
+	return b.kvItems(util.BytesPrefix(b.key(key)), nil, nil, nil), nil
+}
+
+func (b *Bucket) KeyStartByObject(key []byte, Ntype interface{}) ([]KvItem, error) {
+	if len(key) > b.kv.maxkv {
+		return nil, errors.New("out of len")
+	}
+	return b.objItems(util.BytesPrefix(b.key(key)), nil, nil, nil, Ntype, b.codec()), nil
+}
+
+func (b *Bucket) KeyRange(min, max []byte) ([]KvItem, error) {
+	if len(min) > b.kv.maxkv || len(max) > b.kv.maxkv {
+		return nil, errors.New("out of len")
+	}
+	return b.kvItems(util.BytesPrefix(b.prefix), b.key(min), b.key(max), nil), nil
+}
+
+func (b *Bucket) KeyRangeByObject(min, max []byte, Ntype interface{}) ([]KvItem, error) {
+	if len(min) > b.kv.maxkv || len(max) > b.kv.maxkv {
+		return nil, errors.New("out of len")
+	}
+	return b.objItems(util.BytesPrefix(b.prefix), b.key(min), b.key(max), nil, Ntype, b.codec()), nil
+}
+
+//分组迭代器，Key 返回去除分组前缀后的key
+type bucketIter struct {
+	iterator.Iterator
+	prefix []byte
+}
+
+func (i *bucketIter) Key() []byte {
+	key := i.Iterator.Key()
+	if key == nil {
+		return nil
+	}
+	return key[len(i.prefix):]
+}
+
+func (i *bucketIter) Seek(key []byte) bool {
+	nk := make([]byte, len(i.prefix)+len(key))
+	copy(nk, i.prefix)
+	copy(nk[len(i.prefix):], key)
+	return i.Iterator.Seek(nk)
+}
+
+func (b *Bucket) Iter() iterator.Iterator {
+	return &bucketIter{Iterator: b.kv.db.NewIterator(util.BytesPrefix(b.prefix), b.kv.iteratorOpts), prefix: b.prefix}
+}
+
+func (b *Bucket) IterStartWith(key []byte) (iterator.Iterator, error) {
+	if len(key) > b.kv.maxkv {
+		return nil, errors.New("out of len")
+	}
+	return &bucketIter{Iterator: b.kv.db.NewIterator(util.BytesPrefix(b.key(key)), b.kv.iteratorOpts), prefix: b.prefix}, nil
+}
+
+func (b *Bucket) IterRelease(iter iterator.Iterator) {
+	iter.Release()
+}
+
+func (b *Bucket) Stats() (*BucketStats, error) {
+	rg := util.BytesPrefix(b.prefix)
+	st := &BucketStats{Name: b.Name}
+	b.scan(rg, nil, nil, nil, func(key, value []byte) {
+		st.Keys++
+		st.Bytes += int64(len(key) + len(value))
+	})
+	sizes, err := b.kv.db.SizeOf([]util.Range{*rg})
+	if err != nil {
+		return nil, err
+	}
+	st.DiskSize = sizes.Sum()
+	return st, nil
+}
+
+//按批删除分组全部数据后压缩该区间回收空间
+func (b *Bucket) Drop() error {
+	b.kv.mixMu.RLock()
+	defer b.kv.mixMu.RUnlock()
+	rg := util.BytesPrefix(b.prefix)
+	iter := b.kv.db.NewIterator(rg, b.kv.iteratorOpts)
+	batch := new(leveldb.Batch)
+	ops := make([]textOp, 0)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		ops = b.kv.textOp(ops, append([]byte{}, iter.Key()...), nil, true)
+		if b.kv.enableTtl {
+			b.kv.ttldb.DelTTL(iter.Key())
+		}
+		if batch.Len() >= migrateBatch {
+			if err := b.kv.dbWrite(batch, ops); err != nil {
+				iter.Release()
+				return err
+			}
+			batch = new(leveldb.Batch)
+			ops = ops[:0]
+		}
+	}
+	iter.Release()
+	if err := b.kv.dbWrite(batch, ops); err != nil {
+		return err
+	}
+	return b.kv.db.CompactRange(*rg)
+}
+
+//重命名进行中的标记，value 为 msgpack([原名, 新名])
+var renameKey = nsKey(nsState, "rename", nil)
+
+//重命名分组，目标分组需为空，TTL与编码器设置一并转移
+//期间所有分组写入被阻塞，写入要么在迁移前完成，要么在迁移后写到原名新建的分组
+//迁移前写入重命名标记，中途崩溃时下次打开会继续完成迁移
+//同一个 Bucket 对象不能在重命名时被其它协程使用
+func (b *Bucket) Rename(newName string) error {
+	if newName == b.Name {
+		return nil
+	}
+	b.kv.mixMu.Lock()
+	defer b.kv.mixMu.Unlock()
+	nb := b.kv.Bucket(newName)
+	iter := b.kv.db.NewIterator(util.BytesPrefix(nb.prefix), b.kv.iteratorOpts)
+	exists := iter.First()
+	iter.Release()
+	if exists {
+		return errors.New("bucket exists")
+	}
+	mark, err := msgpack.Marshal([]string{b.Name, newName})
+	if err != nil {
+		return err
+	}
+	if err := b.kv.db.Put(renameKey, mark, &opt.WriteOptions{Sync: true}); err != nil {
+		return err
+	}
+	if err := b.kv.moveBucket(b.Name, newName); err != nil {
+		return err
+	}
+	b.kv.Lock()
+	if c, ok := b.kv.mixCodecs[b.Name]; ok {
+		b.kv.mixCodecs[newName] = c
+		delete(b.kv.mixCodecs, b.Name)
+	}
+	b.kv.Unlock()
+	b.Name = newName
+	b.prefix = nb.prefix
+	return nil
+}
+
+//把分组数据迁移到新名称并重建相关索引，完成后删除重命名标记，可重复执行
+func (k *Kvdb) moveBucket(from, to string) error {
+	src, dst := nsPrefix(nsMix, from), nsPrefix(nsMix, to)
+	_, err := migrateKeys(k.db, util.BytesPrefix(src), func(key []byte) []byte {
+		nk := make([]byte, len(dst)+len(key)-len(src))
+		copy(nk, dst)
+		copy(nk[len(dst):], key[len(src):])
+		return nk
+	}, k.moveTTL)
+	if err != nil {
+		return err
+	}
+	if err := k.textRebuildPrefix(src, dst); err != nil {
+		return err
+	}
+	return k.db.Delete(renameKey, nil)
+}
+
+//打开时继续完成上次中断的重命名
+func (k *Kvdb) resumeRename() error {
+	mark, err := k.db.Get(renameKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var names []string
+	if err := msgpack.Unmarshal(mark, &names); err != nil || len(names) != 2 {
+		return errors.New("bad rename marker")
+	}
+	return k.moveBucket(names[0], names[1])
+}
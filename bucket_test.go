@@ -0,0 +1,180 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestBucket_Scoped(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, true, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	users := kv.Bucket("users")
+	users.Put([]byte("testkey1"), []byte("v1"), 0)
+	users.Put([]byte("testkey22"), []byte("v22"), 100)
+	users.Put([]byte("testke"), []byte("v3"), 0)
+	kv.Put([]byte("testkey1"), []byte("raw"), 0)
+	kv.Bucket("groups").Put([]byte("testkey1"), []byte("g1"), 0)
+
+	v, err := users.Get([]byte("testkey1"))
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("v1"))
+
+	mix, err := kv.GetMix("users", "testke")
+	assert.NoError(t, err)
+	assert.Equal(t, mix, []byte("v3"))
+
+	all, err := users.KeyRange([]byte("testkey"), []byte("testkey25"))
+	assert.NoError(t, err)
+	assert.Equal(t, len(all), 2)
+	assert.Equal(t, all[0].Key, []byte("testkey1"))
+
+	keys, err := users.RegexpKeys(`^testkey\d+$`)
+	assert.NoError(t, err)
+	assert.Equal(t, keys, []string{"testkey1", "testkey22"})
+
+	ttl, err := users.GetTTL([]byte("testkey22"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 90)
+
+	iter, err := users.IterStartWith([]byte("testkey"))
+	assert.NoError(t, err)
+	iter.Next()
+	assert.Equal(t, iter.Key(), []byte("testkey1"))
+	iter.Release()
+
+	type object struct {
+		Value int
+	}
+	users.PutObject([]byte("obj"), object{7}, 0)
+	var o object
+	assert.NoError(t, users.GetObject([]byte("obj"), &o))
+	assert.Equal(t, o.Value, 7)
+
+	assert.Equal(t, kv.Buckets(), []string{"groups", "users"})
+
+	st, err := users.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, st.Keys, 4)
+
+	assert.NoError(t, users.Rename("members"))
+	_, err = kv.GetMix("users", "testke")
+	assert.Error(t, err)
+	v, err = kv.Bucket("members").Get([]byte("testke"))
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("v3"))
+	ttl, err = users.GetTTL([]byte("testkey22"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 90)
+	assert.Error(t, kv.RenameBucket("groups", "members"))
+
+	assert.NoError(t, kv.DropBucket("members"))
+	assert.Equal(t, kv.Buckets(), []string{"groups"})
+	v, err = kv.Get([]byte("testkey1"))
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("raw"))
+
+	kv.Drop()
+}
+
+func TestBucket_RenameConcurrent(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Drop()
+
+	for i := 0; i < 2000; i++ {
+		kv.PutMix("old", fmt.Sprintf("k%04d", i), []byte("v0"), 0)
+	}
+	//重命名期间的覆盖写入不会丢失
+	last := make([]string, 2000)
+	for i := range last {
+		last[i] = "v0"
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 1; ; round++ {
+			for i := range last {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				last[i] = fmt.Sprintf("v%d", round)
+				kv.PutMix("old", fmt.Sprintf("k%04d", i), []byte(last[i]), 0)
+			}
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	errs := make(chan error, 2)
+	go func() { errs <- kv.RenameBucket("old", "new") }()
+	go func() { errs <- kv.RenameBucket("old", "new") }()
+	e1, e2 := <-errs, <-errs
+	close(stop)
+	<-done
+	//同名目标只有一次重命名成功
+	assert.True(t, (e1 == nil) != (e2 == nil))
+	for i := range last {
+		key := fmt.Sprintf("k%04d", i)
+		v, err := kv.GetMix("old", key)
+		if err != nil {
+			v, _ = kv.GetMix("new", key)
+		}
+		if string(v) != last[i] {
+			t.Fatalf("%s = %s, want %s", key, v, last[i])
+		}
+	}
+}
+
+func TestBucket_RenameResume(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, true, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	kv.PutMix("old", "k1", []byte("v1"), 0)
+	kv.PutMix("old", "k2", []byte("v2"), 100)
+	//模拟迁移了一部分后崩溃
+	kv.db.Put(idToKeyMix("new", "k1"), []byte("v1"), nil)
+	kv.db.Delete(idToKeyMix("old", "k1"), nil)
+	mark, _ := msgpack.Marshal([]string{"old", "new"})
+	kv.db.Put(renameKey, mark, nil)
+	kv.Close()
+
+	kv, err = OpenKvdb(dir, false, true, 10)
+	assert.NoError(t, err)
+	defer kv.Drop()
+	assert.Equal(t, len(kv.AllByKVMix("old")), 0)
+	assert.Equal(t, len(kv.AllByKVMix("new")), 2)
+	ttl, err := kv.Bucket("new").GetTTL([]byte("k2"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 90)
+	assert.False(t, kv.Exists(renameKey))
+}
@@ -0,0 +1,112 @@
+package yiyidb
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//分组元数据 nsChanMeta + 分组名，value 为 head + tail + count + bytes，与分组数据在同一batch中写入
+//打开时直接加载元数据，只有上次未正常关闭时才扫描全部分组数据重建
+const (
+	stateOpen   byte = 0
+	stateClosed byte = 1
+)
+
+var chanStateKey = nsKey(nsState, "chan", nil)
+
+func chanMetaKey(chname string) []byte {
+	return nsKey(nsChanMeta, chname, nil)
+}
+
+func isChanKey(key []byte) bool {
+	tag, _, sub, ok := nsSplit(key)
+	return ok && tag == nsChan && len(sub) == 8
+}
+
+func (m *mat) encode() []byte {
+	v := make([]byte, 0, 32)
+	v = append(v, IdToKeyPure(m.head)...)
+	v = append(v, IdToKeyPure(m.tail)...)
+	v = append(v, IdToKeyPure(m.count)...)
+	return append(v, IdToKeyPure(m.bytes)...)
+}
+
+func decodeMat(chname string, v []byte) (*mat, bool) {
+	if len(v) != 32 {
+		return nil, false
+	}
+	return &mat{mixName: chname, head: KeyToIDPure(v[:8]), tail: KeyToIDPure(v[8:16]), count: KeyToIDPure(v[16:24]), bytes: KeyToIDPure(v[24:])}, true
+}
+
+//取出队首 n 条共 size 字节后的游标
+func (m mat) popped(n, size uint64) mat {
+	m.head += n
+	m.count -= n
+	m.bytes -= size
+	return m
+}
+
+//返回上次是否正常关闭，并标记为打开状态
+func markOpen(db *leveldb.DB) (bool, error) {
+	v, err := db.Get(chanStateKey, nil)
+	clean := err == nil && len(v) == 1 && v[0] == stateClosed
+	return clean, db.Put(chanStateKey, []byte{stateOpen}, &opt.WriteOptions{Sync: true})
+}
+
+func markClosed(db *leveldb.DB) error {
+	return db.Put(chanStateKey, []byte{stateClosed}, &opt.WriteOptions{Sync: true})
+}
+
+//加载分组元数据，rebuild 时扫描分组数据重建并写回
+func loadMats(db *leveldb.DB, ro *opt.ReadOptions, rebuild bool) (map[string]*mat, error) {
+	mats := make(map[string]*mat)
+	iter := db.NewIterator(util.BytesPrefix([]byte{nsMarker, nsChanMeta}), ro)
+	for iter.Next() {
+		_, chname, _, ok := nsSplit(iter.Key())
+		if mt, valid := decodeMat(chname, iter.Value()); ok && valid {
+			mats[chname] = mt
+		}
+	}
+	err := iter.Error()
+	iter.Release()
+	if err != nil || !rebuild {
+		return mats, err
+	}
+	return rebuildMats(db, ro, mats)
+}
+
+//已取空的分组保留原来的 tail，ID 不复用
+func rebuildMats(db *leveldb.DB, ro *opt.ReadOptions, old map[string]*mat) (map[string]*mat, error) {
+	mats := make(map[string]*mat)
+	iter := db.NewIterator(util.BytesPrefix([]byte{nsMarker, nsChan}), ro)
+	for iter.Next() {
+		if !isChanKey(iter.Key()) {
+			continue
+		}
+		chname, id := keyName(iter.Key()), keyToID(iter.Key())
+		mt, ok := mats[chname]
+		if !ok {
+			mt = &mat{mixName: chname, head: id - 1}
+			mats[chname] = mt
+		}
+		mt.tail = id
+		mt.count++
+		mt.bytes += uint64(len(iter.Value()))
+	}
+	err := iter.Error()
+	iter.Release()
+	if err != nil {
+		return nil, err
+	}
+	for chname, o := range old {
+		if _, ok := mats[chname]; !ok {
+			mats[chname] = &mat{mixName: chname, head: o.tail, tail: o.tail}
+		}
+	}
+	batch := new(leveldb.Batch)
+	for chname, mt := range mats {
+		batch.Put(chanMetaKey(chname), mt.encode())
+	}
+	return mats, db.Write(batch, nil)
+}
@@ -0,0 +1,101 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanQueue_Meta(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+
+	q.Enqueue("a", []byte("a1"))
+	q.Enqueue("a", []byte("a22"))
+	q.Enqueue("a", []byte("a333"))
+	q.Enqueue("b", []byte("b1"))
+	q.Dequeue("a")
+	q.Dequeue("b")
+	assert.Equal(t, *q.mats["a"], mat{mixName: "a", head: 1, tail: 3, count: 2, bytes: 7})
+	q.Close()
+
+	//正常关闭后直接使用保存的元数据
+	q, err = OpenChanQueue(file, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, *q.mats["a"], mat{mixName: "a", head: 1, tail: 3, count: 2, bytes: 7})
+	assert.Equal(t, *q.mats["b"], mat{mixName: "b", head: 1, tail: 1})
+	q.db.Put(chanMetaKey("a"), (&mat{head: 1, tail: 9, count: 8}).encode(), nil)
+	q.Close()
+	q, err = OpenChanQueue(file, 10)
+	assert.NoError(t, err)
+	h, tail := q.GetMetal("a")
+	assert.Equal(t, h, uint64(1))
+	assert.Equal(t, tail, uint64(9))
+
+	//未正常关闭时扫描重建
+	q.db.Put(chanMetaKey("a"), (&mat{head: 1, tail: 9, count: 8}).encode(), nil)
+	q.db.Close()
+	q, err = OpenChanQueue(file, 10)
+	assert.NoError(t, err)
+	defer q.Drop()
+	assert.Equal(t, *q.mats["a"], mat{mixName: "a", head: 1, tail: 3, count: 2, bytes: 7})
+	assert.Equal(t, *q.mats["b"], mat{mixName: "b", head: 1, tail: 1})
+	item, _ := q.Enqueue("b", []byte("b2"))
+	assert.Equal(t, item.ID, uint64(2))
+	item, _ = q.Dequeue("a")
+	assert.Equal(t, item.ToString(), "a22")
+}
+
+func TestKvdb_ChanMeta(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, true, false, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	kv.PutChan("jac", []byte("v1"), 0)
+	kv.PutChan("jac", []byte("v22"), 0)
+	kv.PutChan("jac", []byte("v333"), 0)
+	kv.Del(idToKey("jac", 1))
+	kv.Del(idToKey("jac", 1))
+	kv.BatPutOrDelChan("jac", &[]BatItem{
+		{Op: "put", Key: idToKey("jac", 2), Value: []byte("x")},
+		{Op: "put", Key: idToKey("jac", 5), Value: []byte("v5")},
+		{Op: "del", Key: idToKey("jac", 5)},
+	})
+	kv.PutChan("yum", []byte("y1"), 0)
+	assert.NoError(t, kv.Clear("yum"))
+	assert.Equal(t, *kv.mats["jac"], mat{mixName: "jac", tail: 5, count: 2, bytes: 5})
+	kv.Close()
+
+	kv, err = OpenKvdb(dir, true, false, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, *kv.mats["jac"], mat{mixName: "jac", tail: 5, count: 2, bytes: 5})
+	count, tail := kv.getmtinfo("yum")
+	assert.Equal(t, count, uint64(0))
+	assert.Equal(t, tail, uint64(1))
+
+	//未正常关闭时扫描重建
+	kv.db.Put(chanMetaKey("jac"), (&mat{tail: 5, count: 9}).encode(), nil)
+	kv.db.Close()
+	kv, err = OpenKvdb(dir, true, false, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, *kv.mats["jac"], mat{mixName: "jac", head: 1, tail: 3, count: 2, bytes: 5})
+	kv.PutChan("yum", []byte("y2"), 0)
+	count, tail = kv.getmtinfo("yum")
+	assert.Equal(t, count, uint64(1))
+	assert.Equal(t, tail, uint64(2))
+
+	kv.Drop()
+}
@@ -0,0 +1,158 @@
+package yiyidb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//对象编码器，每个编码后的值前置 codecMagic + Id 两个字节标识
+type Codec interface {
+	Id() byte
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+//0xc1 在msgpack中永不使用，同时也不是合法的json首字节，可与旧数据区分
+const codecMagic byte = 0xc1
+
+const (
+	CodecMsgpack byte = 1
+	CodecJson    byte = 2
+	CodecGob     byte = 3
+	CodecProto   byte = 4
+)
+
+var (
+	Msgpack Codec = msgpackCodec{}
+	Json    Codec = jsonCodec{}
+	Gob     Codec = gobCodec{}
+	Proto   Codec = protoCodec{}
+
+	ErrCodecNotFound = errors.New("codec not found")
+	ErrNotProto      = errors.New("value not proto.Message")
+)
+
+var (
+	codecLock sync.RWMutex
+	codecs    = map[byte]Codec{
+		CodecMsgpack: Msgpack,
+		CodecJson:    Json,
+		CodecGob:     Gob,
+		CodecProto:   Proto,
+	}
+)
+
+//注册自定义编码器，Id不可与已注册的重复
+func RegisterCodec(c Codec) error {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	if _, ok := codecs[c.Id()]; ok {
+		return errors.New("codec id exists")
+	}
+	codecs[c.Id()] = c
+	return nil
+}
+
+func codecById(id byte) (Codec, error) {
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	if c, ok := codecs[id]; ok {
+		return c, nil
+	}
+	return nil, ErrCodecNotFound
+}
+
+func encodeValue(c Codec, value interface{}) ([]byte, error) {
+	msg, err := c.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(msg)+2)
+	data[0] = codecMagic
+	data[1] = c.Id()
+	copy(data[2:], msg)
+	return data, nil
+}
+
+//带标识的值按标识解码，旧版无标识的值使用 def 解码
+func decodeValue(data []byte, def Codec, value interface{}) error {
+	if len(data) >= 2 && data[0] == codecMagic {
+		c, err := codecById(data[1])
+		if err != nil {
+			return err
+		}
+		return c.Unmarshal(data[2:], value)
+	}
+	return def.Unmarshal(data, value)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Id() byte     { return CodecMsgpack }
+func (msgpackCodec) Name() string { return "msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Id() byte     { return CodecJson }
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Id() byte     { return CodecGob }
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Id() byte     { return CodecProto }
+func (protoCodec) Name() string { return "proto" }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProto
+	}
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProto
+	}
+	return proto.Unmarshal(data, m)
+}
@@ -0,0 +1,93 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestKvdb_PutObjectWith(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	type object struct {
+		Value int
+	}
+
+	//旧版无标识msgpack数据
+	legacy, _ := msgpack.Marshal(object{1})
+	kv.Put([]byte("testkey1"), legacy, 0)
+	kv.PutObjectWith([]byte("testkey2"), object{2}, 0, Json)
+	kv.PutObjectWith([]byte("testkey3"), &object{3}, 0, Gob)
+	kv.PutObject([]byte("testkey4"), object{4}, 0)
+
+	var o object
+	err = kv.GetObject([]byte("testkey3"), &o)
+	assert.NoError(t, err)
+	assert.Equal(t, o.Value, 3)
+
+	all := kv.AllByObject(o)
+	assert.Equal(t, len(all), 4)
+	for i, v := range all {
+		assert.Equal(t, v.Object, &object{i + 1})
+	}
+
+	kv.SetCodec(Json)
+	kv.PutObject([]byte("testkey5"), object{5}, 0)
+	v, err := kv.Get([]byte("testkey5"))
+	assert.NoError(t, err)
+	assert.Equal(t, v[1], CodecJson)
+
+	kv.Drop()
+}
+
+func TestKvdb_MixCodec(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	kv.SetMixCodec("pb", Proto)
+	err = kv.PutObjectMix("pb", "k1", &wrappers.StringValue{Value: "hello"}, 0)
+	assert.NoError(t, err)
+
+	var sv wrappers.StringValue
+	err = kv.GetObjectMix("pb", "k1", &sv)
+	assert.NoError(t, err)
+	assert.Equal(t, sv.Value, "hello")
+
+	err = kv.PutObjectMix("pb", "k2", "not proto", 0)
+	assert.Equal(t, err, ErrNotProto)
+
+	kv.Drop()
+}
+
+func TestMsgpackCodec_MarshalNil(t *testing.T) {
+	var p *wrappers.StringValue
+	for _, v := range []interface{}{nil, p} {
+		data, err := Msgpack.Marshal(v)
+		assert.NoError(t, err)
+		expect, _ := msgpack.Marshal(v)
+		assert.Equal(t, data, expect)
+	}
+}
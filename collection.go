@@ -0,0 +1,178 @@
+package yiyidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//泛型集合主键编码器
+type KeyEncoder[K any] interface {
+	EncodeKey(key K) []byte
+	DecodeKey(data []byte) (K, error)
+}
+
+type StringKeys struct{}
+
+func (StringKeys) EncodeKey(key string) []byte           { return []byte(key) }
+func (StringKeys) DecodeKey(data []byte) (string, error) { return string(data), nil }
+
+type BytesKeys struct{}
+
+func (BytesKeys) EncodeKey(key []byte) []byte { return key }
+func (BytesKeys) DecodeKey(data []byte) ([]byte, error) {
+	key := make([]byte, len(data))
+	copy(key, data)
+	return key, nil
+}
+
+type Uint64Keys struct{}
+
+func (Uint64Keys) EncodeKey(key uint64) []byte { return IdToKeyPure(key) }
+func (Uint64Keys) DecodeKey(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, errors.New("key not uint64")
+	}
+	return KeyToIDPure(data), nil
+}
+
+//翻转符号位使负数排在正数之前
+type Int64Keys struct{}
+
+func (Int64Keys) EncodeKey(key int64) []byte { return IdToKeyPure(uint64(key) ^ 1<<63) }
+func (Int64Keys) DecodeKey(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, errors.New("key not int64")
+	}
+	return int64(binary.BigEndian.Uint64(data) ^ 1<<63), nil
+}
+
+type Entry[K any, V any] struct {
+	Key   K
+	Value V
+}
+
+//解码失败的记录
+type DecodeError struct {
+	Key []byte
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode %q: %v", e.Key, e.Err)
+}
+
+//基于Kvdb前缀或Mix分组的强类型集合
+type Collection[K any, V any] struct {
+	kv     *Kvdb
+	prefix []byte
+	keys   KeyEncoder[K]
+	codec  Codec
+}
+
+func NewCollection[K any, V any](kv *Kvdb, prefix []byte, keys KeyEncoder[K]) *Collection[K, V] {
+	return &Collection[K, V]{kv: kv, prefix: prefix, keys: keys, codec: kv.defaultCodec()}
+}
+
+func NewMixCollection[K any, V any](kv *Kvdb, chname string, keys KeyEncoder[K]) *Collection[K, V] {
+	return &Collection[K, V]{kv: kv, prefix: idToKeyMix(chname, ""), keys: keys, codec: kv.mixCodec(chname)}
+}
+
+func (c *Collection[K, V]) WithCodec(codec Codec) *Collection[K, V] {
+	return &Collection[K, V]{kv: c.kv, prefix: c.prefix, keys: c.keys, codec: codec}
+}
+
+func (c *Collection[K, V]) key(key K) []byte {
+	k := c.keys.EncodeKey(key)
+	nk := make([]byte, len(c.prefix)+len(k))
+	copy(nk, c.prefix)
+	copy(nk[len(c.prefix):], k)
+	return nk
+}
+
+func (c *Collection[K, V]) decode(key, data []byte) (K, V, error) {
+	var value V
+	nk, err := c.keys.DecodeKey(key[len(c.prefix):])
+	if err != nil {
+		return nk, value, &DecodeError{Key: append([]byte{}, key...), Err: err}
+	}
+	//指针类型(如proto.Message)需先分配对象
+	var target interface{} = &value
+	if t := reflect.TypeOf(value); t != nil && t.Kind() == reflect.Ptr {
+		value = reflect.New(t.Elem()).Interface().(V)
+		target = value
+	}
+	if err := decodeValue(data, c.codec, target); err != nil {
+		return nk, value, &DecodeError{Key: append([]byte{}, key...), Err: err}
+	}
+	return nk, value, nil
+}
+
+func (c *Collection[K, V]) Exists(key K) bool {
+	return c.kv.Exists(c.key(key))
+}
+
+func (c *Collection[K, V]) Get(key K) (V, error) {
+	nk := c.key(key)
+	data, err := c.kv.Get(nk)
+	if err != nil {
+		var value V
+		return value, err
+	}
+	_, value, err := c.decode(nk, data)
+	return value, err
+}
+
+func (c *Collection[K, V]) Put(key K, value V, ttl int) error {
+	msg, err := encodeValue(c.codec, value)
+	if err != nil {
+		return err
+	}
+	//与 Bucket 写入一样不能与分组重命名并发
+	c.kv.mixMu.RLock()
+	defer c.kv.mixMu.RUnlock()
+	return c.kv.put(c.key(key), msg, ttl)
+}
+
+func (c *Collection[K, V]) Delete(key K) error {
+	c.kv.mixMu.RLock()
+	defer c.kv.mixMu.RUnlock()
+	return c.kv.Del(c.key(key))
+}
+
+//顺序遍历集合，fn返回错误或解码失败时停止并返回该错误
+func (c *Collection[K, V]) Scan(fn func(key K, value V) error) error {
+	iter := c.kv.db.NewIterator(util.BytesPrefix(c.prefix), c.kv.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		key, value, err := c.decode(iter.Key(), iter.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+//返回 min <= key <= max 的记录
+func (c *Collection[K, V]) Range(min, max K) ([]Entry[K, V], error) {
+	result := make([]Entry[K, V], 0)
+	rg := util.BytesPrefix(c.prefix)
+	maxKey := c.key(max)
+	iter := c.kv.db.NewIterator(rg, c.kv.iteratorOpts)
+	defer iter.Release()
+	for ok := iter.Seek(c.key(min)); ok && bytes.Compare(iter.Key(), maxKey) <= 0; ok = iter.Next() {
+		key, value, err := c.decode(iter.Key(), iter.Value())
+		if err != nil {
+			return result, err
+		}
+		result = append(result, Entry[K, V]{Key: key, Value: value})
+	}
+	return result, iter.Error()
+}
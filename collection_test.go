@@ -0,0 +1,87 @@
+package yiyidb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollection_Range(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	type object struct {
+		Value int
+	}
+
+	c := NewCollection[int64, object](kv, []byte("obj/"), Int64Keys{})
+	for i := -5; i <= 5; i++ {
+		assert.NoError(t, c.Put(int64(i), object{i}, 0))
+	}
+
+	o, err := c.Get(-3)
+	assert.NoError(t, err)
+	assert.Equal(t, o.Value, -3)
+
+	all, err := c.Range(-2, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, len(all), 4)
+	assert.Equal(t, all[0].Key, int64(-2))
+	assert.Equal(t, all[3].Value, object{1})
+
+	assert.NoError(t, c.Delete(-2))
+	assert.False(t, c.Exists(-2))
+
+	//解码失败需返回错误而非跳过
+	kv.Put(c.key(100), []byte("bad"), 0)
+	count := 0
+	err = c.Scan(func(key int64, value object) error {
+		count++
+		return nil
+	})
+	var de *DecodeError
+	assert.True(t, errors.As(err, &de))
+	assert.Equal(t, count, 10)
+
+	kv.Drop()
+}
+
+func TestCollection_Mix(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	c := NewMixCollection[string, *wrappers.StringValue](kv, "pb", StringKeys{}).WithCodec(Proto)
+	assert.NoError(t, c.Put("k1", &wrappers.StringValue{Value: "v1"}, 0))
+
+	v, err := c.Get("k1")
+	assert.NoError(t, err)
+	assert.Equal(t, v.Value, "v1")
+
+	var sv wrappers.StringValue
+	assert.NoError(t, kv.GetObjectMix("pb", "k1", &sv))
+	assert.Equal(t, sv.Value, "v1")
+
+	kv.Drop()
+}
@@ -0,0 +1,140 @@
+package yiyidb
+
+import (
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const defaultDedupWindow = 10 * time.Minute
+
+//去重记录 nsDedup + 分组名 + 去重ID，value 为到期时间 + 消息ID
+//到期索引 nsDedupDue + 分组名 + 到期时间 + 去重ID，打开及写入时清理已到期的记录
+func dedupKey(name, dedupID string) []byte {
+	return nsKey(nsDedup, name, []byte(dedupID))
+}
+
+func dedupDueKey(name string, due int64, dedupID string) []byte {
+	return nsKey(nsDedupDue, name, append(IdToKeyPure(uint64(due)), dedupID...))
+}
+
+//窗口内已写入过时返回首次写入的消息ID，数据仍在队列中时带上 Value，已被取出时 Value 为nil
+//首次写入溢出到 spill 队列时与当时的返回一致，ID 为0
+func findDedup(db *leveldb.DB, name, dedupID string, idFn func(id uint64) []byte) (*QueueItem, error) {
+	rec, err := db.Get(dedupKey(name, dedupID), nil)
+	if err == leveldb.ErrNotFound || (err == nil && (len(rec) != 16 || int64(KeyToIDPure(rec[:8])) <= time.Now().UnixNano())) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	item := &QueueItem{ID: KeyToIDPure(rec[8:])}
+	if item.ID > 0 {
+		item.Key = idFn(item.ID)
+		if v, err := db.Get(item.Key, nil); err == nil {
+			item.Value = v
+		} else if err != leveldb.ErrNotFound {
+			return nil, err
+		}
+	}
+	return item, nil
+}
+
+//把分组已到期记录的清理放入 batch
+func purgeDedup(db *leveldb.DB, batch *leveldb.Batch, name string, now int64) error {
+	iter := db.NewIterator(util.BytesPrefix(nsPrefix(nsDedupDue, name)), nil)
+	for iter.Next() {
+		_, _, sub, ok := nsSplit(iter.Key())
+		if !ok || len(sub) < 8 {
+			continue
+		}
+		if int64(KeyToIDPure(sub[:8])) > now {
+			break
+		}
+		batch.Delete(iter.Key())
+		//同一去重ID重新写入后旧的到期索引不再对应记录
+		key := dedupKey(name, string(sub[8:]))
+		if rec, err := db.Get(key, nil); err == nil && len(rec) == 16 && int64(KeyToIDPure(rec[:8])) <= now {
+			batch.Delete(key)
+		}
+	}
+	err := iter.Error()
+	iter.Release()
+	return err
+}
+
+//打开时清理所有分组已到期的记录，空闲的队列不会一直保留
+func sweepDedup(db *leveldb.DB) error {
+	now := time.Now().UnixNano()
+	batch := new(leveldb.Batch)
+	iter := db.NewIterator(util.BytesPrefix([]byte{nsMarker, nsDedupDue}), nil)
+	defer iter.Release()
+	for ok := iter.First(); ok; {
+		_, name, _, valid := nsSplit(iter.Key())
+		if !valid {
+			ok = iter.Next()
+			continue
+		}
+		if err := purgeDedup(db, batch, name, now); err != nil {
+			return err
+		}
+		ok = iter.Seek(util.BytesPrefix(nsPrefix(nsDedupDue, name)).Limit)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return db.Write(batch, nil)
+}
+
+//把去重记录及已到期记录的清理放入 batch
+func putDedup(db *leveldb.DB, batch *leveldb.Batch, name, dedupID string, id uint64, window time.Duration) error {
+	now := time.Now().UnixNano()
+	if err := purgeDedup(db, batch, name, now); err != nil {
+		return err
+	}
+	due := now + int64(window)
+	batch.Put(dedupKey(name, dedupID), append(IdToKeyPure(uint64(due)), IdToKeyPure(id)...))
+	batch.Put(dedupDueKey(name, due, dedupID), nil)
+	return nil
+}
+
+//设置去重窗口，窗口内重复的去重ID不再写入
+func (q *Queue) SetDedupWindow(d time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	q.dedupWindow = d
+}
+
+//去重ID在窗口内已写入过时忽略本次写入，返回首次写入的消息
+func (q *Queue) EnqueueDedup(dedupID string, value []byte) (*QueueItem, error) {
+	var items []*QueueItem
+	err := waitSpace(q.space, "", q.blockTimeout(), func() error {
+		var err error
+		items, err = q.enqueue([][]byte{value}, dedupID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items[0], nil
+}
+
+func (q *ChanQueue) SetDedupWindow(d time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	q.dedupWindow = d
+}
+
+func (q *ChanQueue) EnqueueDedup(chname, dedupID string, value []byte) (*QueueItem, error) {
+	var item *QueueItem
+	err := waitSpace(q.space, chname, q.blockTimeout(chname), func() error {
+		var err error
+		item, err = q.enqueue(chname, value, dedupID)
+		return err
+	})
+	return item, err
+}
@@ -0,0 +1,154 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestQueue_EnqueueDedup(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	item, err := q.EnqueueDedup("order-1", []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, item.ID, uint64(1))
+	item, err = q.EnqueueDedup("order-1", []byte("a-retry"))
+	assert.NoError(t, err)
+	assert.Equal(t, item.ID, uint64(1))
+	assert.Equal(t, item.ToString(), "a")
+	q.EnqueueDedup("order-2", []byte("b"))
+	assert.Equal(t, q.Length(), uint64(2))
+
+	//重启后窗口内仍然去重
+	q.Close()
+	q, err = OpenQueue(file)
+	assert.NoError(t, err)
+	defer q.Drop()
+	q.Dequeue()
+	//数据已被取出时返回首次写入的消息ID，Value 为nil
+	item, _ = q.EnqueueDedup("order-1", []byte("a-retry"))
+	assert.Equal(t, item.ID, uint64(1))
+	assert.Equal(t, item.Key, IdToKeyPure(1))
+	assert.Nil(t, item.Value)
+	assert.Equal(t, q.Length(), uint64(1))
+
+	//超出窗口后重新写入，到期记录被清理
+	q.SetDedupWindow(20 * time.Millisecond)
+	q.EnqueueDedup("order-3", []byte("c"))
+	time.Sleep(40 * time.Millisecond)
+	item, _ = q.EnqueueDedup("order-3", []byte("c"))
+	assert.Equal(t, item.ID, uint64(4))
+	var due int
+	iter := q.db.NewIterator(util.BytesPrefix([]byte{nsMarker, nsDedupDue}), nil)
+	for iter.Next() {
+		due++
+	}
+	iter.Release()
+	assert.Equal(t, due, 3)
+
+	//空闲队列重新打开时清理已到期的记录
+	time.Sleep(40 * time.Millisecond)
+	q.Close()
+	q, err = OpenQueue(file)
+	assert.NoError(t, err)
+	due = 0
+	iter = q.db.NewIterator(util.BytesPrefix([]byte{nsMarker, nsDedupDue}), nil)
+	for iter.Next() {
+		due++
+	}
+	iter.Release()
+	assert.Equal(t, due, 2)
+	_, err = q.db.Get(dedupKey("", "order-3"), nil)
+	assert.Error(t, err)
+	q.Close()
+}
+
+func TestQueue_EnqueueDedupSpill(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+	spill := file + "_spill"
+	defer os.RemoveAll(spill)
+
+	assert.NoError(t, q.SetCapacity(&Capacity{MaxItems: 1, Policy: OverflowSpill, SpillDir: spill}))
+	q.EnqueueString("first")
+	//溢出写入失败时不记录去重，重试可以写入
+	q.spill.maxkv = 0
+	_, err = q.EnqueueDedup("order-1", []byte("b"))
+	assert.Error(t, err)
+	q.spill.maxkv = 512 * MB
+	item, err := q.EnqueueDedup("order-1", []byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, item.ID, uint64(0))
+	assert.Equal(t, q.SpillLength(), uint64(1))
+	//溢出的消息被取出后，重复写入返回与首次写入相同的结果
+	q.Dequeue()
+	q.Dequeue()
+	item, err = q.EnqueueDedup("order-1", []byte("b-retry"))
+	assert.NoError(t, err)
+	assert.Equal(t, item.ID, uint64(0))
+	assert.Nil(t, item.Value)
+	assert.Equal(t, q.Length(), uint64(0))
+}
+
+func TestChanQueue_EnqueueDedup(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	item, _ := q.EnqueueDedup("a", "id-1", []byte("a1"))
+	assert.Equal(t, item.ID, uint64(1))
+	q.Dequeue("a")
+	item, _ = q.EnqueueDedup("a", "id-1", []byte("a1-retry"))
+	assert.Equal(t, item.ID, uint64(1))
+	assert.Equal(t, item.Key, idToKey("a", 1))
+	assert.Nil(t, item.Value)
+	//不同分组互不影响
+	item, _ = q.EnqueueDedup("b", "id-1", []byte("b1"))
+	assert.Equal(t, item.ID, uint64(1))
+	l, _ := q.Length("a")
+	assert.Equal(t, l, uint64(0))
+	l, _ = q.Length("b")
+	assert.Equal(t, l, uint64(1))
+
+	q.SetDedupWindow(20 * time.Millisecond)
+	q.EnqueueDedup("a", "id-2", []byte("a2"))
+	time.Sleep(40 * time.Millisecond)
+	item, _ = q.EnqueueDedup("a", "id-2", []byte("a2"))
+	assert.Equal(t, item.ID, uint64(3))
+}
+
+func TestChanQueue_EnqueueDedupSpill(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+	spill := file + "_spill"
+	defer os.RemoveAll(spill)
+
+	assert.NoError(t, q.SetCapacity("a", &Capacity{MaxItems: 1, Policy: OverflowSpill, SpillDir: spill}))
+	q.Enqueue("a", []byte("first"))
+	q.spills[spill].maxkv = 0
+	_, err = q.EnqueueDedup("a", "id-1", []byte("a1"))
+	assert.Error(t, err)
+	q.spills[spill].maxkv = 512 * MB
+	_, err = q.EnqueueDedup("a", "id-1", []byte("a1"))
+	assert.NoError(t, err)
+	assert.Equal(t, q.SpillLength("a"), uint64(1))
+}
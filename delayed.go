@@ -0,0 +1,311 @@
+package yiyidb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//延时消息索引 d+到期时间+序号，Dequeue 时把已到期消息按到期先后追加到队尾
+//早于1970年的到期时间按0处理，否则负数转成 uint64 后会排在所有正数之后
+func delayKey(name string, due int64, seq uint64) []byte {
+	if due < 0 {
+		due = 0
+	}
+	return nsKey(nsDelay, name, append(IdToKeyPure(uint64(due)), IdToKeyPure(seq)...))
+}
+
+//最大序号保存在 seqKey(delaySeqName)，与延时消息在同一batch中写入
+const delaySeqName = "delay"
+
+//各分组最早的到期时间，用于 nsDelay 及 nsFlightDue 这类 到期时间+序号 的索引，每个分组只定位第一个key
+func dueHeads(db *leveldb.DB, tag byte) (map[string]int64, error) {
+	heads := make(map[string]int64)
+	iter := db.NewIterator(util.BytesPrefix([]byte{nsMarker, tag}), nil)
+	defer iter.Release()
+	for ok := iter.First(); ok; {
+		_, name, sub, valid := nsSplit(iter.Key())
+		if !valid {
+			ok = iter.Next()
+			continue
+		}
+		if len(sub) == 16 {
+			heads[name] = int64(KeyToIDPure(sub[:8]))
+		}
+		ok = iter.Seek(util.BytesPrefix(nsPrefix(tag, name)).Limit)
+	}
+	return heads, iter.Error()
+}
+
+//延时消息及最大序号一起写入
+func putDelay(db *leveldb.DB, name string, due int64, last *uint64, value []byte) error {
+	seq := nextSeq(last)
+	batch := new(leveldb.Batch)
+	batch.Put(delayKey(name, due, seq), value)
+	batch.Put(seqKey(delaySeqName), IdToKeyPure(seq))
+	return db.Write(batch, nil)
+}
+
+//到期时间不晚于 now 的延时消息，next 为之后最早的到期时间，没有时为0
+func dueDelays(db *leveldb.DB, name string, now int64) (keys, values [][]byte, next int64, err error) {
+	iter := db.NewIterator(util.BytesPrefix(nsPrefix(nsDelay, name)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		_, _, sub, ok := nsSplit(iter.Key())
+		if !ok || len(sub) != 16 {
+			continue
+		}
+		if due := int64(KeyToIDPure(sub[:8])); due > now {
+			next = due
+			break
+		}
+		key := make([]byte, len(iter.Key()))
+		value := make([]byte, len(iter.Value()))
+		copy(key, iter.Key())
+		copy(value, iter.Value())
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return keys, values, next, iter.Error()
+}
+
+//有容量限制时只取放得下的前几条，其余留在延时区
+func fitDelays(b *bound, items uint64, keys, values [][]byte) ([][]byte, [][]byte) {
+	var n int
+	var size uint64
+	for n < len(keys) && b.fits(items, b.bytes+size, uint64(n)+1, uint64(len(values[n]))) {
+		size += uint64(len(values[n]))
+		n++
+	}
+	return keys[:n], values[:n]
+}
+
+//到期时间晚于 now 的延时消息数
+func delayCount(db *leveldb.DB, name string, now int64) uint64 {
+	var n uint64
+	iter := db.NewIterator(util.BytesPrefix(nsPrefix(nsDelay, name)), nil)
+	for iter.Next() {
+		if _, _, sub, ok := nsSplit(iter.Key()); ok && len(sub) == 16 && int64(KeyToIDPure(sub[:8])) > now {
+			n++
+		}
+	}
+	iter.Release()
+	return n
+}
+
+//只读查看时把已到期但未移入队列的延时消息接在队列中的 length 条之后，这部分没有 ID
+func appendDue(items []QueueItem, length, offset uint64, n int, values [][]byte) ([]QueueItem, error) {
+	var skip uint64
+	if offset > length {
+		skip = offset - length
+	}
+	if len(items) == 0 && skip >= uint64(len(values)) {
+		if length+uint64(len(values)) == 0 {
+			return nil, ErrEmpty
+		}
+		return nil, ErrOutOfBounds
+	}
+	if skip < uint64(len(values)) {
+		for _, v := range values[skip:] {
+			if n > 0 && len(items) >= n {
+				break
+			}
+			items = append(items, QueueItem{Value: v})
+		}
+	}
+	return items, nil
+}
+
+func (q *Queue) EnqueueDelayed(value []byte, delay time.Duration) error {
+	return q.EnqueueAt(value, time.Now().Add(delay))
+}
+
+//不早于 at 时刻才能被取出
+func (q *Queue) EnqueueAt(value []byte, at time.Time) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if len(value) > q.maxkv {
+		return errors.New("out of len 512M")
+	}
+	if q.bound != nil && !q.bound.fits(0, 0, 1, uint64(len(value))) {
+		return ErrFull
+	}
+	due := at.UnixNano()
+	if err := putDelay(q.db, "", due, &q.delaySeq, value); err != nil {
+		return err
+	}
+	q.waits.notifyAt("", due)
+	return nil
+}
+
+//未到期的延时消息数
+func (q *Queue) DelayedLength() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return 0
+	}
+	return delayCount(q.db, "", time.Now().UnixNano())
+}
+
+//已到期且放得下、下次 Dequeue 时会移入队尾的延时消息
+func (q *Queue) dueValues() ([][]byte, error) {
+	keys, values, _, err := dueDelays(q.db, "", time.Now().UnixNano())
+	if err != nil || q.bound == nil {
+		return values, err
+	}
+	_, values = fitDelays(q.bound, q.tail-q.head, keys, values)
+	return values, nil
+}
+
+//从 offset 开始查看最多 n 条，不移动已到期的延时消息
+func (q *Queue) peekItems(offset uint64, n int) ([]QueueItem, error) {
+	length := q.tail - q.head
+	var items []QueueItem
+	if offset < length {
+		var err error
+		if items, err = readItems(q.db, q.iteratorOpts, IdToKeyPure(q.head+offset+1), IdToKeyPure(q.tail+1), n, KeyToIDPure); err != nil {
+			return nil, err
+		}
+		if n > 0 && len(items) >= n {
+			return items, nil
+		}
+	}
+	values, err := q.dueValues()
+	if err != nil {
+		return nil, err
+	}
+	return appendDue(items, length, offset, n, values)
+}
+
+//把到期的延时消息追加到队尾
+func (q *Queue) promote() error {
+	keys, values, next, err := dueDelays(q.db, "", time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	q.waits.schedule("", next)
+	if q.bound != nil {
+		keys, values = fitDelays(q.bound, q.tail-q.head, keys, values)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	for i, key := range keys {
+		batch.Delete(key)
+		batch.Put(IdToKeyPure(q.tail+uint64(i)+1), values[i])
+	}
+	batch.Put(seqKey(""), IdToKeyPure(q.tail+uint64(len(keys))))
+	if err := q.db.Write(batch, nil); err != nil {
+		return err
+	}
+	q.tail += uint64(len(keys))
+	var size uint64
+	for _, v := range values {
+		size += uint64(len(v))
+	}
+	q.grew(size)
+	q.waits.notify("", len(keys))
+	return nil
+}
+
+func (q *ChanQueue) EnqueueDelayed(chname string, value []byte, delay time.Duration) error {
+	return q.EnqueueAt(chname, value, time.Now().Add(delay))
+}
+
+func (q *ChanQueue) EnqueueAt(chname string, value []byte, at time.Time) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if len(value) > q.maxkv {
+		return errors.New("out of len 512M")
+	}
+	if b, ok := q.bounds[chname]; ok && !b.fits(0, 0, 1, uint64(len(value))) {
+		return ErrFull
+	}
+	due := at.UnixNano()
+	if err := putDelay(q.db, chname, due, &q.delaySeq, value); err != nil {
+		return err
+	}
+	q.waits.notifyAt(chname, due)
+	return nil
+}
+
+func (q *ChanQueue) DelayedLength(chname string) uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return 0
+	}
+	return delayCount(q.db, chname, time.Now().UnixNano())
+}
+
+func (q *ChanQueue) dueValues(chname string) ([][]byte, error) {
+	keys, values, _, err := dueDelays(q.db, chname, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := q.bounds[chname]; ok {
+		_, values = fitDelays(b, q.length(chname), keys, values)
+	}
+	return values, nil
+}
+
+//分组不存在且没有已到期的延时消息时返回 errChanNotExist
+func (q *ChanQueue) peekItems(chname string, offset uint64, n int) ([]QueueItem, error) {
+	mt, ok := q.mats[chname]
+	var length uint64
+	var items []QueueItem
+	if ok {
+		length = mt.tail - mt.head
+	}
+	if offset < length {
+		var err error
+		if items, err = readItems(q.db, q.iteratorOpts, idToKey(chname, mt.head+offset+1), idToKey(chname, mt.tail+1), n, keyToID); err != nil {
+			return nil, err
+		}
+		if n > 0 && len(items) >= n {
+			return items, nil
+		}
+	}
+	values, err := q.dueValues(chname)
+	if err != nil {
+		return nil, err
+	}
+	if !ok && len(values) == 0 {
+		return nil, errChanNotExist
+	}
+	return appendDue(items, length, offset, n, values)
+}
+
+func (q *ChanQueue) promote(chname string) error {
+	keys, values, next, err := dueDelays(q.db, chname, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	q.waits.schedule(chname, next)
+	if b, ok := q.bounds[chname]; ok {
+		keys, values = fitDelays(b, q.length(chname), keys, values)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+	done := q.appendBatch(batch, q.matOf(chname), values)
+	if err := q.db.Write(batch, nil); err != nil {
+		return err
+	}
+	done()
+	return nil
+}
@@ -0,0 +1,155 @@
+package yiyidb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_EnqueueDelayed(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	now := time.Now()
+	assert.NoError(t, q.EnqueueAt([]byte("late"), now.Add(300*time.Millisecond)))
+	assert.NoError(t, q.EnqueueAt([]byte("early"), now.Add(100*time.Millisecond)))
+	assert.NoError(t, q.EnqueueDelayed([]byte("early-2"), 100*time.Millisecond))
+	q.EnqueueString("now")
+	assert.Equal(t, q.DelayedLength(), uint64(3))
+
+	item, err := q.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "now")
+	_, err = q.Dequeue()
+	assert.Equal(t, err, ErrEmpty)
+
+	//到期后按到期先后出队，重启后延时消息保持
+	q.Close()
+	q, err = OpenQueue(file)
+	assert.NoError(t, err)
+	time.Sleep(150 * time.Millisecond)
+	item, _ = q.Dequeue()
+	assert.Equal(t, item.ToString(), "early")
+	item, _ = q.Dequeue()
+	assert.Equal(t, item.ToString(), "early-2")
+	assert.Equal(t, q.DelayedLength(), uint64(1))
+
+	//阻塞读取在到期时被唤醒
+	item, err = q.DequeueTimeout(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "late")
+	assert.Equal(t, q.DelayedLength(), uint64(0))
+}
+
+func TestChanQueue_EnqueueDelayed(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	assert.NoError(t, q.EnqueueDelayed("retry", []byte("r1"), 100*time.Millisecond))
+	assert.NoError(t, q.EnqueueDelayed("other", []byte("o1"), time.Hour))
+	_, err = q.Dequeue("retry")
+	assert.Error(t, err)
+	assert.Equal(t, q.DelayedLength("retry"), uint64(1))
+
+	item, err := q.DequeueTimeout("retry", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "r1")
+	assert.Equal(t, q.DelayedLength("other"), uint64(1))
+
+	q.Enqueue("other", []byte("o2"))
+	assert.NoError(t, q.Clear("other"))
+	assert.Equal(t, q.DelayedLength("other"), uint64(0))
+}
+
+func TestQueue_DelayTimer(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	//每个分组只保留一个指向最早到期时间的定时器
+	for i := 0; i < 100; i++ {
+		q.EnqueueDelayed([]byte("later"), time.Hour+time.Duration(i)*time.Second)
+	}
+	q.EnqueueDelayed([]byte("soon"), 50*time.Millisecond)
+	assert.Equal(t, len(q.waits.timers), 1)
+	assert.Equal(t, time.Until(time.Unix(0, q.waits.timers[timerKey{}].due)) < time.Second, true)
+
+	item, err := q.DequeueTimeout(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "soon")
+	assert.Equal(t, len(q.waits.timers), 1)
+	assert.Equal(t, time.Until(time.Unix(0, q.waits.timers[timerKey{}].due)) > time.Hour-time.Minute, true)
+
+	q.Close()
+	assert.Equal(t, len(q.waits.timers), 0)
+}
+
+func TestQueue_DelayedPeek(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	//已到期的延时消息计入 Length 并可被 Peek 到
+	q.EnqueueAt([]byte("due"), time.Now().Add(-time.Second))
+	q.EnqueueDelayed([]byte("later"), time.Hour)
+	assert.Equal(t, q.Length(), uint64(1))
+	item, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "due")
+	assert.Equal(t, item.ID, uint64(0))
+	items, _ := q.PeekRange(0, 10)
+	assert.Equal(t, len(items), 1)
+	assert.Equal(t, q.DelayedLength(), uint64(1))
+	//Peek 不移动数据
+	assert.Equal(t, q.tail-q.head, uint64(0))
+	item, err = q.Dequeue()
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "due")
+	assert.Equal(t, item.ID, uint64(1))
+
+	//早于1970年的到期时间排在最前
+	q.EnqueueAt([]byte("b"), time.Now().Add(-time.Second))
+	q.EnqueueAt([]byte("a"), time.Unix(-100, 0))
+	items, _ = q.PeekRange(0, 10)
+	assert.Equal(t, logValues(items), []string{"a", "b"})
+}
+
+func TestChanQueue_DelayedPeek(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.EnqueueAt("a", []byte("due"), time.Now().Add(-time.Second))
+	l, err := q.Length("a")
+	assert.NoError(t, err)
+	assert.Equal(t, l, uint64(1))
+	item, err := q.Peek("a")
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "due")
+	items, _ := q.PeekRange("a", 0, 10)
+	assert.Equal(t, len(items), 1)
+	_, ok := q.mats["a"]
+	assert.Equal(t, ok, false)
+	item, err = q.Dequeue("a")
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "due")
+}
@@ -0,0 +1,732 @@
+package yiyidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//全文索引: 定义保存在 X+name，索引数据保存在 x+name 下
+//倒排 t+term+0x00+key -> uvarint(文档长度)+词位置，正排 d+key -> 文档长度及词列表，元数据 -> 文档数+总长度
+const (
+	textTermSub byte = 't'
+	textDocSub  byte = 'd'
+	textK1           = 1.2
+	textB            = 0.75
+)
+
+var ErrTextIndexNotFound = errors.New("text index not found")
+
+var defaultStopWords = []string{"a", "an", "and", "are", "as", "at", "be", "by", "for", "from", "in", "is", "it", "of", "on", "or", "that", "the", "to", "was", "were", "with"}
+
+type TextIndexOptions struct {
+	//对象字段路径，如 "Desc"、"Device.Name"，为空时整个值作为文本
+	Fields []string
+	//nil 使用默认英文停用词
+	StopWords []string
+}
+
+type textConfig struct {
+	Prefix    []byte
+	Bucket    string
+	Fields    []string
+	StopWords []string
+}
+
+type TextIndex struct {
+	kv   *Kvdb
+	Name string
+	conf textConfig
+	stop map[string]bool
+}
+
+type TextHit struct {
+	Key   []byte
+	Score float64
+}
+
+type textToken struct {
+	term string
+	pos  int
+}
+
+type textDoc struct {
+	Len   int
+	Terms []string
+}
+
+type textPosting struct {
+	docLen    int
+	positions []int
+}
+
+type textOp struct {
+	key   []byte
+	value []byte
+	del   bool
+}
+
+func newTextIndex(k *Kvdb, name string, conf textConfig) *TextIndex {
+	t := &TextIndex{kv: k, Name: name, conf: conf, stop: make(map[string]bool)}
+	for _, w := range conf.StopWords {
+		t.stop[w] = true
+	}
+	return t
+}
+
+func textTermPrefix(name, term string) []byte {
+	return append(nsKey(nsText, name, []byte{textTermSub}), term...)
+}
+
+func textPostingKey(name, term string, key []byte) []byte {
+	pk := append(textTermPrefix(name, term), 0)
+	return append(pk, key...)
+}
+
+func textDocKey(name string, key []byte) []byte {
+	return append(nsKey(nsText, name, []byte{textDocSub}), key...)
+}
+
+//分词: 字母数字连续为一个词并转小写，汉字逐字成词，位置计入停用词
+func (t *TextIndex) tokenize(text string, stop bool) []textToken {
+	tokens := make([]textToken, 0)
+	word := make([]rune, 0)
+	pos := 0
+	emit := func(term string) {
+		if !stop || !t.stop[term] {
+			tokens = append(tokens, textToken{term: term, pos: pos})
+		}
+		pos++
+	}
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			if len(word) > 0 {
+				emit(string(word))
+				word = word[:0]
+			}
+			emit(string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, unicode.ToLower(r))
+		case len(word) > 0:
+			emit(string(word))
+			word = word[:0]
+		}
+	}
+	if len(word) > 0 {
+		emit(string(word))
+	}
+	return tokens
+}
+
+func (t *TextIndex) codec() Codec {
+	if t.conf.Bucket != "" {
+		return t.kv.mixCodec(t.conf.Bucket)
+	}
+	return t.kv.defaultCodec()
+}
+
+func textField(v interface{}, path []string) (interface{}, bool) {
+	for _, p := range path {
+		var ok bool
+		switch m := v.(type) {
+		case map[string]interface{}:
+			v, ok = m[p]
+		case map[interface{}]interface{}:
+			v, ok = m[p]
+		}
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+//取出待索引文本，对象解码失败时不索引
+func (t *TextIndex) text(value []byte) string {
+	if len(t.conf.Fields) == 0 {
+		return string(value)
+	}
+	var obj map[string]interface{}
+	if err := decodeValue(value, t.codec(), &obj); err != nil {
+		return ""
+	}
+	parts := make([]string, 0, len(t.conf.Fields))
+	for _, f := range t.conf.Fields {
+		if v, ok := textField(obj, strings.Split(f, ".")); ok && v != nil {
+			parts = append(parts, fmt.Sprint(v))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+//分组索引只覆盖分组内的key，普通前缀索引不覆盖0xff开头的内部key
+func (t *TextIndex) covers(key []byte) bool {
+	if !bytes.HasPrefix(key, t.conf.Prefix) {
+		return false
+	}
+	return t.conf.Bucket != "" || !isReservedKey(key)
+}
+
+func (t *TextIndex) dataRange() *util.Range {
+	if len(t.conf.Prefix) == 0 {
+		return &util.Range{Limit: []byte{nsMarker}}
+	}
+	return util.BytesPrefix(t.conf.Prefix)
+}
+
+//一次写入中的索引变更，同一key多次变更以最后一次为准
+type textBatch struct {
+	kv    *Kvdb
+	batch *leveldb.Batch
+	docs  map[string]*textDoc
+	meta  map[string]*[2]uint64
+}
+
+func newTextBatch(k *Kvdb, batch *leveldb.Batch) *textBatch {
+	return &textBatch{kv: k, batch: batch, docs: make(map[string]*textDoc), meta: make(map[string]*[2]uint64)}
+}
+
+func (b *textBatch) loadMeta(name string) *[2]uint64 {
+	if m, ok := b.meta[name]; ok {
+		return m
+	}
+	m := new([2]uint64)
+	if val, err := b.kv.db.Get(nsMetaKey(nsText, name), nil); err == nil && len(val) >= 16 {
+		m[0] = KeyToIDPure(val[:8])
+		m[1] = KeyToIDPure(val[8:16])
+	}
+	b.meta[name] = m
+	return m
+}
+
+func (b *textBatch) doc(t *TextIndex, key []byte) *textDoc {
+	id := t.Name + "\x00" + string(key)
+	if d, ok := b.docs[id]; ok {
+		return d
+	}
+	val, err := b.kv.db.Get(textDocKey(t.Name, key), nil)
+	if err != nil {
+		return nil
+	}
+	d := &textDoc{}
+	if msgpack.Unmarshal(val, d) != nil {
+		return nil
+	}
+	return d
+}
+
+func (b *textBatch) remove(t *TextIndex, key []byte) {
+	d := b.doc(t, key)
+	if d == nil {
+		return
+	}
+	for _, term := range d.Terms {
+		b.batch.Delete(textPostingKey(t.Name, term, key))
+	}
+	b.batch.Delete(textDocKey(t.Name, key))
+	m := b.loadMeta(t.Name)
+	m[0]--
+	m[1] -= uint64(d.Len)
+	b.docs[t.Name+"\x00"+string(key)] = nil
+}
+
+func (b *textBatch) add(t *TextIndex, key, value []byte) {
+	tokens := t.tokenize(t.text(value), true)
+	if len(tokens) == 0 {
+		return
+	}
+	d := &textDoc{Len: len(tokens), Terms: make([]string, 0)}
+	positions := make(map[string][]int)
+	for _, tk := range tokens {
+		if _, ok := positions[tk.term]; !ok {
+			d.Terms = append(d.Terms, tk.term)
+		}
+		positions[tk.term] = append(positions[tk.term], tk.pos)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, term := range d.Terms {
+		val := make([]byte, 0)
+		val = append(val, buf[:binary.PutUvarint(buf, uint64(d.Len))]...)
+		last := 0
+		for _, p := range positions[term] {
+			val = append(val, buf[:binary.PutUvarint(buf, uint64(p-last))]...)
+			last = p
+		}
+		b.batch.Put(textPostingKey(t.Name, term, key), val)
+	}
+	data, _ := msgpack.Marshal(d)
+	b.batch.Put(textDocKey(t.Name, key), data)
+	m := b.loadMeta(t.Name)
+	m[0]++
+	m[1] += uint64(d.Len)
+	b.docs[t.Name+"\x00"+string(key)] = d
+}
+
+func (b *textBatch) flush() {
+	for name, m := range b.meta {
+		if m[0] == 0 {
+			b.batch.Delete(nsMetaKey(nsText, name))
+			continue
+		}
+		b.batch.Put(nsMetaKey(nsText, name), append(IdToKeyPure(m[0]), IdToKeyPure(m[1])...))
+	}
+	b.meta = make(map[string]*[2]uint64)
+}
+
+func parsePosting(val []byte) textPosting {
+	l, n := binary.Uvarint(val)
+	p := textPosting{docLen: int(l)}
+	last := 0
+	for i := n; i < len(val); {
+		d, n := binary.Uvarint(val[i:])
+		if n <= 0 {
+			break
+		}
+		last += int(d)
+		p.positions = append(p.positions, last)
+		i += n
+	}
+	return p
+}
+
+func (k *Kvdb) textCovers(key []byte) bool {
+	k.textMu.Lock()
+	defer k.textMu.Unlock()
+	for _, t := range k.texts {
+		if t.covers(key) {
+			return true
+		}
+	}
+	return false
+}
+
+//有全文索引覆盖的key追加到 ops
+func (k *Kvdb) textOp(ops []textOp, key, value []byte, del bool) []textOp {
+	if k.textCovers(key) {
+		ops = append(ops, textOp{key: key, value: value, del: del})
+	}
+	return ops
+}
+
+//索引变更并入 batch 一起写入，保证数据与索引一致
+func (k *Kvdb) textWrite(batch *leveldb.Batch, ops []textOp) error {
+	k.textMu.Lock()
+	defer k.textMu.Unlock()
+	tb := newTextBatch(k, batch)
+	for _, op := range ops {
+		for _, t := range k.texts {
+			if !t.covers(op.key) {
+				continue
+			}
+			tb.remove(t, op.key)
+			if !op.del {
+				tb.add(t, op.key, op.value)
+			}
+		}
+	}
+	tb.flush()
+	return k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) dbWrite(batch *leveldb.Batch, ops []textOp) error {
+	if len(ops) == 0 {
+		return k.db.Write(batch, nil)
+	}
+	return k.textWrite(batch, ops)
+}
+
+func (k *Kvdb) dbPut(key, value []byte) error {
+	ops := k.textOp(nil, key, value, false)
+	if len(ops) == 0 {
+		return k.db.Put(key, value, nil)
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(key, value)
+	return k.textWrite(batch, ops)
+}
+
+func (k *Kvdb) dbDelete(key []byte) error {
+	ops := k.textOp(nil, key, nil, true)
+	if len(ops) == 0 {
+		return k.db.Delete(key, nil)
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(key)
+	return k.textWrite(batch, ops)
+}
+
+//超时删除时同步清理索引
+func (k *Kvdb) writeExpired(batch *leveldb.Batch, keys [][]byte) error {
+	ops := make([]textOp, 0)
+	for _, key := range keys {
+		ops = k.textOp(ops, key, nil, true)
+	}
+	if !k.enableChan {
+		return k.dbWrite(batch, ops)
+	}
+	//chan模式下超时删除的分组数据同步更新分组元数据
+	k.Lock()
+	defer k.Unlock()
+	s := k.newChanStage()
+	for _, key := range keys {
+		if err := s.apply(key, nil, true); err != nil {
+			return err
+		}
+	}
+	return s.write(batch, ops)
+}
+
+func (k *Kvdb) loadTextIndexes() error {
+	iter := k.db.NewIterator(util.BytesPrefix([]byte{nsMarker, nsTextDef}), k.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		_, name, _, ok := nsSplit(iter.Key())
+		if !ok {
+			continue
+		}
+		var conf textConfig
+		if err := msgpack.Unmarshal(iter.Value(), &conf); err != nil {
+			return err
+		}
+		k.texts[name] = newTextIndex(k, name, conf)
+	}
+	return iter.Error()
+}
+
+//新建全文索引并索引前缀下已有数据，索引定义持久化，重新打开后自动生效
+func (k *Kvdb) CreateTextIndex(name string, prefix []byte, opts *TextIndexOptions) (*TextIndex, error) {
+	return k.createTextIndex(name, textConfig{Prefix: prefix}, opts)
+}
+
+//新建覆盖整个分组的全文索引，查询结果返回分组内的key
+func (b *Bucket) CreateTextIndex(name string, opts *TextIndexOptions) (*TextIndex, error) {
+	return b.kv.createTextIndex(name, textConfig{Prefix: b.prefix, Bucket: b.Name}, opts)
+}
+
+func (k *Kvdb) createTextIndex(name string, conf textConfig, opts *TextIndexOptions) (*TextIndex, error) {
+	conf.StopWords = defaultStopWords
+	if opts != nil {
+		conf.Fields = opts.Fields
+		if opts.StopWords != nil {
+			conf.StopWords = opts.StopWords
+		}
+	}
+	k.textMu.Lock()
+	defer k.textMu.Unlock()
+	if _, ok := k.texts[name]; ok {
+		return nil, errors.New("text index exists")
+	}
+	data, err := msgpack.Marshal(&conf)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.db.Put(nsPrefix(nsTextDef, name), data, nil); err != nil {
+		return nil, err
+	}
+	t := newTextIndex(k, name, conf)
+	k.texts[name] = t
+	return t, k.textRebuild(t)
+}
+
+func (k *Kvdb) TextIndex(name string) (*TextIndex, error) {
+	k.textMu.Lock()
+	defer k.textMu.Unlock()
+	t, ok := k.texts[name]
+	if !ok {
+		return nil, ErrTextIndexNotFound
+	}
+	return t, nil
+}
+
+func (k *Kvdb) TextIndexes() []string {
+	k.textMu.Lock()
+	defer k.textMu.Unlock()
+	names := make([]string, 0, len(k.texts))
+	for name := range k.texts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//删除索引定义及全部索引数据，不影响原数据
+func (k *Kvdb) DropTextIndex(name string) error {
+	k.textMu.Lock()
+	defer k.textMu.Unlock()
+	if _, ok := k.texts[name]; !ok {
+		return ErrTextIndexNotFound
+	}
+	delete(k.texts, name)
+	if err := k.db.Delete(nsPrefix(nsTextDef, name), nil); err != nil {
+		return err
+	}
+	return k.textPurge(name)
+}
+
+func (k *Kvdb) textPurge(name string) error {
+	batch := new(leveldb.Batch)
+	iter := k.db.NewIterator(util.BytesPrefix(nsPrefix(nsText, name)), k.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		if batch.Len() >= migrateBatch {
+			if err := k.db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	return k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) textRebuild(t *TextIndex) error {
+	if err := k.textPurge(t.Name); err != nil {
+		return err
+	}
+	tb := newTextBatch(k, new(leveldb.Batch))
+	iter := k.db.NewIterator(t.dataRange(), k.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		if !t.covers(iter.Key()) {
+			continue
+		}
+		tb.add(t, iter.Key(), iter.Value())
+		if tb.batch.Len() >= migrateBatch {
+			tb.flush()
+			if err := k.db.Write(tb.batch, nil); err != nil {
+				return err
+			}
+			tb = newTextBatch(k, new(leveldb.Batch))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	tb.flush()
+	return k.db.Write(tb.batch, nil)
+}
+
+//重建与前缀有交叠的索引，用于分组整体迁移后
+func (k *Kvdb) textRebuildPrefix(prefixes ...[]byte) error {
+	k.textMu.Lock()
+	defer k.textMu.Unlock()
+	for _, t := range k.texts {
+		for _, p := range prefixes {
+			if bytes.HasPrefix(t.conf.Prefix, p) || bytes.HasPrefix(p, t.conf.Prefix) {
+				if err := k.textRebuild(t); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+//清除索引数据后重新索引前缀下的全部记录
+func (t *TextIndex) Rebuild() error {
+	t.kv.textMu.Lock()
+	defer t.kv.textMu.Unlock()
+	return t.kv.textRebuild(t)
+}
+
+//已索引的文档数
+func (t *TextIndex) Len() uint64 {
+	return t.kv.nsCount(nsText, t.Name)
+}
+
+type textClause struct {
+	tokens []textToken
+	prefix bool
+}
+
+//查询语法: 空格分隔的条件需全部满足，"..." 为短语，以 * 结尾为前缀
+func (t *TextIndex) parse(query string) []textClause {
+	clauses := make([]textClause, 0)
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		var c textClause
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				end = len(query) - 1
+			}
+			c.tokens = t.tokenize(query[1:end+1], true)
+			if end+2 > len(query) {
+				end = len(query) - 2
+			}
+			query = query[end+2:]
+		} else {
+			word := query
+			if i := strings.IndexFunc(query, unicode.IsSpace); i >= 0 {
+				word = query[:i]
+			}
+			query = query[len(word):]
+			if strings.HasSuffix(word, "*") {
+				if tokens := t.tokenize(strings.TrimSuffix(word, "*"), false); len(tokens) == 1 {
+					c.tokens, c.prefix = tokens, true
+				}
+			}
+			if !c.prefix {
+				c.tokens = t.tokenize(word, true)
+			}
+		}
+		if len(c.tokens) > 0 {
+			clauses = append(clauses, c)
+		}
+	}
+	return clauses
+}
+
+func textBM25(tf, df, dl int, n uint64, avgdl float64) float64 {
+	idf := math.Log(1 + (float64(n)-float64(df)+0.5)/(float64(df)+0.5))
+	return idf * float64(tf) * (textK1 + 1) / (float64(tf) + textK1*(1-textB+textB*float64(dl)/avgdl))
+}
+
+//读取以 termPrefix 开头的全部倒排，exact 为true时只取完全相同的词，按词回调
+func (t *TextIndex) postings(snap *leveldb.Snapshot, term string, exact bool, fn func(term string, docs map[string]textPosting)) error {
+	base := len(textTermPrefix(t.Name, ""))
+	p := textTermPrefix(t.Name, term)
+	if exact {
+		p = append(p, 0)
+	}
+	iter := snap.NewIterator(util.BytesPrefix(p), t.kv.iteratorOpts)
+	defer iter.Release()
+	cur := ""
+	docs := make(map[string]textPosting)
+	for iter.Next() {
+		rest := iter.Key()[base:]
+		sep := bytes.IndexByte(rest, 0)
+		if sep < 0 {
+			continue
+		}
+		if w := string(rest[:sep]); w != cur {
+			if len(docs) > 0 {
+				fn(cur, docs)
+				docs = make(map[string]textPosting)
+			}
+			cur = w
+		}
+		docs[string(rest[sep+1:])] = parsePosting(iter.Value())
+	}
+	if len(docs) > 0 {
+		fn(cur, docs)
+	}
+	return iter.Error()
+}
+
+func (t *TextIndex) evalClause(snap *leveldb.Snapshot, c textClause, n uint64, avgdl float64) (map[string]float64, error) {
+	scores := make(map[string]float64)
+	if len(c.tokens) == 1 {
+		err := t.postings(snap, c.tokens[0].term, !c.prefix, func(term string, docs map[string]textPosting) {
+			for key, p := range docs {
+				scores[key] += textBM25(len(p.positions), len(docs), p.docLen, n, avgdl)
+			}
+		})
+		return scores, err
+	}
+	//短语: 各词在文档中的位置需保持查询中的相对距离
+	lists := make([]map[string]textPosting, len(c.tokens))
+	for i, tk := range c.tokens {
+		lists[i] = make(map[string]textPosting)
+		err := t.postings(snap, tk.term, true, func(term string, docs map[string]textPosting) {
+			lists[i] = docs
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for key, first := range lists[0] {
+		matched := false
+		for _, start := range first.positions {
+			matched = true
+			for i := 1; i < len(c.tokens) && matched; i++ {
+				p, ok := lists[i][key]
+				want := start + c.tokens[i].pos - c.tokens[0].pos
+				j := sort.SearchInts(p.positions, want)
+				matched = ok && j < len(p.positions) && p.positions[j] == want
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		for i := range c.tokens {
+			p := lists[i][key]
+			scores[key] += textBM25(len(p.positions), len(lists[i]), p.docLen, n, avgdl)
+		}
+	}
+	return scores, nil
+}
+
+//按BM25得分由高到低返回命中记录，limit<=0 返回全部
+func (t *TextIndex) Search(query string, limit int) ([]TextHit, error) {
+	hits := make([]TextHit, 0)
+	clauses := t.parse(query)
+	if len(clauses) == 0 {
+		return hits, nil
+	}
+	snap, err := t.kv.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	val, err := snap.Get(nsMetaKey(nsText, t.Name), nil)
+	if err == leveldb.ErrNotFound || len(val) < 16 {
+		return hits, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := KeyToIDPure(val[:8])
+	avgdl := float64(KeyToIDPure(val[8:16])) / float64(n)
+	var scores map[string]float64
+	for i, c := range clauses {
+		cs, err := t.evalClause(snap, c, n, avgdl)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			scores = cs
+		} else {
+			for key := range scores {
+				if s, ok := cs[key]; ok {
+					scores[key] += s
+				} else {
+					delete(scores, key)
+				}
+			}
+		}
+		if len(scores) == 0 {
+			return hits, nil
+		}
+	}
+	for key, s := range scores {
+		nk := []byte(key)
+		if t.conf.Bucket != "" {
+			nk = nk[len(t.conf.Prefix):]
+		}
+		hits = append(hits, TextHit{Key: nk, Score: s})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return bytes.Compare(hits[i].Key, hits[j].Key) < 0
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
@@ -0,0 +1,139 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func textKeys(hits []TextHit) []string {
+	keys := make([]string, len(hits))
+	for i, h := range hits {
+		keys[i] = string(h.Key)
+	}
+	return keys
+}
+
+func TestKvdb_TextIndex(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, true, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	kv.Put([]byte("log-1"), []byte("Disk full on the storage node"), 0)
+	kv.Put([]byte("log-2"), []byte("Network timeout, disk OK"), 0)
+	kv.Put([]byte("other"), []byte("disk full"), 0)
+
+	idx, err := kv.CreateTextIndex("logs", []byte("log-"), nil)
+	assert.NoError(t, err)
+	_, err = kv.CreateTextIndex("logs", []byte("log-"), nil)
+	assert.Error(t, err)
+	assert.Equal(t, idx.Len(), uint64(2))
+
+	kv.Put([]byte("log-3"), []byte("full disk full disk, storage degraded"), 0)
+
+	hits, err := idx.Search("disk", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, len(hits), 3)
+	assert.Equal(t, string(hits[0].Key), "log-3")
+
+	hits, _ = idx.Search("DISK storage", 0)
+	assert.Equal(t, textKeys(hits), []string{"log-1", "log-3"})
+	hits, _ = idx.Search(`"disk full"`, 0)
+	assert.Equal(t, textKeys(hits), []string{"log-3", "log-1"})
+	hits, _ = idx.Search(`"storage full"`, 0)
+	assert.Equal(t, textKeys(hits), []string{})
+	hits, _ = idx.Search(`"full on the storage"`, 0)
+	assert.Equal(t, textKeys(hits), []string{"log-1"})
+	hits, _ = idx.Search("time*", 0)
+	assert.Equal(t, textKeys(hits), []string{"log-2"})
+	hits, _ = idx.Search("the", 0)
+	assert.Equal(t, len(hits), 0)
+	hits, _ = idx.Search("disk", 1)
+	assert.Equal(t, len(hits), 1)
+
+	//覆盖与删除同步更新索引
+	kv.Put([]byte("log-1"), []byte("all good"), 0)
+	hits, _ = idx.Search("storage", 0)
+	assert.Equal(t, textKeys(hits), []string{"log-3"})
+	kv.Del([]byte("log-3"))
+	hits, _ = idx.Search("storage", 0)
+	assert.Equal(t, len(hits), 0)
+	kv.BatPutOrDel(&[]BatItem{{Op: "put", Key: []byte("log-4"), Value: []byte("storage ok")}, {Op: "del", Key: []byte("log-2")}})
+	hits, _ = idx.Search("storage", 0)
+	assert.Equal(t, textKeys(hits), []string{"log-4"})
+	assert.Equal(t, idx.Len(), uint64(2))
+
+	//超时删除同步清理
+	kv.Put([]byte("log-5"), []byte("ephemeral storage"), 1)
+	hits, _ = idx.Search("ephemeral", 0)
+	assert.Equal(t, len(hits), 1)
+	time.Sleep(3 * time.Second)
+	hits, _ = idx.Search("ephemeral", 0)
+	assert.Equal(t, len(hits), 0)
+
+	//重新打开后索引定义保持
+	kv.Close()
+	kv, err = OpenKvdb(dir, false, true, 10)
+	assert.NoError(t, err)
+	idx, err = kv.TextIndex("logs")
+	assert.NoError(t, err)
+	kv.Put([]byte("log-6"), []byte("storage 存储故障"), 0)
+	hits, _ = idx.Search("故障", 0)
+	assert.Equal(t, textKeys(hits), []string{"log-6"})
+	hits, _ = idx.Search("储故", 0)
+	assert.Equal(t, textKeys(hits), []string{"log-6"})
+
+	assert.NoError(t, idx.Rebuild())
+	assert.Equal(t, idx.Len(), uint64(3))
+	assert.NoError(t, kv.DropTextIndex("logs"))
+	_, err = kv.TextIndex("logs")
+	assert.Equal(t, err, ErrTextIndexNotFound)
+
+	kv.Drop()
+}
+
+func TestBucket_TextIndex(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Drop()
+
+	type device struct {
+		Name string
+		Desc string
+		Meta map[string]string
+	}
+	b := kv.Bucket("devices")
+	idx, err := b.CreateTextIndex("desc", &TextIndexOptions{Fields: []string{"Desc", "Meta.site"}})
+	assert.NoError(t, err)
+	b.PutObject([]byte("d1"), device{Name: "gateway", Desc: "Edge gateway in rack", Meta: map[string]string{"site": "Shenzhen"}}, 0)
+	kv.PutObjectMix("devices", "d2", device{Name: "sensor", Desc: "Temperature sensor", Meta: map[string]string{"site": "Beijing"}}, 0)
+	kv.Put([]byte("d3"), []byte("gateway sensor"), 0)
+
+	hits, err := idx.Search("sensor", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, textKeys(hits), []string{"d2"})
+	hits, _ = idx.Search("shenzhen", 0)
+	assert.Equal(t, textKeys(hits), []string{"d1"})
+	hits, _ = idx.Search("gateway", 0)
+	assert.Equal(t, textKeys(hits), []string{"d1"})
+
+	assert.NoError(t, b.Drop())
+	assert.Equal(t, idx.Len(), uint64(0))
+}
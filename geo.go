@@ -0,0 +1,288 @@
+package yiyidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//地理位置: 成员 m+member -> 纬度+经度，索引 h+geohash(52位)+member -> 纬度+经度
+//geohash 经纬度各26位交叉编码，前缀相同的点在同一网格内，查询转为若干网格的区间扫描
+const (
+	geoMemberSub byte = 'm'
+	geoHashSub   byte = 'h'
+	geoStep           = 26
+	geoEarth          = 6372797.560856
+)
+
+type GeoItem struct {
+	Member string
+	Lat    float64
+	Lon    float64
+	Dist   float64
+}
+
+func geoMemberKey(set, member string) []byte {
+	return append(nsKey(nsGeo, set, []byte{geoMemberSub}), member...)
+}
+
+func geoHashKey(set string, hash uint64, member string) []byte {
+	key := append(nsKey(nsGeo, set, []byte{geoHashSub}), IdToKeyPure(hash)...)
+	return append(key, member...)
+}
+
+func geoCell(lat, lon float64, step uint) (uint64, uint64) {
+	scale := float64(uint64(1) << step)
+	y := uint64((lat + 90) / 180 * scale)
+	x := uint64((lon + 180) / 360 * scale)
+	max := uint64(1)<<step - 1
+	if y > max {
+		y = max
+	}
+	if x > max {
+		x = max
+	}
+	return y, x
+}
+
+//经度位在前，纬度位在后交叉
+func geoInterleave(y, x uint64, step uint) uint64 {
+	var h uint64
+	for i := int(step) - 1; i >= 0; i-- {
+		h = h<<1 | x>>uint(i)&1
+		h = h<<1 | y>>uint(i)&1
+	}
+	return h
+}
+
+func geoEncode(lat, lon float64) uint64 {
+	y, x := geoCell(lat, lon, geoStep)
+	return geoInterleave(y, x, geoStep)
+}
+
+func geoValue(lat, lon float64) []byte {
+	val := make([]byte, 16)
+	binary.BigEndian.PutUint64(val, math.Float64bits(lat))
+	binary.BigEndian.PutUint64(val[8:], math.Float64bits(lon))
+	return val
+}
+
+func geoParse(val []byte) (float64, float64) {
+	return math.Float64frombits(binary.BigEndian.Uint64(val)), math.Float64frombits(binary.BigEndian.Uint64(val[8:]))
+}
+
+func geoRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func geoDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+//球面距离，单位米
+func geoDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	u := math.Sin((geoRad(lat2) - geoRad(lat1)) / 2)
+	v := math.Sin((geoRad(lon2) - geoRad(lon1)) / 2)
+	a := u*u + math.Cos(geoRad(lat1))*math.Cos(geoRad(lat2))*v*v
+	return 2 * geoEarth * math.Asin(math.Sqrt(a))
+}
+
+func geoValid(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+//添加或更新成员位置，新增返回true
+func (k *Kvdb) GeoAdd(set, member string, lat, lon float64) (bool, error) {
+	if !geoValid(lat, lon) {
+		return false, errors.New("invalid coordinate")
+	}
+	k.Lock()
+	defer k.Unlock()
+	mk := geoMemberKey(set, member)
+	batch := new(leveldb.Batch)
+	old, err := k.db.Get(mk, nil)
+	added := err == leveldb.ErrNotFound
+	if err == nil {
+		olat, olon := geoParse(old)
+		batch.Delete(geoHashKey(set, geoEncode(olat, olon), member))
+	} else if !added {
+		return false, err
+	}
+	val := geoValue(lat, lon)
+	batch.Put(mk, val)
+	batch.Put(geoHashKey(set, geoEncode(lat, lon), member), val)
+	if added {
+		k.nsSetCount(batch, nsGeo, set, k.nsCount(nsGeo, set)+1)
+	}
+	return added, k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) GeoRem(set string, members ...string) (int, error) {
+	k.Lock()
+	defer k.Unlock()
+	batch := new(leveldb.Batch)
+	removed := make(map[string]bool)
+	for _, m := range members {
+		mk := geoMemberKey(set, m)
+		old, err := k.db.Get(mk, nil)
+		if err != nil || removed[m] {
+			continue
+		}
+		lat, lon := geoParse(old)
+		batch.Delete(mk)
+		batch.Delete(geoHashKey(set, geoEncode(lat, lon), m))
+		removed[m] = true
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	k.nsSetCount(batch, nsGeo, set, k.nsCount(nsGeo, set)-uint64(len(removed)))
+	return len(removed), k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) GeoPos(set, member string) (lat, lon float64, err error) {
+	val, err := k.db.Get(geoMemberKey(set, member), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	lat, lon = geoParse(val)
+	return lat, lon, nil
+}
+
+//两个成员间的距离，单位米
+func (k *Kvdb) GeoDist(set, member1, member2 string) (float64, error) {
+	lat1, lon1, err := k.GeoPos(set, member1)
+	if err != nil {
+		return 0, err
+	}
+	lat2, lon2, err := k.GeoPos(set, member2)
+	if err != nil {
+		return 0, err
+	}
+	return geoDistance(lat1, lon1, lat2, lon2), nil
+}
+
+func (k *Kvdb) GeoCard(set string) uint64 {
+	return k.nsCount(nsGeo, set)
+}
+
+//扫描覆盖矩形的网格，矩形不跨越经度±180
+func (k *Kvdb) geoScan(set string, minLat, minLon, maxLat, maxLon float64, seen map[string]bool, fn func(item GeoItem)) error {
+	//选取最细的网格精度，使矩形在每个方向最多跨3个网格
+	step := uint(geoStep)
+	var y0, x0, y1, x1 uint64
+	for ; ; step-- {
+		y0, x0 = geoCell(minLat, minLon, step)
+		y1, x1 = geoCell(maxLat, maxLon, step)
+		if step == 0 || (y1-y0 < 3 && x1-x0 < 3) {
+			break
+		}
+	}
+	p := nsKey(nsGeo, set, []byte{geoHashSub})
+	shift := 2 * (geoStep - step)
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			cell := geoInterleave(y, x, step)
+			rg := &util.Range{Start: geoHashKey(set, cell<<shift, ""), Limit: geoHashKey(set, (cell+1)<<shift, "")}
+			iter := k.db.NewIterator(rg, k.iteratorOpts)
+			for iter.Next() {
+				member := string(iter.Key()[len(p)+8:])
+				lat, lon := geoParse(iter.Value())
+				if seen[member] || lat < minLat || lat > maxLat || lon < minLon || lon > maxLon {
+					continue
+				}
+				seen[member] = true
+				fn(GeoItem{Member: member, Lat: lat, Lon: lon})
+			}
+			iter.Release()
+			if err := iter.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//跨越经度±180的矩形拆成两段扫描
+func (k *Kvdb) geoBox(set string, minLat, minLon, maxLat, maxLon float64, fn func(item GeoItem)) error {
+	seen := make(map[string]bool)
+	minLat, maxLat = math.Max(minLat, -90), math.Min(maxLat, 90)
+	switch {
+	case minLon < -180:
+		if err := k.geoScan(set, minLat, minLon+360, maxLat, 180, seen, fn); err != nil {
+			return err
+		}
+		return k.geoScan(set, minLat, -180, maxLat, maxLon, seen, fn)
+	case maxLon > 180:
+		if err := k.geoScan(set, minLat, minLon, maxLat, 180, seen, fn); err != nil {
+			return err
+		}
+		return k.geoScan(set, minLat, -180, maxLat, maxLon-360, seen, fn)
+	case minLon > maxLon:
+		if err := k.geoScan(set, minLat, minLon, maxLat, 180, seen, fn); err != nil {
+			return err
+		}
+		return k.geoScan(set, minLat, -180, maxLat, maxLon, seen, fn)
+	}
+	return k.geoScan(set, minLat, minLon, maxLat, maxLon, seen, fn)
+}
+
+//返回矩形内的成员，minLon > maxLon 表示跨越经度180度
+func (k *Kvdb) GeoBox(set string, minLat, minLon, maxLat, maxLon float64) ([]GeoItem, error) {
+	if !geoValid(minLat, minLon) || !geoValid(maxLat, maxLon) || minLat > maxLat {
+		return nil, errors.New("invalid coordinate")
+	}
+	result := make([]GeoItem, 0)
+	err := k.geoBox(set, minLat, minLon, maxLat, maxLon, func(item GeoItem) {
+		result = append(result, item)
+	})
+	return result, err
+}
+
+//返回距中心 radius 米内的成员，按距离由近到远排序
+func (k *Kvdb) GeoRadius(set string, lat, lon, radius float64) ([]GeoItem, error) {
+	if !geoValid(lat, lon) {
+		return nil, errors.New("invalid coordinate")
+	}
+	if radius < 0 {
+		return nil, errors.New("radius must >= 0")
+	}
+	dLat := geoDeg(radius / geoEarth)
+	minLat, maxLat := lat-dLat, lat+dLat
+	minLon, maxLon := -180.0, 180.0
+	if minLat > -90 && maxLat < 90 {
+		if s := math.Sin(radius/geoEarth) / math.Cos(geoRad(lat)); s < 1 {
+			dLon := geoDeg(math.Asin(s))
+			minLon, maxLon = lon-dLon, lon+dLon
+		}
+	}
+	result := make([]GeoItem, 0)
+	err := k.geoBox(set, minLat, minLon, maxLat, maxLon, func(item GeoItem) {
+		if item.Dist = geoDistance(lat, lon, item.Lat, item.Lon); item.Dist <= radius {
+			result = append(result, item)
+		}
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Dist < result[j].Dist
+	})
+	return result, err
+}
+
+func (k *Kvdb) GeoClear(set string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsGeo, set)
+}
+
+//设置整个位置集的超时秒数，<0 取消超时
+func (k *Kvdb) GeoSetTTL(set string, ttl int) error {
+	return k.expireNs(nsGeo, set, ttl)
+}
+
+func (k *Kvdb) GeoGetTTL(set string) (float64, error) {
+	return k.ttlNs(nsGeo, set)
+}
@@ -0,0 +1,73 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_Geo(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Drop()
+
+	kv.GeoAdd("fleet", "palermo", 38.115556, 13.361389)
+	kv.GeoAdd("fleet", "catania", 37.502669, 15.087269)
+	kv.GeoAdd("fleet", "rome", 41.9028, 12.4964)
+	kv.GeoAdd("fleet", "fiji", -17.7134, 179.99)
+	kv.GeoAdd("fleet", "samoa", -13.759, -172.1046)
+	added, err := kv.GeoAdd("fleet", "rome", 41.9028, 12.4964)
+	assert.NoError(t, err)
+	assert.False(t, added)
+	assert.Equal(t, kv.GeoCard("fleet"), uint64(5))
+	_, err = kv.GeoAdd("fleet", "bad", 91, 0)
+	assert.Error(t, err)
+
+	d, err := kv.GeoDist("fleet", "palermo", "catania")
+	assert.NoError(t, err)
+	assert.InDelta(t, 166274, d, 10)
+	lat, lon, err := kv.GeoPos("fleet", "catania")
+	assert.NoError(t, err)
+	assert.Equal(t, lat, 37.502669)
+	assert.Equal(t, lon, 15.087269)
+
+	items, err := kv.GeoRadius("fleet", 38, 15, 200000)
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 2)
+	assert.Equal(t, items[0].Member, "catania")
+	assert.Equal(t, items[1].Member, "palermo")
+
+	items, _ = kv.GeoBox("fleet", 37, 12, 42, 16)
+	assert.Equal(t, len(items), 3)
+
+	//跨越经度180度
+	items, _ = kv.GeoBox("fleet", -20, 170, -10, -170)
+	assert.Equal(t, len(items), 2)
+	items, _ = kv.GeoRadius("fleet", -16, 179, 1000000)
+	assert.Equal(t, len(items), 2)
+	assert.Equal(t, items[0].Member, "fiji")
+
+	//移动后旧位置不再命中
+	kv.GeoAdd("fleet", "rome", 0, 0)
+	items, _ = kv.GeoBox("fleet", 37, 12, 42, 16)
+	assert.Equal(t, len(items), 2)
+
+	n, _ := kv.GeoRem("fleet", "rome", "missing")
+	assert.Equal(t, n, 1)
+	items, _ = kv.GeoRadius("fleet", 0, 0, 100)
+	assert.Equal(t, len(items), 0)
+
+	assert.NoError(t, kv.GeoClear("fleet"))
+	assert.Equal(t, kv.GeoCard("fleet"), uint64(0))
+}
@@ -0,0 +1,198 @@
+package yiyidb
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//哈希: 每个字段一条记录 f+field -> value
+const hFieldSub byte = 'f'
+
+func hFieldPrefix(hash string) []byte {
+	return nsKey(nsHash, hash, []byte{hFieldSub})
+}
+
+func hFieldKey(hash, field string) []byte {
+	return append(hFieldPrefix(hash), field...)
+}
+
+//写入字段，返回新增字段数
+func (k *Kvdb) hset(hash string, fields map[string][]byte) (int, error) {
+	batch := new(leveldb.Batch)
+	added := 0
+	for f, v := range fields {
+		if len(v) > k.maxkv {
+			return 0, errors.New("out of len")
+		}
+		fk := hFieldKey(hash, f)
+		if ok, _ := k.db.Has(fk, nil); !ok {
+			added++
+		}
+		batch.Put(fk, v)
+	}
+	if added > 0 {
+		k.nsSetCount(batch, nsHash, hash, k.nsCount(nsHash, hash)+uint64(added))
+	}
+	return added, k.db.Write(batch, nil)
+}
+
+//设置字段，返回字段是否为新增
+func (k *Kvdb) HSet(hash, field string, value []byte) (bool, error) {
+	k.Lock()
+	defer k.Unlock()
+	added, err := k.hset(hash, map[string][]byte{field: value})
+	return added > 0, err
+}
+
+func (k *Kvdb) HMSet(hash string, fields map[string][]byte) (int, error) {
+	k.Lock()
+	defer k.Unlock()
+	return k.hset(hash, fields)
+}
+
+func (k *Kvdb) HGet(hash, field string) ([]byte, error) {
+	return k.db.Get(hFieldKey(hash, field), nil)
+}
+
+func (k *Kvdb) HExists(hash, field string) bool {
+	ok, _ := k.db.Has(hFieldKey(hash, field), k.iteratorOpts)
+	return ok
+}
+
+//不存在的字段对应位置返回nil
+func (k *Kvdb) HMGet(hash string, fields ...string) ([][]byte, error) {
+	result := make([][]byte, len(fields))
+	snap, err := k.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	for i, f := range fields {
+		v, err := snap.Get(hFieldKey(hash, f), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+//删除字段，返回实际删除数
+func (k *Kvdb) HDel(hash string, fields ...string) (int, error) {
+	k.Lock()
+	defer k.Unlock()
+	batch := new(leveldb.Batch)
+	removed := make(map[string]bool)
+	for _, f := range fields {
+		fk := hFieldKey(hash, f)
+		if ok, _ := k.db.Has(fk, nil); ok && !removed[f] {
+			batch.Delete(fk)
+			removed[f] = true
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	k.nsSetCount(batch, nsHash, hash, k.nsCount(nsHash, hash)-uint64(len(removed)))
+	return len(removed), k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) HGetAll(hash string) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	p := hFieldPrefix(hash)
+	iter := k.db.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		v := make([]byte, len(iter.Value()))
+		copy(v, iter.Value())
+		result[string(iter.Key()[len(p):])] = v
+	}
+	return result, iter.Error()
+}
+
+//字段值按十进制整数保存
+func (k *Kvdb) HIncrBy(hash, field string, incr int64) (int64, error) {
+	k.Lock()
+	defer k.Unlock()
+	var n int64
+	v, err := k.db.Get(hFieldKey(hash, field), nil)
+	if err == nil {
+		if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, errors.New("hash value is not an integer")
+		}
+	} else if err != leveldb.ErrNotFound {
+		return 0, err
+	}
+	n += incr
+	_, err = k.hset(hash, map[string][]byte{field: []byte(strconv.FormatInt(n, 10))})
+	return n, err
+}
+
+func (k *Kvdb) HLen(hash string) uint64 {
+	return k.nsCount(nsHash, hash)
+}
+
+//从 cursor 之后(不含)按字段顺序返回至多 count(默认10) 个字段，exp 为空时不过滤
+//返回的 next 为空表示已遍历完毕
+func (k *Kvdb) HScan(hash, cursor, exp string, count int) ([]KvItem, string, error) {
+	var regx *regexp.Regexp
+	if exp != "" {
+		var err error
+		if regx, err = regexp.Compile(exp); err != nil {
+			return nil, "", err
+		}
+	}
+	if count <= 0 {
+		count = 10
+	}
+	result := make([]KvItem, 0)
+	p := hFieldPrefix(hash)
+	iter := k.db.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+	defer iter.Release()
+	ok := iter.First()
+	if cursor != "" {
+		start := hFieldKey(hash, cursor)
+		if ok = iter.Seek(start); ok && string(iter.Key()) == string(start) {
+			ok = iter.Next()
+		}
+	}
+	next := ""
+	for ; ok; ok = iter.Next() {
+		field := iter.Key()[len(p):]
+		if len(result) >= count {
+			return result, next, iter.Error()
+		}
+		next = string(field)
+		if regx != nil && !regx.Match(field) {
+			continue
+		}
+		item := KvItem{}
+		item.Key = make([]byte, len(field))
+		item.Value = make([]byte, len(iter.Value()))
+		copy(item.Key, field)
+		copy(item.Value, iter.Value())
+		result = append(result, item)
+	}
+	return result, "", iter.Error()
+}
+
+func (k *Kvdb) HClear(hash string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsHash, hash)
+}
+
+//设置整个哈希的超时秒数，<0 取消超时
+func (k *Kvdb) HSetTTL(hash string, ttl int) error {
+	return k.expireNs(nsHash, hash, ttl)
+}
+
+func (k *Kvdb) HGetTTL(hash string) (float64, error) {
+	return k.ttlNs(nsHash, hash)
+}
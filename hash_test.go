@@ -0,0 +1,80 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_Hash(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, true, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	isNew, err := kv.HSet("dev1", "ip", []byte("10.0.0.1"))
+	assert.NoError(t, err)
+	assert.True(t, isNew)
+	isNew, err = kv.HSet("dev1", "ip", []byte("10.0.0.2"))
+	assert.NoError(t, err)
+	assert.False(t, isNew)
+	n, err := kv.HMSet("dev1", map[string][]byte{"mac": []byte("aa:bb"), "fw": []byte("1.0")})
+	assert.NoError(t, err)
+	assert.Equal(t, n, 2)
+	assert.Equal(t, kv.HLen("dev1"), uint64(3))
+
+	v, err := kv.HGet("dev1", "ip")
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("10.0.0.2"))
+
+	vals, err := kv.HMGet("dev1", "fw", "none", "mac")
+	assert.NoError(t, err)
+	assert.Equal(t, vals, [][]byte{[]byte("1.0"), nil, []byte("aa:bb")})
+
+	cnt, err := kv.HIncrBy("dev1", "reboots", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, int64(2))
+	cnt, err = kv.HIncrBy("dev1", "reboots", -5)
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, int64(-3))
+	_, err = kv.HIncrBy("dev1", "ip", 1)
+	assert.Error(t, err)
+
+	items, next, err := kv.HScan("dev1", "", "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 2)
+	assert.Equal(t, next, "ip")
+	items, next, err = kv.HScan("dev1", next, "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, string(items[0].Key), "mac")
+	assert.Equal(t, string(items[1].Key), "reboots")
+	assert.Equal(t, next, "")
+	items, _, err = kv.HScan("dev1", "", "^m", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 1)
+
+	n, err = kv.HDel("dev1", "fw", "none")
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	all, err := kv.HGetAll("dev1")
+	assert.NoError(t, err)
+	assert.Equal(t, len(all), 3)
+	assert.Equal(t, all["mac"], []byte("aa:bb"))
+
+	assert.NoError(t, kv.HSetTTL("dev1", 1))
+	time.Sleep(3 * time.Second)
+	assert.Equal(t, kv.HLen("dev1"), uint64(0))
+	assert.False(t, kv.HExists("dev1", "mac"))
+
+	kv.Drop()
+}
@@ -0,0 +1,189 @@
+package yiyidb
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+//基数估算: 16384个6位寄存器紧凑存放在 r 子key(约12KB)，元数据缓存最近一次估算值
+const (
+	hllRegSub   byte = 'r'
+	hllP             = 14
+	hllM             = 1 << hllP
+	hllBits          = 6
+	hllMaxRank       = 64 - hllP + 1
+	hllRegBytes      = hllM*hllBits/8 + 1
+)
+
+type hllRegisters []byte
+
+func (r hllRegisters) get(i int) uint8 {
+	b := i * hllBits / 8
+	fb := uint(i*hllBits) & 7
+	return uint8((uint16(r[b])>>fb | uint16(r[b+1])<<(8-fb)) & 0x3f)
+}
+
+func (r hllRegisters) set(i int, v uint8) {
+	b := i * hllBits / 8
+	fb := uint(i*hllBits) & 7
+	r[b] &^= byte(0x3f << fb)
+	r[b] |= byte(v << fb)
+	r[b+1] &^= byte(0x3f >> (8 - fb))
+	r[b+1] |= byte(v >> (8 - fb))
+}
+
+//fnv结果再做一次混淆，保证高位分布均匀
+func hllHash(element string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(element))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (r hllRegisters) add(element string) bool {
+	x := hllHash(element)
+	idx := int(x >> (64 - hllP))
+	rank := uint8(bits.LeadingZeros64(x<<hllP|1<<(hllP-1)) + 1)
+	if rank > r.get(idx) {
+		r.set(idx, rank)
+		return true
+	}
+	return false
+}
+
+func (r hllRegisters) merge(o hllRegisters) {
+	for i := 0; i < hllM; i++ {
+		if v := o.get(i); v > r.get(i) {
+			r.set(i, v)
+		}
+	}
+}
+
+func (r hllRegisters) estimate() uint64 {
+	sum := 0.0
+	zeros := 0
+	for i := 0; i < hllM; i++ {
+		v := r.get(i)
+		if v == 0 {
+			zeros++
+		}
+		sum += math.Ldexp(1, -int(v))
+	}
+	m := float64(hllM)
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		//小基数使用线性计数修正
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+func hllRegKey(counter string) []byte {
+	return nsKey(nsHLL, counter, []byte{hllRegSub})
+}
+
+func (k *Kvdb) hllLoad(counter string) (hllRegisters, error) {
+	val, err := k.db.Get(hllRegKey(counter), nil)
+	if err == leveldb.ErrNotFound {
+		return make(hllRegisters, hllRegBytes), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(val) != hllRegBytes {
+		return nil, errors.New("hyperloglog data invalid")
+	}
+	return val, nil
+}
+
+func (k *Kvdb) hllSave(counter string, r hllRegisters) error {
+	batch := new(leveldb.Batch)
+	batch.Put(hllRegKey(counter), r)
+	batch.Put(nsMetaKey(nsHLL, counter), IdToKeyPure(r.estimate()))
+	return k.db.Write(batch, nil)
+}
+
+//添加元素，有寄存器变化时返回true
+func (k *Kvdb) PFAdd(counter string, elements ...string) (bool, error) {
+	k.Lock()
+	defer k.Unlock()
+	r, err := k.hllLoad(counter)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for _, e := range elements {
+		if r.add(e) {
+			changed = true
+		}
+	}
+	if !changed && k.Exists(nsMetaKey(nsHLL, counter)) {
+		return false, nil
+	}
+	return changed, k.hllSave(counter, r)
+}
+
+//估算基数，多个计数器时返回并集的基数
+func (k *Kvdb) PFCount(counters ...string) (uint64, error) {
+	if len(counters) == 1 {
+		val, err := k.db.Get(nsMetaKey(nsHLL, counters[0]), nil)
+		if err == leveldb.ErrNotFound {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return KeyToIDPure(val), nil
+	}
+	r := make(hllRegisters, hllRegBytes)
+	for _, c := range counters {
+		o, err := k.hllLoad(c)
+		if err != nil {
+			return 0, err
+		}
+		r.merge(o)
+	}
+	return r.estimate(), nil
+}
+
+//合并多个计数器到 dest，dest 原有数据一并保留
+func (k *Kvdb) PFMerge(dest string, srcs ...string) error {
+	k.Lock()
+	defer k.Unlock()
+	r, err := k.hllLoad(dest)
+	if err != nil {
+		return err
+	}
+	for _, c := range srcs {
+		o, err := k.hllLoad(c)
+		if err != nil {
+			return err
+		}
+		r.merge(o)
+	}
+	return k.hllSave(dest, r)
+}
+
+func (k *Kvdb) PFClear(counter string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsHLL, counter)
+}
+
+//设置计数器的超时秒数，<0 取消超时
+func (k *Kvdb) PFSetTTL(counter string, ttl int) error {
+	return k.expireNs(nsHLL, counter, ttl)
+}
+
+func (k *Kvdb) PFGetTTL(counter string) (float64, error) {
+	return k.ttlNs(nsHLL, counter)
+}
@@ -0,0 +1,62 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_HyperLogLog(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, true, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	ids := make([]string, 0)
+	for i := 0; i < 20000; i++ {
+		ids = append(ids, fmt.Sprintf("device-%d", i))
+	}
+	kv.PFAdd("uv", ids...)
+	changed, err := kv.PFAdd("uv", "device-1")
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	n, err := kv.PFCount("uv")
+	assert.NoError(t, err)
+	assert.InDelta(t, 20000, float64(n), 400)
+
+	small := make([]string, 0)
+	for i := 10000; i < 30100; i++ {
+		small = append(small, fmt.Sprintf("device-%d", i))
+	}
+	kv.PFAdd("uv2", small...)
+	n, _ = kv.PFCount("uv", "uv2")
+	assert.InDelta(t, 30100, float64(n), 600)
+	assert.NoError(t, kv.PFMerge("total", "uv", "uv2"))
+	m, _ := kv.PFCount("total")
+	assert.Equal(t, m, n)
+
+	kv.PFAdd("few", "a", "b", "c")
+	n, _ = kv.PFCount("few")
+	assert.Equal(t, n, uint64(3))
+	val, _ := kv.db.Get(hllRegKey("few"), nil)
+	assert.Equal(t, len(val), hllRegBytes)
+
+	assert.NoError(t, kv.PFSetTTL("few", 1))
+	time.Sleep(3 * time.Second)
+	n, _ = kv.PFCount("few")
+	assert.Equal(t, n, uint64(0))
+	n, _ = kv.PFCount("missing")
+	assert.Equal(t, n, uint64(0))
+
+	kv.Drop()
+}
@@ -8,13 +8,11 @@ import (
 	"bytes"
 	"errors"
 	"os"
-	"gopkg.in/vmihailenco/msgpack.v2"
 	"reflect"
 	"math"
 	"sync"
 	"regexp"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
-	"github.com/pquerna/ffjson/ffjson"
 )
 
 type Kvdb struct {
@@ -27,6 +25,12 @@ type Kvdb struct {
 	mats         map[string]*mat
 	maxkv        int
 	iteratorOpts *opt.ReadOptions
+	codec        Codec
+	mixCodecs    map[string]Codec
+	waits        *waitQueue
+	texts        map[string]*TextIndex
+	textMu       sync.Mutex
+	mixMu        sync.RWMutex //分组写入共享，分组重命名独占
 	OnExpirse    func(key, value []byte)
 }
 
@@ -47,6 +51,10 @@ func OpenKvdb(dataDir string, nChan, nttl bool, defaultKeyLen int) (*Kvdb, error
 		enableChan:   nChan,
 		mats:         make(map[string]*mat),
 		maxkv:        256 * MB,
+		codec:        Msgpack,
+		mixCodecs:    make(map[string]Codec),
+		waits:        newWaitQueue(),
+		texts:        make(map[string]*TextIndex),
 	}
 
 	bloom := Precision(float64(defaultKeyLen)*1.44, 0, true)
@@ -68,6 +76,11 @@ func OpenKvdb(dataDir string, nChan, nttl bool, defaultKeyLen int) (*Kvdb, error
 	if err != nil {
 		return nil, err
 	}
+	//旧版 0xff 开头的普通key会被当作分组数据，必须在ttl运行前检查
+	if err := checkFormat(kv.db, kv.DataDir); err != nil {
+		kv.db.Close()
+		return nil, err
+	}
 
 	if kv.enableTtl {
 		//Open TTl
@@ -76,11 +89,23 @@ func OpenKvdb(dataDir string, nChan, nttl bool, defaultKeyLen int) (*Kvdb, error
 			return nil, err
 		}
 		kv.ttldb.HandleExpirse = kv.onExp
+		kv.ttldb.DelPrefix = compositePrefix
+		kv.ttldb.WriteExpired = kv.writeExpired
 		//run ttl func
-		go kv.ttldb.Run()
+		kv.ttldb.Run()
+	}
+
+	if err := kv.init(); err != nil {
+		return nil, err
+	}
+
+	if err := kv.loadTextIndexes(); err != nil {
+		return nil, err
 	}
 
-	kv.init()
+	if err := kv.resumeRename(); err != nil {
+		return nil, err
+	}
 
 	return kv, nil
 }
@@ -98,6 +123,19 @@ func (k *Kvdb) Drop() {
 	os.RemoveAll(k.DataDir)
 }
 
+//设置库默认对象编码器，应在读写前设置
+func (k *Kvdb) SetCodec(c Codec) {
+	k.Lock()
+	defer k.Unlock()
+	k.codec = c
+}
+
+func (k *Kvdb) defaultCodec() Codec {
+	k.RLock()
+	defer k.RUnlock()
+	return k.codec
+}
+
 func (k *Kvdb) onExp(key, value []byte) {
 	if k.OnExpirse != nil {
 		k.OnExpirse(key, value)
@@ -169,11 +207,7 @@ func (k *Kvdb) GetObject(key []byte, value interface{}) error {
 	if v.Kind() != reflect.Ptr {
 		return errors.New("not ptr")
 	}
-	err = msgpack.Unmarshal(data, &value)
-	if err != nil {
-		return err
-	}
-	return nil
+	return decodeValue(data, k.defaultCodec(), value)
 }
 
 func (k *Kvdb) GetJson(key []byte, value interface{}) error {
@@ -185,18 +219,21 @@ func (k *Kvdb) GetJson(key []byte, value interface{}) error {
 	if v.Kind() != reflect.Ptr {
 		return errors.New("not ptr")
 	}
-	err = ffjson.Unmarshal(data, &value)
-	if err != nil {
-		return err
-	}
-	return nil
+	return decodeValue(data, Json, value)
 }
 
 func (k *Kvdb) Put(key, value []byte, ttl int) error {
+	if isReservedKey(key) {
+		return ErrReservedKey
+	}
+	return k.put(key, value, ttl)
+}
+
+func (k *Kvdb) put(key, value []byte, ttl int) error {
 	if len(key) > k.maxkv || len(value) > k.maxkv {
 		return errors.New("out of len")
 	}
-	err := k.db.Put(key, value, nil)
+	err := k.dbPut(key, value)
 	if err != nil {
 		return err
 	}
@@ -207,11 +244,11 @@ func (k *Kvdb) Put(key, value []byte, ttl int) error {
 }
 
 func (k *Kvdb) PutObject(key []byte, value interface{}, ttl int) error {
-	t := reflect.ValueOf(value)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
-	msg, err := msgpack.Marshal(t.Interface())
+	return k.PutObjectWith(key, value, ttl, k.defaultCodec())
+}
+
+func (k *Kvdb) PutObjectWith(key []byte, value interface{}, ttl int, c Codec) error {
+	msg, err := encodeValue(c, value)
 	if err != nil {
 		return err
 	}
@@ -219,19 +256,21 @@ func (k *Kvdb) PutObject(key []byte, value interface{}, ttl int) error {
 }
 
 func (k *Kvdb) PutJson(key []byte, value interface{}, ttl int) error {
-	t := reflect.ValueOf(value)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
-	msg, err := ffjson.Marshal(t.Interface())
-	if err != nil {
-		return err
-	}
-	return k.Put(key, msg, ttl)
+	return k.PutObjectWith(key, value, ttl, Json)
 }
 
 func (k *Kvdb) BatPutOrDel(items *[]BatItem) error {
+	for _, v := range *items {
+		if v.Op == "put" && isReservedKey(v.Key) {
+			return ErrReservedKey
+		}
+	}
+	return k.batPutOrDel(items)
+}
+
+func (k *Kvdb) batPutOrDel(items *[]BatItem) error {
 	batch := new(leveldb.Batch)
+	ops := make([]textOp, 0)
 	for _, v := range *items {
 		switch v.Op {
 		case "put":
@@ -239,6 +278,7 @@ func (k *Kvdb) BatPutOrDel(items *[]BatItem) error {
 				return errors.New("out of len")
 			}
 			batch.Put(v.Key, v.Value)
+			ops = k.textOp(ops, v.Key, v.Value, false)
 			if k.enableTtl && v.Ttl > 0 {
 				k.ttldb.SetTTL(v.Ttl, v.Key)
 			}
@@ -247,12 +287,13 @@ func (k *Kvdb) BatPutOrDel(items *[]BatItem) error {
 				return errors.New("out of len")
 			}
 			batch.Delete(v.Key)
+			ops = k.textOp(ops, v.Key, nil, true)
 			if k.enableTtl {
 				k.ttldb.DelTTL(v.Key)
 			}
 		}
 	}
-	err := k.db.Write(batch, nil)
+	err := k.dbWrite(batch, ops)
 	if err != nil {
 		return err
 	}
@@ -263,14 +304,18 @@ func (k *Kvdb) Del(key []byte) error {
 	if len(key) > k.maxkv {
 		return errors.New("out of len")
 	}
-	err := k.db.Delete(key, nil)
+	var err error
+	if k.enableChan {
+		err = k.delChanKey(key)
+	} else {
+		err = k.dbDelete(key)
+	}
 	if err != nil {
 		return err
 	}
 	if k.enableTtl {
 		k.ttldb.DelTTL(key)
 	}
-	k.delchan(key)
 	return nil
 }
 
@@ -279,11 +324,12 @@ func (k *Kvdb) AllByObject(Ntype interface{}) []KvItem {
 	if nt.Kind() == reflect.Ptr {
 		nt = nt.Elem()
 	}
+	c := k.defaultCodec()
 	result := make([]KvItem, 0)
 	iter := k.db.NewIterator(nil, k.iteratorOpts)
 	for iter.Next() {
 		t := reflect.New(nt).Interface()
-		err := msgpack.Unmarshal(iter.Value(), t)
+		err := decodeValue(iter.Value(), c, t)
 		if err == nil {
 			item := KvItem{}
 			item.Key = make([]byte, len(iter.Key()))
@@ -305,7 +351,7 @@ func (k *Kvdb) AllByJson(Ntype interface{}) []KvItem {
 	iter := k.db.NewIterator(nil, k.iteratorOpts)
 	for iter.Next() {
 		t := reflect.New(nt).Interface()
-		err := ffjson.Unmarshal(iter.Value(), t)
+		err := decodeValue(iter.Value(), Json, t)
 		if err == nil {
 			item := KvItem{}
 			item.Key = make([]byte, len(iter.Key()))
@@ -382,12 +428,14 @@ func (k *Kvdb) RegexpByKV(exp string) ([]KvItem, error) {
 
 func (k *Kvdb) KeyStartDels(key []byte) error {
 	batch := new(leveldb.Batch)
+	ops := make([]textOp, 0)
 	iter := k.db.NewIterator(util.BytesPrefix(key), k.iteratorOpts)
 	for iter.Next() {
 		batch.Delete(iter.Key())
+		ops = k.textOp(ops, append([]byte{}, iter.Key()...), nil, true)
 	}
 	iter.Release()
-	err := k.db.Write(batch, nil)
+	err := k.dbWrite(batch, ops)
 	if err != nil {
 		return err
 	}
@@ -445,11 +493,12 @@ func (k *Kvdb) KeyStartByObject(key []byte, Ntype interface{}) ([]KvItem, error)
 	if nt.Kind() == reflect.Ptr {
 		nt = nt.Elem()
 	}
+	c := k.defaultCodec()
 	result := make([]KvItem, 0)
 	iter := k.db.NewIterator(util.BytesPrefix(key), k.iteratorOpts)
 	for iter.Next() {
 		t := reflect.New(nt).Interface()
-		err := msgpack.Unmarshal(iter.Value(), t)
+		err := decodeValue(iter.Value(), c, t)
 		if err == nil {
 			item := KvItem{}
 			item.Key = make([]byte, len(iter.Key()))
@@ -471,12 +520,13 @@ func (k *Kvdb) RegexpByObject(exp string, Ntype interface{}) ([]KvItem, error) {
 	if nt.Kind() == reflect.Ptr {
 		nt = nt.Elem()
 	}
+	c := k.defaultCodec()
 	result := make([]KvItem, 0)
 	iter := k.db.NewIterator(nil, k.iteratorOpts)
 	for iter.Next() {
 		if regx.Match(iter.Key()) {
 			t := reflect.New(nt).Interface()
-			err := msgpack.Unmarshal(iter.Value(), t)
+			err := decodeValue(iter.Value(), c, t)
 			if err == nil {
 				item := KvItem{}
 				item.Key = make([]byte, len(iter.Key()))
@@ -516,11 +566,12 @@ func (k *Kvdb) KeyRangeByObject(min, max []byte, Ntype interface{}) ([]KvItem, e
 	if nt.Kind() == reflect.Ptr {
 		nt = nt.Elem()
 	}
+	c := k.defaultCodec()
 	result := make([]KvItem, 0)
 	iter := k.db.NewIterator(nil, k.iteratorOpts)
 	for ok := iter.Seek(min); ok && bytes.Compare(iter.Key(), max) <= 0; ok = iter.Next() {
 		t := reflect.New(nt).Interface()
-		err := msgpack.Unmarshal(iter.Value(), t)
+		err := decodeValue(iter.Value(), c, t)
 		if err == nil {
 			item := KvItem{}
 			item.Key = make([]byte, len(iter.Key()))
@@ -534,12 +585,13 @@ func (k *Kvdb) KeyRangeByObject(min, max []byte, Ntype interface{}) ([]KvItem, e
 }
 
 func (k *Kvdb) Close() error {
-	err := k.db.Close()
-	if err != nil {
-		return err
-	}
+	k.waits.close()
+	//先停止超时清理，其写入依赖主库
 	if k.enableTtl {
 		k.ttldb.Close()
 	}
-	return nil
+	if k.enableChan {
+		markClosed(k.db)
+	}
+	return k.db.Close()
 }
@@ -3,7 +3,6 @@ package yiyidb
 import (
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"reflect"
-	"gopkg.in/vmihailenco/msgpack.v2"
 	"errors"
 	"github.com/syndtr/goleveldb/leveldb"
 	"regexp"
@@ -15,32 +14,28 @@ func (k *Kvdb) PutChan(chname string, value []byte, ttl int) error {
 	}
 	k.Lock()
 	defer k.Unlock()
+	s := k.newChanStage()
+	var tail uint64
 	if mt, ok := k.mats[chname]; ok {
-		nk := idToKey(chname, mt.tail+1)
-		if err := k.db.Put(nk, value, nil); err != nil {
-			return err
-		}
-		if k.enableTtl && ttl > 0 {
-			k.ttldb.SetTTL(ttl, nk)
-		}
-		k.addchan(nk)
-		return nil
-	} else {
-		if err := k.db.Put(idToKey(chname, 1), value, nil); err != nil {
-			return err
-		}
-		k.mats[chname] = &mat{tail: 1, head: 1}
-		return nil
+		tail = mt.tail
+	}
+	nk := idToKey(chname, tail+1)
+	if err := s.apply(nk, value, false); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(nk, value)
+	if err := s.write(batch, nil); err != nil {
+		return err
+	}
+	if k.enableTtl && ttl > 0 {
+		k.ttldb.SetTTL(ttl, nk)
 	}
 	return nil
 }
 
 func (k *Kvdb) PutObjectChan(chname string, value interface{}, ttl int) error {
-	t := reflect.ValueOf(value)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
-	msg, err := msgpack.Marshal(t.Interface())
+	msg, err := encodeValue(k.mixCodec(chname), value)
 	if err != nil {
 		return err
 	}
@@ -48,97 +43,167 @@ func (k *Kvdb) PutObjectChan(chname string, value interface{}, ttl int) error {
 }
 
 func (k *Kvdb) BatPutOrDelChan(chname string, items *[]BatItem) error {
-	if k.enableChan {
-		h, t := k.getmtinfo(chname)
-		batch := new(leveldb.Batch)
-		for _, v := range *items {
-			switch v.Op {
-			case "put":
-				if len(v.Key) > k.maxkv || len(v.Value) > k.maxkv {
-					return errors.New("out of len")
-				}
-				batch.Put(v.Key, v.Value)
-				if k.enableTtl && v.Ttl > 0 {
-					k.ttldb.SetTTL(v.Ttl, v.Key)
-				}
-				k.addchan(v.Key)
-			case "del":
-				if len(v.Key) > k.maxkv {
-					return errors.New("out of len")
-				}
-				batch.Delete(v.Key)
-				if k.enableTtl {
-					k.ttldb.DelTTL(v.Key)
-				}
-				k.delchan(v.Key)
+	if !k.enableChan {
+		return errors.New("kv type not chan")
+	}
+	k.Lock()
+	defer k.Unlock()
+	s := k.newChanStage()
+	batch := new(leveldb.Batch)
+	for _, v := range *items {
+		switch v.Op {
+		case "put":
+			if len(v.Key) > k.maxkv || len(v.Value) > k.maxkv {
+				return errors.New("out of len")
+			}
+			if err := s.apply(v.Key, v.Value, false); err != nil {
+				return err
+			}
+			batch.Put(v.Key, v.Value)
+		case "del":
+			if len(v.Key) > k.maxkv {
+				return errors.New("out of len")
 			}
+			if err := s.apply(v.Key, nil, true); err != nil {
+				return err
+			}
+			batch.Delete(v.Key)
 		}
-		err := k.db.Write(batch, nil)
-		if err != nil {
-			k.setmtinfo(chname, h, t)
-			return err
+	}
+	if err := s.write(batch, nil); err != nil {
+		return err
+	}
+	if k.enableTtl {
+		for _, v := range *items {
+			if v.Op == "put" && v.Ttl > 0 {
+				k.ttldb.SetTTL(v.Ttl, v.Key)
+			} else if v.Op == "del" {
+				k.ttldb.DelTTL(v.Key)
+			}
 		}
-		return nil
-	} else {
-		return errors.New("kv type not chan")
 	}
+	return nil
 }
 
+//返回分组数据条数及最大ID
 func (k *Kvdb) getmtinfo(chname string) (uint64, uint64) {
 	k.RLock()
 	defer k.RUnlock()
 	if mt, ok := k.mats[chname]; ok {
-		return mt.head, mt.tail
+		return mt.count, mt.tail
 	}
 	return 0, 0
 }
 
-func (k *Kvdb) setmtinfo(chname string, h, t uint64) {
-	k.Lock()
-	defer k.Unlock()
-	if mt, ok := k.mats[chname]; ok {
-		mt.head = h
-		mt.tail = t
+//本次写入中各分组游标的副本，按key写入前后的大小调整数量及字节数
+type chanStage struct {
+	k     *Kvdb
+	mats  map[string]*mat
+	sizes map[string]int //本次已写入的key，-1表示已删除
+}
+
+func (k *Kvdb) newChanStage() *chanStage {
+	return &chanStage{k: k, mats: make(map[string]*mat), sizes: make(map[string]int)}
+}
+
+func (s *chanStage) apply(key, value []byte, del bool) error {
+	if !isChanKey(key) {
+		return nil
 	}
+	old, ok := s.sizes[string(key)]
+	if !ok {
+		v, err := s.k.db.Get(key, nil)
+		switch err {
+		case nil:
+			old = len(v)
+		case leveldb.ErrNotFound:
+			old = -1
+		default:
+			return err
+		}
+	}
+	chname := keyName(key)
+	mt, ok := s.mats[chname]
+	if !ok {
+		mt = &mat{mixName: chname}
+		if cur, exists := s.k.mats[chname]; exists {
+			*mt = *cur
+		}
+		s.mats[chname] = mt
+	}
+	if old >= 0 {
+		mt.count--
+		mt.bytes -= uint64(old)
+	}
+	if del {
+		s.sizes[string(key)] = -1
+		return nil
+	}
+	mt.count++
+	mt.bytes += uint64(len(value))
+	if id := keyToID(key); id > mt.tail {
+		mt.tail = id
+	}
+	s.sizes[string(key)] = len(value)
+	return nil
 }
 
-func (k *Kvdb) addchan(key []byte) {
-	if mt, ok := k.mats[keyName(key)]; ok {
-		mt.tail++
-		mt.head++
-	} else {
-		k.mats[keyName(key)] = &mat{tail: 1, head: 1}
+//分组元数据并入 batch 一起写入，成功后更新游标
+func (s *chanStage) write(batch *leveldb.Batch, ops []textOp) error {
+	for chname, mt := range s.mats {
+		batch.Put(chanMetaKey(chname), mt.encode())
+	}
+	if err := s.k.dbWrite(batch, ops); err != nil {
+		return err
 	}
+	for chname, mt := range s.mats {
+		s.k.mats[chname] = mt
+	}
+	return nil
 }
 
-func (k *Kvdb) Clear(chname string) error {
-	all := k.KeyStartKeys([]byte(chname))
-	items := make([]BatItem, 0)
-	for _, v := range all {
-		item := BatItem{
-			Op:  "del",
-			Key: []byte(v),
-		}
-		items = append(items, item)
+//chan模式下删除分组数据时同步更新分组元数据
+func (k *Kvdb) delChanKey(key []byte) error {
+	k.Lock()
+	defer k.Unlock()
+	s := k.newChanStage()
+	if err := s.apply(key, nil, true); err != nil {
+		return err
 	}
-	return k.BatPutOrDel(&items)
+	batch := new(leveldb.Batch)
+	batch.Delete(key)
+	return s.write(batch, k.textOp(nil, key, nil, true))
 }
 
-func (k *Kvdb) delchan(key []byte) {
-	if k.enableChan {
-		if mt, ok := k.mats[keyName(key)]; ok {
-			id := keyToID(key)
-			if id <= mt.tail {
-				k.Lock()
-				mt.head--
-				//当key取空后重置游标
-				if mt.head == 0 {
-					mt.tail = 0
-				}
-				k.Unlock()
-			}
+func (k *Kvdb) Clear(chname string) error {
+	k.Lock()
+	defer k.Unlock()
+	s := k.newChanStage()
+	batch := new(leveldb.Batch)
+	ops := make([]textOp, 0)
+	keys := make([][]byte, 0)
+	iter := k.db.NewIterator(util.BytesPrefix(nsPrefix(nsChan, chname)), k.iteratorOpts)
+	for iter.Next() {
+		key := make([]byte, len(iter.Key()))
+		copy(key, iter.Key())
+		batch.Delete(key)
+		ops = k.textOp(ops, key, nil, true)
+		keys = append(keys, key)
+	}
+	iter.Release()
+	if mt, ok := k.mats[chname]; ok {
+		next := mt.popped(mt.count, mt.bytes)
+		s.mats[chname] = &next
+	}
+	if err := s.write(batch, ops); err != nil {
+		return err
+	}
+	if k.enableTtl {
+		for _, key := range keys {
+			k.ttldb.DelTTL(key)
 		}
 	}
+	return nil
 }
 
 func (k *Kvdb) RegexpByObjectChan(chname, exp string, Ntype interface{}) ([]KvItem, error) {
@@ -150,12 +215,13 @@ func (k *Kvdb) RegexpByObjectChan(chname, exp string, Ntype interface{}) ([]KvIt
 	if nt.Kind() == reflect.Ptr {
 		nt = nt.Elem()
 	}
+	c := k.mixCodec(chname)
 	result := make([]KvItem, 0)
-	iter := k.db.NewIterator(util.BytesPrefix([]byte(chname+"-")), k.iteratorOpts)
+	iter := k.db.NewIterator(util.BytesPrefix(nsPrefix(nsChan, chname)), k.iteratorOpts)
 	for iter.Next() {
 		if regx.Match(iter.Key()) {
 			t := reflect.New(nt).Interface()
-			err := msgpack.Unmarshal(iter.Value(), t)
+			err := decodeValue(iter.Value(), c, t)
 			if err == nil {
 				item := KvItem{}
 				item.Key = make([]byte, len(iter.Key()))
@@ -174,11 +240,12 @@ func (k *Kvdb) AllByObjectChan(chname string, Ntype interface{}) []KvItem {
 	if nt.Kind() == reflect.Ptr {
 		nt = nt.Elem()
 	}
+	c := k.mixCodec(chname)
 	result := make([]KvItem, 0)
-	iter := k.db.NewIterator(util.BytesPrefix([]byte(chname+"-")), k.iteratorOpts)
+	iter := k.db.NewIterator(util.BytesPrefix(nsPrefix(nsChan, chname)), k.iteratorOpts)
 	for iter.Next() {
 		t := reflect.New(nt).Interface()
-		err := msgpack.Unmarshal(iter.Value(), t)
+		err := decodeValue(iter.Value(), c, t)
 		if err == nil {
 			item := KvItem{}
 			item.Key = make([]byte, len(iter.Key()))
@@ -193,7 +260,7 @@ func (k *Kvdb) AllByObjectChan(chname string, Ntype interface{}) []KvItem {
 
 func (k *Kvdb) AllByKVChan(chname string) []KvItem {
 	result := make([]KvItem, 0)
-	iter := k.db.NewIterator(util.BytesPrefix([]byte(chname+"-")), k.iteratorOpts)
+	iter := k.db.NewIterator(util.BytesPrefix(nsPrefix(nsChan, chname)), k.iteratorOpts)
 	for iter.Next() {
 		item := KvItem{}
 		item.Key = make([]byte, len(iter.Key()))
@@ -206,29 +273,16 @@ func (k *Kvdb) AllByKVChan(chname string) []KvItem {
 	return result
 }
 
-func (k *Kvdb) init() {
-	if k.enableChan {
-		iter := k.db.NewIterator(nil, k.iteratorOpts)
-		defer iter.Release()
-		k.Lock()
-		for iter.Next() {
-			mixName := keyName(iter.Key())
-			if _, ok := k.mats[mixName]; !ok {
-				k.mats[mixName] = &mat{head: 0, tail: 0}
-			}
-		}
-		if len(k.mats) > 0 {
-			for nk, v := range k.mats {
-				var lastid uint64
-				iter := k.db.NewIterator(util.BytesPrefix([]byte(nk+"-")), k.iteratorOpts)
-				for iter.Next() {
-					v.head++
-					lastid = keyToID(iter.Key())
-				}
-				iter.Release()
-				v.tail = lastid
-			}
-		}
-		k.Unlock()
+func (k *Kvdb) init() error {
+	if !k.enableChan {
+		return nil
 	}
+	clean, err := markOpen(k.db)
+	if err != nil {
+		return err
+	}
+	k.Lock()
+	defer k.Unlock()
+	k.mats, err = loadMats(k.db, k.iteratorOpts, !clean)
+	return err
 }
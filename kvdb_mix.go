@@ -2,13 +2,31 @@ package yiyidb
 
 import (
 	"reflect"
-	"gopkg.in/vmihailenco/msgpack.v2"
 	"github.com/syndtr/goleveldb/leveldb"
 	"errors"
-	"strings"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+//设置分组对象编码器，未设置的分组使用库默认编码器
+func (k *Kvdb) SetMixCodec(chname string, c Codec) {
+	k.Lock()
+	defer k.Unlock()
+	if c == nil {
+		delete(k.mixCodecs, chname)
+		return
+	}
+	k.mixCodecs[chname] = c
+}
+
+func (k *Kvdb) mixCodec(chname string) Codec {
+	k.RLock()
+	defer k.RUnlock()
+	if c, ok := k.mixCodecs[chname]; ok {
+		return c
+	}
+	return k.codec
+}
+
 func (k *Kvdb) ExistsMix(chname, key string) bool {
 	if len(key) > k.maxkv {
 		return false
@@ -18,9 +36,6 @@ func (k *Kvdb) ExistsMix(chname, key string) bool {
 }
 
 func (k *Kvdb) GetMix(chname, key string) ([]byte, error) {
-	if strings.Contains(chname,"-") || strings.Contains(string(key), "-"){
-		return nil, errors.New("ch or key has '-'")
-	}
 	data, err := k.db.Get(idToKeyMix(chname,key), nil)
 	if err != nil {
 		return nil, err
@@ -37,22 +52,17 @@ func (k *Kvdb) GetObjectMix(chname, key string, value interface{}) error {
 	if v.Kind() != reflect.Ptr {
 		return errors.New("not ptr")
 	}
-	err = msgpack.Unmarshal(data, &value)
-	if err != nil {
-		return err
-	}
-	return nil
+	return decodeValue(data, k.mixCodec(chname), value)
 }
 
 func (k *Kvdb) PutMix(chname, key string, value []byte, ttl int) error {
 	if len(value) > k.maxkv {
 		return errors.New("out of len")
 	}
-	if strings.Contains(chname,"-") || strings.Contains(string(key), "-"){
-		return errors.New("ch or key has '-'")
-	}
+	k.mixMu.RLock()
+	defer k.mixMu.RUnlock()
 	nk := idToKeyMix(chname, key)
-	if err := k.db.Put(nk, value, nil); err != nil {
+	if err := k.dbPut(nk, value); err != nil {
 		return err
 	}
 	if k.enableTtl && ttl > 0 {
@@ -62,11 +72,11 @@ func (k *Kvdb) PutMix(chname, key string, value []byte, ttl int) error {
 }
 
 func (k *Kvdb) PutObjectMix(chname, key string, value interface{}, ttl int) error {
-	t := reflect.ValueOf(value)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
-	msg, err := msgpack.Marshal(t.Interface())
+	return k.PutObjectMixWith(chname, key, value, ttl, k.mixCodec(chname))
+}
+
+func (k *Kvdb) PutObjectMixWith(chname, key string, value interface{}, ttl int, c Codec) error {
+	msg, err := encodeValue(c, value)
 	if err != nil {
 		return err
 	}
@@ -74,10 +84,10 @@ func (k *Kvdb) PutObjectMix(chname, key string, value interface{}, ttl int) erro
 }
 
 func (k *Kvdb) BatPutOrDelMix(chname string, items *[]BatItem) error {
-	if strings.Contains(chname,"-"){
-		return errors.New("ch or key has '-' ")
-	}
+	k.mixMu.RLock()
+	defer k.mixMu.RUnlock()
 	batch := new(leveldb.Batch)
+	ops := make([]textOp, 0)
 	for _, v := range *items {
 		nk := idToKeyMix(chname, string(v.Key))
 		switch v.Op {
@@ -86,6 +96,7 @@ func (k *Kvdb) BatPutOrDelMix(chname string, items *[]BatItem) error {
 				return errors.New("out of len")
 			}
 			batch.Put(nk, v.Value)
+			ops = k.textOp(ops, nk, v.Value, false)
 			if k.enableTtl && v.Ttl > 0 {
 				k.ttldb.SetTTL(v.Ttl, nk)
 			}
@@ -94,12 +105,13 @@ func (k *Kvdb) BatPutOrDelMix(chname string, items *[]BatItem) error {
 				return errors.New("out of len")
 			}
 			batch.Delete(nk)
+			ops = k.textOp(ops, nk, nil, true)
 			if k.enableTtl {
 				k.ttldb.DelTTL(nk)
 			}
 		}
 	}
-	err := k.db.Write(batch, nil)
+	err := k.dbWrite(batch, ops)
 	if err != nil {
 		return err
 	}
@@ -107,7 +119,9 @@ func (k *Kvdb) BatPutOrDelMix(chname string, items *[]BatItem) error {
 }
 
 func (k *Kvdb) DelMix(chname string) error {
-	all := k.KeyStartKeys([]byte(chname+"-"))
+	k.mixMu.RLock()
+	defer k.mixMu.RUnlock()
+	all := k.KeyStartKeys(nsPrefix(nsMix, chname))
 	items := make([]BatItem, 0)
 	for _, v := range all {
 		item := BatItem{
@@ -120,11 +134,10 @@ func (k *Kvdb) DelMix(chname string) error {
 }
 
 func (k *Kvdb) DelColMix(chname, key string) error {
-	if strings.Contains(chname,"-") || strings.Contains(string(key), "-"){
-		return errors.New("ch or key has '-' ")
-	}
-	nk := []byte(idToKeyMix(chname, key))
-	err := k.db.Delete(nk, nil)
+	k.mixMu.RLock()
+	defer k.mixMu.RUnlock()
+	nk := idToKeyMix(chname, key)
+	err := k.dbDelete(nk)
 	if err != nil {
 		return err
 	}
@@ -141,11 +154,12 @@ func (k *Kvdb) AllByObjectMix(chname string, Ntype interface{}) []KvItem {
 	if nt.Kind() == reflect.Ptr {
 		nt = nt.Elem()
 	}
+	c := k.mixCodec(chname)
 	result := make([]KvItem, 0)
-	iter := k.db.NewIterator(util.BytesPrefix([]byte(chname+"-")), k.iteratorOpts)
+	iter := k.db.NewIterator(util.BytesPrefix(nsPrefix(nsMix, chname)), k.iteratorOpts)
 	for iter.Next() {
 		t := reflect.New(nt).Interface()
-		err := msgpack.Unmarshal(iter.Value(), t)
+		err := decodeValue(iter.Value(), c, t)
 		if err == nil {
 			item := KvItem{}
 			item.Key = make([]byte, len(iter.Key()))
@@ -160,7 +174,7 @@ func (k *Kvdb) AllByObjectMix(chname string, Ntype interface{}) []KvItem {
 
 func (k *Kvdb) AllByKVMix(chname string) []KvItem {
 	result := make([]KvItem, 0)
-	iter := k.db.NewIterator(util.BytesPrefix([]byte(chname+"-")), k.iteratorOpts)
+	iter := k.db.NewIterator(util.BytesPrefix(nsPrefix(nsMix, chname)), k.iteratorOpts)
 	for iter.Next() {
 		item := KvItem{}
 		item.Key = make([]byte, len(iter.Key()))
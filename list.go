@@ -0,0 +1,242 @@
+package yiyidb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//双端列表: 元素 i+序号 -> value，元数据保存 数量+头部序号，重新打开无需扫描
+const lItemSub byte = 'i'
+
+type listMeta struct {
+	head  int64
+	count uint64
+}
+
+func lItemPrefix(list string) []byte {
+	return nsKey(nsList, list, []byte{lItemSub})
+}
+
+func lItemKey(list string, idx int64) []byte {
+	return append(lItemPrefix(list), IdToKeyPure(uint64(idx)^1<<63)...)
+}
+
+func (k *Kvdb) lMeta(list string) listMeta {
+	val, err := k.db.Get(nsMetaKey(nsList, list), nil)
+	if err != nil || len(val) < 16 {
+		return listMeta{}
+	}
+	return listMeta{count: KeyToIDPure(val), head: int64(KeyToIDPure(val[8:]) ^ 1<<63)}
+}
+
+func (k *Kvdb) lSetMeta(batch *leveldb.Batch, list string, m listMeta) {
+	if m.count == 0 {
+		k.nsSetCount(batch, nsList, list, 0)
+		return
+	}
+	batch.Put(nsMetaKey(nsList, list), append(IdToKeyPure(m.count), IdToKeyPure(uint64(m.head)^1<<63)...))
+}
+
+//把可为负数的下标转为相对头部的偏移
+func (m listMeta) index(idx int64) (int64, bool) {
+	if idx < 0 {
+		idx += int64(m.count)
+	}
+	return idx, idx >= 0 && idx < int64(m.count)
+}
+
+func (m listMeta) span(start, stop int64) (int64, int64) {
+	if start < 0 {
+		start += int64(m.count)
+	}
+	if stop < 0 {
+		stop += int64(m.count)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= int64(m.count) {
+		stop = int64(m.count) - 1
+	}
+	return start, stop
+}
+
+func (k *Kvdb) lPush(list string, values [][]byte, left bool) (uint64, error) {
+	k.Lock()
+	defer k.Unlock()
+	m := k.lMeta(list)
+	batch := new(leveldb.Batch)
+	for _, v := range values {
+		if len(v) > k.maxkv {
+			return 0, errors.New("out of len")
+		}
+		if left {
+			m.head--
+			batch.Put(lItemKey(list, m.head), v)
+		} else {
+			batch.Put(lItemKey(list, m.head+int64(m.count)), v)
+		}
+		m.count++
+	}
+	k.lSetMeta(batch, list, m)
+	if err := k.db.Write(batch, nil); err != nil {
+		return 0, err
+	}
+	k.waits.notify(string(lItemPrefix(list)), len(values))
+	return m.count, nil
+}
+
+//从头部依次插入，返回插入后长度
+func (k *Kvdb) LPush(list string, values ...[]byte) (uint64, error) {
+	return k.lPush(list, values, true)
+}
+
+func (k *Kvdb) RPush(list string, values ...[]byte) (uint64, error) {
+	return k.lPush(list, values, false)
+}
+
+func (k *Kvdb) lPop(list string, left bool) ([]byte, error) {
+	k.Lock()
+	defer k.Unlock()
+	m := k.lMeta(list)
+	if m.count == 0 {
+		return nil, ErrEmpty
+	}
+	idx := m.head + int64(m.count) - 1
+	if left {
+		idx = m.head
+		m.head++
+	}
+	m.count--
+	key := lItemKey(list, idx)
+	val, err := k.db.Get(key, nil)
+	if err != nil {
+		return nil, err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(key)
+	k.lSetMeta(batch, list, m)
+	return val, k.db.Write(batch, nil)
+}
+
+//列表为空时返回 ErrEmpty
+func (k *Kvdb) LPop(list string) ([]byte, error) {
+	return k.lPop(list, true)
+}
+
+func (k *Kvdb) RPop(list string) ([]byte, error) {
+	return k.lPop(list, false)
+}
+
+//阻塞弹出，timeout 为0时一直等待，超时返回 ErrTimeout，关闭数据库返回 ErrDBClosed
+func (k *Kvdb) BLPop(list string, timeout time.Duration) ([]byte, error) {
+	return k.bPop(list, timeout, true)
+}
+
+func (k *Kvdb) BRPop(list string, timeout time.Duration) ([]byte, error) {
+	return k.bPop(list, timeout, false)
+}
+
+func (k *Kvdb) bPop(list string, timeout time.Duration, left bool) ([]byte, error) {
+	var val []byte
+	err := k.waits.blockTimeout(timeout, string(lItemPrefix(list)), func() error {
+		var err error
+		val, err = k.lPop(list, left)
+		return err
+	})
+	return val, err
+}
+
+func (k *Kvdb) LLen(list string) uint64 {
+	return k.nsCount(nsList, list)
+}
+
+//按下标范围(含)返回，负数表示从末尾倒数
+func (k *Kvdb) LRange(list string, start, stop int64) ([][]byte, error) {
+	k.RLock()
+	m := k.lMeta(list)
+	snap, err := k.db.GetSnapshot()
+	k.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	start, stop = m.span(start, stop)
+	result := make([][]byte, 0)
+	if start > stop {
+		return result, nil
+	}
+	iter := snap.NewIterator(util.BytesPrefix(lItemPrefix(list)), k.iteratorOpts)
+	defer iter.Release()
+	for ok := iter.Seek(lItemKey(list, m.head+start)); ok && int64(len(result)) <= stop-start; ok = iter.Next() {
+		v := make([]byte, len(iter.Value()))
+		copy(v, iter.Value())
+		result = append(result, v)
+	}
+	return result, iter.Error()
+}
+
+func (k *Kvdb) LIndex(list string, idx int64) ([]byte, error) {
+	k.RLock()
+	defer k.RUnlock()
+	m := k.lMeta(list)
+	i, ok := m.index(idx)
+	if !ok {
+		return nil, ErrOutOfBounds
+	}
+	return k.db.Get(lItemKey(list, m.head+i), nil)
+}
+
+func (k *Kvdb) LSet(list string, idx int64, value []byte) error {
+	if len(value) > k.maxkv {
+		return errors.New("out of len")
+	}
+	k.Lock()
+	defer k.Unlock()
+	m := k.lMeta(list)
+	i, ok := m.index(idx)
+	if !ok {
+		return ErrOutOfBounds
+	}
+	return k.db.Put(lItemKey(list, m.head+i), value, nil)
+}
+
+//只保留下标范围(含)内的元素
+func (k *Kvdb) LTrim(list string, start, stop int64) error {
+	k.Lock()
+	defer k.Unlock()
+	m := k.lMeta(list)
+	start, stop = m.span(start, stop)
+	batch := new(leveldb.Batch)
+	if start > stop {
+		start, stop = int64(m.count), int64(m.count)-1
+	}
+	for i := int64(0); i < start; i++ {
+		batch.Delete(lItemKey(list, m.head+i))
+	}
+	for i := stop + 1; i < int64(m.count); i++ {
+		batch.Delete(lItemKey(list, m.head+i))
+	}
+	m.head += start
+	m.count = uint64(stop - start + 1)
+	k.lSetMeta(batch, list, m)
+	return k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) LClear(list string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsList, list)
+}
+
+//设置整个列表的超时秒数，<0 取消超时
+func (k *Kvdb) LSetTTL(list string, ttl int) error {
+	return k.expireNs(nsList, list, ttl)
+}
+
+func (k *Kvdb) LGetTTL(list string) (float64, error) {
+	return k.ttlNs(nsList, list)
+}
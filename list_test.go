@@ -0,0 +1,116 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_List(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	n, err := kv.RPush("jobs", []byte("c"), []byte("d"))
+	assert.NoError(t, err)
+	assert.Equal(t, n, uint64(2))
+	n, err = kv.LPush("jobs", []byte("b"), []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, n, uint64(4))
+	kv.RPush("other", []byte("x"))
+
+	all, err := kv.LRange("jobs", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, all, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")})
+
+	v, err := kv.LIndex("jobs", -1)
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("d"))
+	_, err = kv.LIndex("jobs", 4)
+	assert.Equal(t, err, ErrOutOfBounds)
+
+	assert.NoError(t, kv.LSet("jobs", 1, []byte("B")))
+
+	//重新打开后头尾位置保持
+	kv.Close()
+	kv, err = OpenKvdb(dir, false, false, 10)
+	assert.NoError(t, err)
+	defer kv.Close()
+
+	v, err = kv.LPop("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("a"))
+	v, err = kv.RPop("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("d"))
+	assert.Equal(t, kv.LLen("jobs"), uint64(2))
+
+	kv.RPush("jobs", []byte("e"), []byte("f"))
+	assert.NoError(t, kv.LTrim("jobs", 1, -2))
+	all, err = kv.LRange("jobs", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, all, [][]byte{[]byte("c"), []byte("e")})
+
+	assert.NoError(t, kv.LTrim("jobs", 5, 10))
+	assert.Equal(t, kv.LLen("jobs"), uint64(0))
+	_, err = kv.LPop("jobs")
+	assert.Equal(t, err, ErrEmpty)
+	assert.Equal(t, kv.LLen("other"), uint64(1))
+
+	kv.Drop()
+}
+
+func TestKvdb_BLPop(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = kv.BLPop("jobs", 50*time.Millisecond)
+	assert.Equal(t, err, ErrTimeout)
+
+	var wg sync.WaitGroup
+	got := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := kv.BLPop("jobs", 0)
+			if err == nil {
+				got <- string(v)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	kv.RPush("jobs", []byte("a"), []byte("b"))
+	assert.Equal(t, len(<-got)+len(<-got), 2)
+
+	//关闭时阻塞的调用返回 ErrDBClosed
+	errc := make(chan error, 1)
+	go func() {
+		_, err := kv.BRPop("idle", 0)
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	kv.Close()
+	assert.Equal(t, <-errc, ErrDBClosed)
+	wg.Wait()
+
+	kv.Drop()
+}
@@ -0,0 +1,189 @@
+package yiyidb
+
+import (
+	"errors"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//旧版分组key格式为 chname + "-" + key，迁移时每批写入的记录数
+const migrateBatch = 1000
+
+//旧版chan key: chname + "-" + 8字节id，只转换后缀恰好8字节的key
+func legacyChanKey(ch string) func(key []byte) []byte {
+	n := len(ch) + 1
+	return func(key []byte) []byte {
+		if len(key) != n+8 {
+			return nil
+		}
+		return nsKey(nsChan, ch, key[n:])
+	}
+}
+
+//按分组名迁移旧版chan数据，不扫描分组以外的key
+func migrateChans(db *leveldb.DB, chnames []string, moved func(old, nk []byte) error) (int, error) {
+	total := 0
+	for _, ch := range chnames {
+		n, err := migrateKeys(db, util.BytesPrefix([]byte(ch+"-")), legacyChanKey(ch), moved)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+//按批把 conv 返回非空的旧key改写为新key，moved 在每条记录改写后调用
+func migrateKeys(db *leveldb.DB, rg *util.Range, conv func(key []byte) []byte, moved func(old, nk []byte) error) (int, error) {
+	total := 0
+	batch := new(leveldb.Batch)
+	pairs := make([][2][]byte, 0, migrateBatch)
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		if err := db.Write(batch, nil); err != nil {
+			return err
+		}
+		if moved != nil {
+			for _, p := range pairs {
+				if err := moved(p[0], p[1]); err != nil {
+					return err
+				}
+			}
+		}
+		total += len(pairs)
+		batch.Reset()
+		pairs = pairs[:0]
+		return nil
+	}
+	iter := db.NewIterator(rg, &opt.ReadOptions{DontFillCache: true})
+	defer iter.Release()
+	for iter.Next() {
+		nk := conv(iter.Key())
+		if nk == nil {
+			continue
+		}
+		old := append([]byte{}, iter.Key()...)
+		batch.Put(nk, iter.Value())
+		batch.Delete(old)
+		pairs = append(pairs, [2][]byte{old, nk})
+		if len(pairs) >= migrateBatch {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return total, err
+	}
+	return total, flush()
+}
+
+func (k *Kvdb) moveTTL(old, nk []byte) error {
+	if k.enableTtl {
+		return k.ttldb.moveTTL(old, nk)
+	}
+	return nil
+}
+
+//在线迁移旧版Mix分组数据到新编码，TTL一并迁移，需指定分组名避免误转普通key
+func (k *Kvdb) MigrateLegacyMix(chnames ...string) (int, error) {
+	total := 0
+	for _, ch := range chnames {
+		prefix := []byte(ch + "-")
+		n, err := migrateKeys(k.db, util.BytesPrefix(prefix), func(key []byte) []byte {
+			return idToKeyMix(ch, string(key[len(prefix):]))
+		}, k.moveTTL)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+//在线迁移chan模式旧数据，完成后重建分组游标，需指定分组名避免误转普通key
+func (k *Kvdb) MigrateLegacyChan(chnames ...string) (int, error) {
+	if !k.enableChan {
+		return 0, errors.New("kv type not chan")
+	}
+	n, err := migrateChans(k.db, chnames, k.moveTTL)
+	//打开后状态已标记为未关闭，init 会扫描重建分组元数据
+	if ierr := k.init(); err == nil {
+		err = ierr
+	}
+	return n, err
+}
+
+//离线迁移Kvdb目录，存在ttl库时一并迁移，mixNames 为Mix分组，chanNames 为chan模式分组
+func MigrateLegacyKvdb(dataDir string, nChan bool, mixNames, chanNames []string) (int, error) {
+	_, err := os.Stat(dataDir + "/ttl")
+	kv, err := OpenKvdb(dataDir, nChan, err == nil, 10)
+	if err != nil {
+		return 0, err
+	}
+	defer kv.Close()
+	total, err := kv.MigrateLegacyMix(mixNames...)
+	if err != nil || !nChan {
+		return total, err
+	}
+	n, err := kv.MigrateLegacyChan(chanNames...)
+	return total + n, err
+}
+
+//离线把旧版库中 0xff 开头的普通key移入 bucket 分组，key 不变，存在ttl库时一并迁移
+//迁移后写入格式标记，OpenKvdb 才能打开该库
+func MigrateReservedKeys(dataDir, bucket string) (int, error) {
+	db, err := leveldb.OpenFile(dataDir, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	if _, err := os.Stat(dataDir + formatFile); err == nil {
+		return 0, nil
+	}
+	var moved func(old, nk []byte) error
+	if _, err := os.Stat(dataDir + "/ttl"); err == nil {
+		ttl, err := OpenTtlRunner(db, dataDir, int(Precision(10*1.44, 0, true)))
+		if err != nil {
+			return 0, err
+		}
+		defer ttl.Close()
+		moved = ttl.moveTTL
+	}
+	n, err := migrateKeys(db, &util.Range{Start: []byte{nsMarker}}, func(key []byte) []byte {
+		return idToKeyMix(bucket, string(key))
+	}, moved)
+	if err != nil {
+		return n, err
+	}
+	return n, writeFormat(dataDir)
+}
+
+//在线迁移ChanQueue旧数据
+func (q *ChanQueue) MigrateLegacy(chnames ...string) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return 0, ErrDBClosed
+	}
+	n, err := migrateChans(q.db, chnames, nil)
+	if ierr := q.init(); err == nil {
+		err = ierr
+	}
+	return n, err
+}
+
+//离线迁移ChanQueue目录
+func MigrateLegacyChanQueue(dataDir string, chnames ...string) (int, error) {
+	q, err := OpenChanQueue(dataDir, 10)
+	if err != nil {
+		return 0, err
+	}
+	defer q.Close()
+	return q.MigrateLegacy(chnames...)
+}
@@ -0,0 +1,170 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestKvdb_MixBinaryKeys(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	uuid := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	assert.NoError(t, kv.PutMix("a", uuid, []byte("mix value"), 0))
+	assert.NoError(t, kv.PutMix("a-b", "\x00\xff", []byte("binary"), 0))
+	assert.NoError(t, kv.Put([]byte("a-"+uuid), []byte("raw value"), 0))
+	assert.Equal(t, kv.Put([]byte{nsMarker, 'x'}, []byte("raw"), 0), ErrReservedKey)
+
+	v, err := kv.GetMix("a", uuid)
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("mix value"))
+
+	all := kv.AllByKVMix("a")
+	assert.Equal(t, len(all), 1)
+	ch, key := keyToIdMix(all[0].Key)
+	assert.Equal(t, ch, "a")
+	assert.Equal(t, key, uuid)
+
+	v, err = kv.GetMix("a-b", "\x00\xff")
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("binary"))
+
+	kv.Drop()
+}
+
+func TestKvdb_MigrateLegacy(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, true, true, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	//旧版格式数据
+	kv.db.Put([]byte("jac-k1"), []byte("v1"), nil)
+	kv.db.Put([]byte("jac-k2"), []byte("v2"), nil)
+	kv.db.Put(append([]byte("yum-"), IdToKeyPure(1)...), []byte("c1"), nil)
+	kv.db.Put(append([]byte("yum-"), IdToKeyPure(2)...), []byte("c2"), nil)
+	kv.ttldb.SetTTL(100, []byte("jac-k1"))
+	//普通key及未指定的分组不迁移
+	kv.Put([]byte("order-20240101"), []byte("plain"), 0)
+	kv.db.Put([]byte("tom-k1"), []byte("t1"), nil)
+	kv.db.Put([]byte("yum-x"), []byte("short"), nil)
+	kv.Close()
+
+	n, err := MigrateLegacyKvdb(dir, true, []string{"jac"}, []string{"yum"})
+	assert.NoError(t, err)
+	assert.Equal(t, n, 4)
+
+	kv, err = OpenKvdb(dir, true, true, 10)
+	assert.NoError(t, err)
+	v, err := kv.GetMix("jac", "k1")
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("v1"))
+	ttl, err := kv.GetTTL(idToKeyMix("jac", "k1"))
+	assert.NoError(t, err)
+	assert.True(t, ttl > 90)
+	assert.False(t, kv.Exists([]byte("jac-k1")))
+
+	all := kv.AllByKVChan("yum")
+	assert.Equal(t, len(all), 2)
+	h, tail := kv.getmtinfo("yum")
+	assert.Equal(t, h, uint64(2))
+	assert.Equal(t, tail, uint64(2))
+
+	v, err = kv.Get([]byte("order-20240101"))
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("plain"))
+	v, err = kv.Get([]byte("tom-k1"))
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("t1"))
+	v, err = kv.Get([]byte("yum-x"))
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("short"))
+
+	kv.Drop()
+}
+
+func TestChanQueue_MigrateLegacy(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		q.db.Put(append([]byte("jac-"), IdToKeyPure(i)...), []byte(fmt.Sprintf("value %d", i)), nil)
+	}
+	q.db.Put(append([]byte("tom-"), IdToKeyPure(1)...), []byte("other"), nil)
+	q.Close()
+
+	n, err := MigrateLegacyChanQueue(file, "jac")
+	assert.NoError(t, err)
+	assert.Equal(t, n, 3)
+
+	q, err = OpenChanQueue(file, 10)
+	assert.NoError(t, err)
+	item, err := q.Dequeue("jac")
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "value 1")
+	_, err = q.Length("tom")
+	assert.Error(t, err)
+	v, err := q.db.Get(append([]byte("tom-"), IdToKeyPure(1)...), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("other"))
+
+	q.Drop()
+}
+
+func TestKvdb_MigrateReservedKeys(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	defer os.RemoveAll(dir)
+
+	//旧版本库中 0xff 开头的普通key
+	legacy := append([]byte{nsMarker}, IdToKeyPure(7)...)
+	db, err := leveldb.OpenFile(dir, nil)
+	assert.NoError(t, err)
+	db.Put(legacy, []byte("raw"), nil)
+	db.Put([]byte("plain"), []byte("p"), nil)
+	db.Close()
+
+	_, err = OpenKvdb(dir, false, false, 10)
+	assert.Equal(t, err, ErrLegacyReservedKey)
+
+	n, err := MigrateReservedKeys(dir, "legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	n, err = MigrateReservedKeys(dir, "legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, n, 0)
+
+	kv, err := OpenKvdb(dir, false, false, 10)
+	assert.NoError(t, err)
+	defer kv.Close()
+	v, err := kv.Bucket("legacy").Get(legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("raw"))
+	v, err = kv.Get([]byte("plain"))
+	assert.NoError(t, err)
+	assert.Equal(t, v, []byte("p"))
+}
@@ -0,0 +1,178 @@
+package yiyidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//分组类key编码: nsMarker + 类型标识 + uvarint(len(name)) + name + 子key
+//0xff 不会出现在utf8文本中，普通key不允许以其开头，避免与分组数据冲突
+//旧版本创建的库可能已有 0xff 开头的普通key，打开时检查格式标记，需先用 MigrateReservedKeys 迁移
+const nsMarker byte = 0xff
+
+const (
+	nsMix       byte = 'm'
+	nsChan      byte = 'c'
+	nsZset      byte = 'z'
+	nsHash      byte = 'h'
+	nsSet       byte = 's'
+	nsList      byte = 'l'
+	nsTS        byte = 't'
+	nsBit       byte = 'b'
+	nsHLL       byte = 'p'
+	nsGeo       byte = 'g'
+	nsText      byte = 'x'
+	nsTextDef   byte = 'X'
+	nsVec       byte = 'v'
+	nsFlight    byte = 'f'
+	nsFlightDue byte = 'F'
+	nsDead      byte = 'D'
+	nsDelay     byte = 'd'
+	nsLog       byte = 'L'
+	nsGroup     byte = 'o'
+	nsSeq       byte = 'q'
+	nsChanMeta  byte = 'C'
+	nsState     byte = 'S'
+	nsDedup     byte = 'u'
+	nsDedupDue  byte = 'U'
+)
+
+//复合类型的元数据子key，类型整体的ttl挂在该key上，超时后删除整个类型前缀
+const nsMetaSub byte = 0x00
+
+var ErrReservedKey = errors.New("key prefix 0xff reserved")
+
+var ErrLegacyReservedKey = errors.New("legacy keys with prefix 0xff found, run MigrateReservedKeys first")
+
+//数据目录下的格式标记文件，不存在说明库由旧版本创建，其中 0xff 开头的key都是普通key
+//与ttl库目录一样放在数据目录中，不占用key空间
+const formatFile = "/yiyidb.format"
+
+//新库写入格式标记，没有标记的旧库存在 0xff 开头的key时返回 ErrLegacyReservedKey
+func checkFormat(db *leveldb.DB, dataDir string) error {
+	if _, err := os.Stat(dataDir + formatFile); err == nil {
+		return nil
+	}
+	iter := db.NewIterator(&util.Range{Start: []byte{nsMarker}}, nil)
+	found := iter.First()
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if found {
+		return ErrLegacyReservedKey
+	}
+	return writeFormat(dataDir)
+}
+
+func writeFormat(dataDir string) error {
+	return os.WriteFile(dataDir+formatFile, []byte{1}, 0644)
+}
+
+func nsPrefix(tag byte, name string) []byte {
+	p := make([]byte, 2+binary.MaxVarintLen64+len(name))
+	p[0] = nsMarker
+	p[1] = tag
+	n := binary.PutUvarint(p[2:], uint64(len(name)))
+	copy(p[2+n:], name)
+	return p[:2+n+len(name)]
+}
+
+func nsKey(tag byte, name string, sub []byte) []byte {
+	p := nsPrefix(tag, name)
+	key := make([]byte, len(p)+len(sub))
+	copy(key, p)
+	copy(key[len(p):], sub)
+	return key
+}
+
+//拆分分组key，非分组key返回 ok=false
+func nsSplit(key []byte) (tag byte, name string, sub []byte, ok bool) {
+	if len(key) < 3 || key[0] != nsMarker {
+		return 0, "", nil, false
+	}
+	l, n := binary.Uvarint(key[2:])
+	if n <= 0 || uint64(len(key)-2-n) < l {
+		return 0, "", nil, false
+	}
+	start := 2 + n
+	return key[1], string(key[start : start+int(l)]), key[start+int(l):], true
+}
+
+func isReservedKey(key []byte) bool {
+	return len(key) > 0 && key[0] == nsMarker
+}
+
+func nsMetaKey(tag byte, name string) []byte {
+	return nsKey(tag, name, []byte{nsMetaSub})
+}
+
+//复合类型元数据key对应的类型前缀，其它key返回nil
+func compositePrefix(key []byte) []byte {
+	tag, name, sub, ok := nsSplit(key)
+	if !ok || tag == nsMix || tag == nsChan || len(sub) != 1 || sub[0] != nsMetaSub {
+		return nil
+	}
+	return nsPrefix(tag, name)
+}
+
+//删除整个复合类型及其ttl
+func (k *Kvdb) delNs(tag byte, name string) error {
+	batch := new(leveldb.Batch)
+	iter := k.db.NewIterator(util.BytesPrefix(nsPrefix(tag, name)), k.iteratorOpts)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	if err := k.db.Write(batch, nil); err != nil {
+		return err
+	}
+	if k.enableTtl {
+		k.ttldb.DelTTL(nsMetaKey(tag, name))
+	}
+	return nil
+}
+
+func (k *Kvdb) expireNs(tag byte, name string, ttl int) error {
+	if !k.enableTtl {
+		return errors.New("ttl not enable")
+	}
+	meta := nsMetaKey(tag, name)
+	if !k.Exists(meta) {
+		return errors.New("records not found")
+	}
+	if ttl == 0 {
+		return errors.New("must > 0")
+	}
+	return k.ttldb.SetTTL(ttl, meta)
+}
+
+func (k *Kvdb) ttlNs(tag byte, name string) (float64, error) {
+	return k.GetTTL(nsMetaKey(tag, name))
+}
+
+//复合类型成员数，保存在元数据key中
+func (k *Kvdb) nsCount(tag byte, name string) uint64 {
+	val, err := k.db.Get(nsMetaKey(tag, name), nil)
+	if err != nil || len(val) < 8 {
+		return 0
+	}
+	return KeyToIDPure(val)
+}
+
+//成员数为0时删除元数据及ttl，类型随之消失
+func (k *Kvdb) nsSetCount(batch *leveldb.Batch, tag byte, name string, n uint64) {
+	meta := nsMetaKey(tag, name)
+	if n == 0 {
+		batch.Delete(meta)
+		if k.enableTtl {
+			k.ttldb.DelTTL(meta)
+		}
+		return
+	}
+	batch.Put(meta, IdToKeyPure(n))
+}
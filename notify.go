@@ -0,0 +1,227 @@
+package yiyidb
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//阻塞读取的等待队列，按注册先后顺序唤醒，关闭后唤醒全部等待者
+type waitQueue struct {
+	sync.Mutex
+	waiters map[string][]chan struct{}
+	timers  map[timerKey]*dueTimer
+	closed  bool
+}
+
+//每个分组最多两个定时器，分别指向最早的延时消息及最早到期的租约
+type timerKey struct {
+	name  string
+	lease bool
+}
+
+type dueTimer struct {
+	*time.Timer
+	due int64
+}
+
+func newWaitQueue() *waitQueue {
+	return &waitQueue{waiters: make(map[string][]chan struct{}), timers: make(map[timerKey]*dueTimer)}
+}
+
+//注册等待者，front 为 true 时排到队首(被唤醒但未取到数据的等待者)
+func (w *waitQueue) wait(name string, front bool) (chan struct{}, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return nil, false
+	}
+	ch := make(chan struct{})
+	if front {
+		w.waiters[name] = append([]chan struct{}{ch}, w.waiters[name]...)
+	} else {
+		w.waiters[name] = append(w.waiters[name], ch)
+	}
+	return ch, true
+}
+
+//取消注册，若已被唤醒则把唤醒转交给下一个等待者
+func (w *waitQueue) cancel(name string, ch chan struct{}) {
+	w.Lock()
+	defer w.Unlock()
+	list := w.waiters[name]
+	for i, c := range list {
+		if c == ch {
+			w.waiters[name] = append(list[:i], list[i+1:]...)
+			if len(w.waiters[name]) == 0 {
+				delete(w.waiters, name)
+			}
+			return
+		}
+	}
+	if !w.closed {
+		w.notifyLocked(name, 1)
+	}
+}
+
+//唤醒最早的 n 个等待者
+func (w *waitQueue) notify(name string, n int) {
+	w.Lock()
+	defer w.Unlock()
+	w.notifyLocked(name, n)
+}
+
+func (w *waitQueue) notifyLocked(name string, n int) {
+	list := w.waiters[name]
+	if n > len(list) {
+		n = len(list)
+	}
+	for _, ch := range list[:n] {
+		close(ch)
+	}
+	if n == len(list) {
+		delete(w.waiters, name)
+	} else {
+		w.waiters[name] = list[n:]
+	}
+}
+
+func (w *waitQueue) close() {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	for key, t := range w.timers {
+		t.Stop()
+		delete(w.timers, key)
+	}
+	for name, list := range w.waiters {
+		for _, ch := range list {
+			close(ch)
+		}
+		delete(w.waiters, name)
+	}
+}
+
+//等待者数量
+func (w *waitQueue) len(name string) int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.waiters[name])
+}
+
+func (w *waitQueue) isClosed() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.closed
+}
+
+//循环调用 try 直到取得数据、ctx 结束或等待队列关闭，try 返回 ErrEmpty 表示需继续等待
+func (w *waitQueue) block(ctx context.Context, name string, try func() error) error {
+	front := false
+	for {
+		ch, ok := w.wait(name, front)
+		if !ok {
+			return ErrDBClosed
+		}
+		err := try()
+		if err != ErrEmpty {
+			w.cancel(name, ch)
+			return err
+		}
+		select {
+		case <-ch:
+			if w.isClosed() {
+				return ErrDBClosed
+			}
+			front = true
+		case <-ctx.Done():
+			w.cancel(name, ch)
+			return ctx.Err()
+		}
+	}
+}
+
+//按超时等待，timeout 为0时一直等待，超时返回 ErrTimeout
+func (w *waitQueue) blockTimeout(timeout time.Duration, name string, try func() error) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	err := w.block(ctx, name, try)
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	return err
+}
+
+//唤醒全部等待者，用于 Nack 等只有部分等待者能取到的数据
+func (w *waitQueue) notifyAll(name string) {
+	w.Lock()
+	defer w.Unlock()
+	w.notifyLocked(name, len(w.waiters[name]))
+}
+
+//到期时唤醒一个等待者，用于延时消息，已有更早的定时器时不变
+func (w *waitQueue) notifyAt(name string, due int64) {
+	w.Lock()
+	defer w.Unlock()
+	w.armEarlier(timerKey{name: name}, due)
+}
+
+//租约到期时唤醒全部等待者，已有更早的定时器时不变，due 为0时忽略
+func (w *waitQueue) leaseAt(name string, due int64) {
+	w.Lock()
+	defer w.Unlock()
+	if due > 0 {
+		w.armEarlier(timerKey{name: name, lease: true}, due)
+	}
+}
+
+//把分组延时消息的定时器重设为 due，due 为0时停止
+func (w *waitQueue) schedule(name string, due int64) {
+	w.Lock()
+	defer w.Unlock()
+	key := timerKey{name: name}
+	if t, ok := w.timers[key]; ok && t.due == due {
+		return
+	}
+	w.arm(key, due)
+}
+
+func (w *waitQueue) armEarlier(key timerKey, due int64) {
+	if t, ok := w.timers[key]; ok && t.due <= due {
+		return
+	}
+	w.arm(key, due)
+}
+
+func (w *waitQueue) arm(key timerKey, due int64) {
+	if t, ok := w.timers[key]; ok {
+		t.Stop()
+		delete(w.timers, key)
+	}
+	if w.closed || due == 0 {
+		return
+	}
+	t := &dueTimer{due: due}
+	t.Timer = time.AfterFunc(time.Until(time.Unix(0, due)), func() {
+		w.Lock()
+		defer w.Unlock()
+		if w.timers[key] == t {
+			delete(w.timers, key)
+		}
+		if key.lease {
+			w.notifyLocked(key.name, len(w.waiters[key.name]))
+		} else {
+			w.notifyLocked(key.name, 1)
+		}
+	})
+	w.timers[key] = t
+}
@@ -4,10 +4,13 @@ import (
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"gopkg.in/vmihailenco/msgpack.v2"
 	"sync"
 	"os"
 	"errors"
+	"context"
+	"time"
 )
 
 //FIFO
@@ -20,6 +23,14 @@ type Queue struct {
 	isOpen       bool
 	iteratorOpts *opt.ReadOptions
 	maxkv        int
+	waits        *waitQueue
+	maxAttempts  int
+	lease        uint64
+	delaySeq     uint64
+	bound        *bound
+	spill        *Queue
+	space        *waitQueue
+	dedupWindow  time.Duration
 }
 
 func OpenQueue(dataDir string) (*Queue, error) {
@@ -33,6 +44,10 @@ func OpenQueue(dataDir string) (*Queue, error) {
 		isOpen:       false,
 		iteratorOpts: &opt.ReadOptions{DontFillCache: true},
 		maxkv:        512 * MB,
+		waits:        newWaitQueue(),
+		space:        newWaitQueue(),
+		maxAttempts:  defaultMaxAttempts,
+		dedupWindow:  defaultDedupWindow,
 	}
 
 	opts := &opt.Options{}
@@ -57,51 +72,101 @@ func OpenQueue(dataDir string) (*Queue, error) {
 }
 
 func (q *Queue) EnqueueBatch(value [][]byte) error {
-	q.Lock()
-	defer q.Unlock()
-	if !q.isOpen {
-		return ErrDBClosed
+	var err error
+	if len(value) > 0 {
+		err = waitSpace(q.space, "", q.blockTimeout(), func() error {
+			_, err := q.enqueue(value, "")
+			return err
+		})
 	}
+	return err
+}
 
-	batch := new(leveldb.Batch)
-	for _, v := range value {
-		if len(v) > q.maxkv {
-			return errors.New("out of len 512M")
-		}
-		item := &QueueItem{
-			ID:    q.tail + 1,
-			Key:   IdToKeyPure(q.tail + 1),
-			Value: v,
-		}
-		batch.Put(item.Key, item.Value)
-		q.tail++
-	}
-	if err := q.db.Write(batch, nil); err != nil {
+//设置了容量限制且写入溢出目录时返回的 ID 为0
+func (q *Queue) Enqueue(value []byte) (*QueueItem, error) {
+	var items []*QueueItem
+	err := waitSpace(q.space, "", q.blockTimeout(), func() error {
+		var err error
+		items, err = q.enqueue([][]byte{value}, "")
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	return items[0], nil
 }
 
-func (q *Queue) Enqueue(value []byte) (*QueueItem, error) {
+//dedupID 不为空时按去重窗口忽略重复写入
+func (q *Queue) enqueue(values [][]byte, dedupID string) ([]*QueueItem, error) {
 	q.Lock()
 	defer q.Unlock()
 	if !q.isOpen {
 		return nil, ErrDBClosed
 	}
-	if len(value) > q.maxkv {
-		return nil, errors.New("out of len 512M")
+	if dedupID != "" {
+		if item, err := findDedup(q.db, "", dedupID, IdToKeyPure); item != nil || err != nil {
+			return []*QueueItem{item}, err
+		}
 	}
-	item := &QueueItem{
-		ID:    q.tail + 1,
-		Key:   IdToKeyPure(q.tail + 1),
-		Value: value,
+	var size uint64
+	for _, v := range values {
+		if len(v) > q.maxkv {
+			return nil, errors.New("out of len 512M")
+		}
+		size += uint64(len(v))
+	}
+	batch := new(leveldb.Batch)
+	var dropped, droppedBytes uint64
+	if q.bound != nil {
+		act, err := q.bound.admit(q.tail-q.head, uint64(len(values)), size, q.spill != nil && q.spill.Length() > 0)
+		if err != nil {
+			return nil, err
+		}
+		switch act {
+		case admitSpill:
+			if err := q.spill.EnqueueBatch(values); err != nil {
+				return nil, err
+			}
+			//溢出写入成功后才记录去重，失败时重试不会被当作重复
+			if dedupID != "" {
+				if err := putDedup(q.db, batch, "", dedupID, 0, q.dedupWindow); err != nil {
+					return nil, err
+				}
+				if err := q.db.Write(batch, nil); err != nil {
+					return nil, err
+				}
+			}
+			return spilledItems(values), nil
+		case admitDrop:
+			r := &util.Range{Start: IdToKeyPure(q.head + 1), Limit: IdToKeyPure(q.tail + 1)}
+			if dropped, droppedBytes, err = q.bound.dropOldest(q.db, batch, r, q.tail-q.head, uint64(len(values)), size); err != nil {
+				return nil, err
+			}
+		}
+	}
+	items := make([]*QueueItem, len(values))
+	for i, v := range values {
+		id := q.tail + uint64(i) + 1
+		items[i] = &QueueItem{ID: id, Key: IdToKeyPure(id), Value: v}
+		batch.Put(items[i].Key, v)
 	}
-	if err := q.db.Put(item.Key, item.Value, nil); err != nil {
+	batch.Put(seqKey(""), IdToKeyPure(q.tail+uint64(len(values))))
+	if dedupID != "" {
+		if err := putDedup(q.db, batch, "", dedupID, items[0].ID, q.dedupWindow); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.db.Write(batch, nil); err != nil {
 		return nil, err
 	}
-	q.tail++
-	return item, nil
+	q.head += dropped
+	q.tail += uint64(len(values))
+	if q.bound != nil {
+		q.bound.bytes -= droppedBytes
+	}
+	q.grew(size)
+	q.waits.notify("", len(values))
+	return items, nil
 }
 
 func (q *Queue) EnqueueString(value string) (*QueueItem, error) {
@@ -122,6 +187,9 @@ func (q *Queue) Dequeue() (*QueueItem, error) {
 	if !q.isOpen {
 		return nil, ErrDBClosed
 	}
+	if err := q.promote(); err != nil {
+		return nil, err
+	}
 	item, err := q.getItemByID(q.head + 1)
 	if err != nil {
 		return nil, err
@@ -130,30 +198,189 @@ func (q *Queue) Dequeue() (*QueueItem, error) {
 		return nil, err
 	}
 	q.head++
-	//当队列取空后重置游标
-	if q.head == q.tail {
-		q.head = 0
-		q.tail = 0
-	}
+	q.shrank(1, uint64(len(item.Value)))
 	return item, nil
 }
 
+//阻塞等待直到取得数据，ctx 结束返回 ctx.Err()，队列关闭返回 ErrDBClosed
+func (q *Queue) DequeueWait(ctx context.Context) (*QueueItem, error) {
+	var item *QueueItem
+	err := q.waits.block(ctx, "", func() error {
+		var err error
+		item, err = q.Dequeue()
+		return err
+	})
+	return item, err
+}
+
+//阻塞等待直到取得数据，超时返回 ErrTimeout，timeout 为0时一直等待
+func (q *Queue) DequeueTimeout(timeout time.Duration) (*QueueItem, error) {
+	var item *QueueItem
+	err := q.waits.blockTimeout(timeout, "", func() error {
+		var err error
+		item, err = q.Dequeue()
+		return err
+	})
+	return item, err
+}
+
+//已到期但未移入队列的延时消息接在队列数据之后返回，ID 为0，Peek 与 Length 不移动数据
 func (q *Queue) Peek() (*QueueItem, error) {
+	return q.PeekByOffset(0)
+}
+
+func (q *Queue) PeekByOffset(offset uint64) (*QueueItem, error) {
 	q.RLock()
 	defer q.RUnlock()
 	if !q.isOpen {
 		return nil, ErrDBClosed
 	}
-	return q.getItemByID(q.head + 1)
+	items, err := q.peekItems(offset, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &items[0], nil
 }
 
-func (q *Queue) PeekByOffset(offset uint64) (*QueueItem, error) {
+//从 offset 开始查看最多 n 条数据
+func (q *Queue) PeekRange(offset uint64, n int) ([]QueueItem, error) {
 	q.RLock()
 	defer q.RUnlock()
 	if !q.isOpen {
 		return nil, ErrDBClosed
 	}
-	return q.getItemByID(q.head + offset + 1)
+	return q.peekItems(offset, n)
+}
+
+//DrainTo 每次交给 fn 的最大条数
+const drainBatch = 1024
+
+//批量取出最多 n 条数据，一次batch删除，n 必须大于0
+func (q *Queue) DequeueBatch(n int) ([]QueueItem, error) {
+	if n <= 0 {
+		return nil, errors.New("n must be > 0")
+	}
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	if err := q.promote(); err != nil {
+		return nil, err
+	}
+	if q.tail-q.head == 0 {
+		return nil, ErrEmpty
+	}
+	items, err := readItems(q.db, q.iteratorOpts, IdToKeyPure(q.head+1), IdToKeyPure(q.tail+1), n, KeyToIDPure)
+	if err != nil {
+		return nil, err
+	}
+	batch := new(leveldb.Batch)
+	for _, item := range items {
+		batch.Delete(item.Key)
+	}
+	if err := q.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	q.head += uint64(len(items))
+	var size uint64
+	for _, item := range items {
+		size += uint64(len(item.Value))
+	}
+	q.shrank(uint64(len(items)), size)
+	return items, nil
+}
+
+//取出调用时已有的全部数据，每次最多 drainBatch 条交给 fn 处理，fn 返回nil时才删除这一块
+//fn 执行时不持有队列锁，可以调用该队列；fn 返回错误时停止，之前的块已删除
+//与其它消费者并发取出时，同一条数据可能既被 fn 处理又被其它消费者取出
+func (q *Queue) DrainTo(fn func(items []QueueItem) error) error {
+	q.Lock()
+	if !q.isOpen {
+		q.Unlock()
+		return ErrDBClosed
+	}
+	err := q.promote()
+	end := q.tail
+	q.Unlock()
+	if err != nil {
+		return err
+	}
+	for {
+		items, err := q.drainChunk(end)
+		if err != nil || len(items) == 0 {
+			return err
+		}
+		if err := fn(items); err != nil {
+			return err
+		}
+		if err := q.drainCommit(items[len(items)-1].ID); err != nil {
+			return err
+		}
+	}
+}
+
+//读取 head 之后且不超过 end 的一块数据
+func (q *Queue) drainChunk(end uint64) ([]QueueItem, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	if q.head >= end {
+		return nil, nil
+	}
+	if q.tail < end {
+		end = q.tail
+	}
+	return readItems(q.db, q.iteratorOpts, IdToKeyPure(q.head+1), IdToKeyPure(end+1), drainBatch, KeyToIDPure)
+}
+
+//删除 head 到 last 之间的数据，fn 执行期间已被其它消费者取走的部分跳过
+func (q *Queue) drainCommit(last uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if last <= q.head {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	var n, size uint64
+	iter := q.db.NewIterator(&util.Range{Start: IdToKeyPure(q.head + 1), Limit: IdToKeyPure(last + 1)}, q.iteratorOpts)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		n++
+		size += uint64(len(iter.Value()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if err := q.db.Write(batch, nil); err != nil {
+		return err
+	}
+	q.head = last
+	q.shrank(n, size)
+	return nil
+}
+
+//读取 [start, limit) 范围内最多 n 条数据，n<=0 时读取全部
+func readItems(db *leveldb.DB, ro *opt.ReadOptions, start, limit []byte, n int, id func([]byte) uint64) ([]QueueItem, error) {
+	result := make([]QueueItem, 0)
+	iter := db.NewIterator(&util.Range{Start: start, Limit: limit}, ro)
+	defer iter.Release()
+	for (n <= 0 || len(result) < n) && iter.Next() {
+		item := QueueItem{}
+		item.ID = id(iter.Key())
+		item.Key = make([]byte, len(iter.Key()))
+		item.Value = make([]byte, len(iter.Value()))
+		copy(item.Key, iter.Key())
+		copy(item.Value, iter.Value())
+		result = append(result, item)
+	}
+	return result, iter.Error()
 }
 
 func (q *Queue) PeekByID(id uint64) (*QueueItem, error) {
@@ -165,7 +392,18 @@ func (q *Queue) PeekByID(id uint64) (*QueueItem, error) {
 	return q.getItemByID(id)
 }
 
+//值变长时按容量策略处理，OverflowDropOldest 只删除更早的数据，放不下时返回 ErrFull
 func (q *Queue) Update(id uint64, newValue []byte) (*QueueItem, error) {
+	var item *QueueItem
+	err := waitSpace(q.space, "", q.blockTimeout(), func() error {
+		var err error
+		item, err = q.update(id, newValue)
+		return err
+	})
+	return item, err
+}
+
+func (q *Queue) update(id uint64, newValue []byte) (*QueueItem, error) {
 	q.Lock()
 	defer q.Unlock()
 	if !q.isOpen {
@@ -179,10 +417,48 @@ func (q *Queue) Update(id uint64, newValue []byte) (*QueueItem, error) {
 		Key:   IdToKeyPure(id),
 		Value: newValue,
 	}
-	if err := q.db.Put(item.Key, item.Value, nil); err != nil {
+	batch := new(leveldb.Batch)
+	var old []byte
+	var dropped, droppedBytes uint64
+	if q.bound != nil {
+		var err error
+		if old, err = q.db.Get(item.Key, nil); err != nil {
+			return nil, err
+		}
+		if len(newValue) > len(old) {
+			grow := uint64(len(newValue) - len(old))
+			act, err := q.bound.admit(q.tail-q.head, 0, grow, false)
+			if err != nil {
+				return nil, err
+			}
+			switch act {
+			case admitDrop:
+				r := &util.Range{Start: IdToKeyPure(q.head + 1), Limit: IdToKeyPure(id)}
+				if dropped, droppedBytes, err = q.bound.dropOldest(q.db, batch, r, q.tail-q.head, 0, grow); err != nil {
+					return nil, err
+				}
+				if !q.bound.fits(q.tail-q.head-dropped, q.bound.bytes-droppedBytes, 0, grow) {
+					return nil, ErrFull
+				}
+			case admitSpill:
+				return nil, ErrFull
+			}
+		}
+	}
+	batch.Put(item.Key, item.Value)
+	if err := q.db.Write(batch, nil); err != nil {
 		return nil, err
 	}
-
+	q.head += dropped
+	if q.bound != nil {
+		q.bound.bytes -= droppedBytes
+	}
+	//占用按新旧长度差调整
+	if len(newValue) >= len(old) {
+		q.grew(uint64(len(newValue) - len(old)))
+	} else {
+		q.shrank(0, uint64(len(old)-len(newValue)))
+	}
 	return item, nil
 }
 
@@ -201,7 +477,11 @@ func (q *Queue) UpdateObject(id uint64, newValue interface{}) (*QueueItem, error
 func (q *Queue) Length() uint64 {
 	q.RLock()
 	defer q.RUnlock()
-	return q.tail - q.head
+	if !q.isOpen {
+		return q.tail - q.head
+	}
+	values, _ := q.dueValues()
+	return q.tail - q.head + uint64(len(values))
 }
 
 func (q *Queue) Close() {
@@ -214,6 +494,11 @@ func (q *Queue) Close() {
 	q.tail = 0
 	q.db.Close()
 	q.isOpen = false
+	q.waits.close()
+	q.space.close()
+	if q.spill != nil {
+		q.spill.Close()
+	}
 }
 
 func (q *Queue) Drop() {
@@ -238,17 +523,33 @@ func (q *Queue) getItemByID(id uint64) (*QueueItem, error) {
 func (q *Queue) init() error {
 	q.Lock()
 	defer q.Unlock()
-	iter := q.db.NewIterator(nil, q.iteratorOpts)
+	q.lease = loadSeq(q.db, leaseSeq)
+	q.delaySeq = loadSeq(q.db, delaySeqName)
+	if err := sweepDedup(q.db); err != nil {
+		return err
+	}
+	heads, err := dueHeads(q.db, nsDelay)
+	if err != nil {
+		return err
+	}
+	if due, ok := heads[""]; ok {
+		q.waits.notifyAt("", due)
+	}
+	if heads, err = dueHeads(q.db, nsFlightDue); err != nil {
+		return err
+	}
+	q.waits.leaseAt("", heads[""])
+	//0xff 开头为在途及死信等内部数据
+	iter := q.db.NewIterator(&util.Range{Limit: []byte{nsMarker}}, q.iteratorOpts)
 	defer iter.Release()
+	q.tail = loadSeq(q.db, "")
+	if ok := iter.Last(); ok && KeyToIDPure(iter.Key()) > q.tail {
+		q.tail = KeyToIDPure(iter.Key())
+	}
 	if ok := iter.First(); ok {
 		q.head = KeyToIDPure(iter.Key()) - 1
 	} else {
-		q.head = 0
-	}
-	if ok := iter.Last(); ok {
-		q.tail = KeyToIDPure(iter.Key())
-	} else {
-		q.tail = 0
+		q.head = q.tail
 	}
 	return iter.Error()
 }
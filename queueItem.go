@@ -2,8 +2,8 @@ package yiyidb
 
 import (
 	"encoding/binary"
+	"github.com/syndtr/goleveldb/leveldb"
 	"gopkg.in/vmihailenco/msgpack.v2"
-	"bytes"
 	"errors"
 )
 
@@ -17,6 +17,8 @@ var (
 	ErrEmpty       = errors.New("queue is empty")
 	ErrOutOfBounds = errors.New("ID used is outside range of queue")
 	ErrDBClosed    = errors.New("Database is closed")
+	ErrTimeout     = errors.New("wait timeout")
+	ErrFull        = errors.New("queue is full")
 )
 
 type QueueItem struct {
@@ -47,30 +49,43 @@ func KeyToIDPure(key []byte) uint64 {
 func idToKey(chname string, id uint64) []byte {
 	kid := make([]byte, 8)
 	binary.BigEndian.PutUint64(kid, id)
-	return append([]byte(chname+"-"), kid...)
+	return nsKey(nsChan, chname, kid)
+}
+
+//已分配的最大 ID，保证 ID 在取空、重启及 Clear 后不复用
+func seqKey(chname string) []byte {
+	return nsKey(nsSeq, chname, nil)
+}
+
+func loadSeq(db *leveldb.DB, chname string) uint64 {
+	val, err := db.Get(seqKey(chname), nil)
+	if err != nil || len(val) != 8 {
+		return 0
+	}
+	return KeyToIDPure(val)
 }
 
 func idToKeyMix(chname, key string) []byte {
-	return []byte(chname + "-" + key)
+	return nsKey(nsMix, chname, []byte(key))
 }
 
 func keyToIdMix(mixkey []byte) (string, string) {
-	bts := bytes.Split(mixkey,[]byte("-"))
-	return string(bts[0]), string(bts[1])
+	if tag, name, sub, ok := nsSplit(mixkey); ok && tag == nsMix {
+		return name, string(sub)
+	}
+	return "", ""
 }
 
 func keyName(key []byte) string {
-	k := bytes.Split(key, []byte("-"))
-	if len(k) == 2 {
-		return string(k[0])
+	if tag, name, sub, ok := nsSplit(key); ok && tag == nsChan && len(sub) == 8 {
+		return name
 	}
 	return ""
 }
 
 func keyToID(key []byte) uint64 {
-	k := bytes.Split(key, []byte("-"))
-	if len(k) == 2 {
-		return binary.BigEndian.Uint64(k[1])
+	if tag, _, sub, ok := nsSplit(key); ok && tag == nsChan && len(sub) == 8 {
+		return binary.BigEndian.Uint64(sub)
 	}
 	return 0
 }
@@ -7,11 +7,14 @@ import (
 	"github.com/syndtr/goleveldb/leveldb/filter"
 	"errors"
 	"github.com/syndtr/goleveldb/leveldb/util"
-	"bytes"
 	"os"
 	"gopkg.in/vmihailenco/msgpack.v2"
+	"context"
+	"time"
 )
 
+var errChanNotExist = errors.New("ch not ext")
+
 //FIFO
 type ChanQueue struct {
 	sync.RWMutex
@@ -21,12 +24,22 @@ type ChanQueue struct {
 	iteratorOpts *opt.ReadOptions
 	maxkv        int
 	mats         map[string]*mat
+	waits        *waitQueue
+	maxAttempts  int
+	lease        uint64
+	delaySeq     uint64
+	bounds       map[string]*bound
+	spills       map[string]*ChanQueue
+	space        *waitQueue
+	dedupWindow  time.Duration
 }
 
 type mat struct {
 	mixName string
 	head    uint64
 	tail    uint64
+	count   uint64
+	bytes   uint64
 }
 
 func OpenChanQueue(dataDir string, defaultKeyLen int) (*ChanQueue, error) {
@@ -38,6 +51,12 @@ func OpenChanQueue(dataDir string, defaultKeyLen int) (*ChanQueue, error) {
 		mats:         make(map[string]*mat),
 		iteratorOpts: &opt.ReadOptions{DontFillCache: true},
 		maxkv:        512 * MB,
+		waits:        newWaitQueue(),
+		bounds:       make(map[string]*bound),
+		spills:       make(map[string]*ChanQueue),
+		space:        newWaitQueue(),
+		maxAttempts:  defaultMaxAttempts,
+		dedupWindow:  defaultDedupWindow,
 	}
 
 	opts := &opt.Options{}
@@ -62,27 +81,30 @@ func OpenChanQueue(dataDir string, defaultKeyLen int) (*ChanQueue, error) {
 }
 
 func (q *ChanQueue) init() error {
-	iter := q.db.NewIterator(nil, q.iteratorOpts)
-	defer iter.Release()
-	for iter.Next() {
-		mixName := keyName(iter.Key())
-		if _, ok := q.mats[mixName]; !ok {
-			q.mats[mixName] = &mat{mixName: mixName, head: 0, tail: 0}
-		}
+	q.lease = loadSeq(q.db, leaseSeq)
+	q.delaySeq = loadSeq(q.db, delaySeqName)
+	if err := sweepDedup(q.db); err != nil {
+		return err
 	}
-	if len(q.mats) > 0 {
-		for k, v := range q.mats {
-			rg := util.BytesPrefix([]byte(k))
-			iter.Seek(rg.Start)
-			v.head = keyToID(iter.Key())
-			var lastid uint64
-			for ok := iter.Seek(rg.Start); ok && bytes.Compare(iter.Key(), rg.Limit) <= 0; ok = iter.Next() {
-				lastid = keyToID(iter.Key())
-			}
-			v.tail = lastid
-		}
+	heads, err := dueHeads(q.db, nsDelay)
+	if err != nil {
+		return err
+	}
+	for chname, due := range heads {
+		q.waits.notifyAt(chname, due)
+	}
+	if heads, err = dueHeads(q.db, nsFlightDue); err != nil {
+		return err
+	}
+	for chname, due := range heads {
+		q.waits.leaseAt(chname, due)
+	}
+	clean, err := markOpen(q.db)
+	if err != nil {
+		return err
 	}
-	return iter.Error()
+	q.mats, err = loadMats(q.db, q.iteratorOpts, !clean)
+	return err
 }
 
 func (q *ChanQueue) EnqueueObject(chname string, value interface{}) (*QueueItem, error) {
@@ -93,7 +115,18 @@ func (q *ChanQueue) EnqueueObject(chname string, value interface{}) (*QueueItem,
 	return q.Enqueue(chname, msg)
 }
 
+//分组设置了容量限制且写入溢出目录时返回的 ID 为0
 func (q *ChanQueue) Enqueue(chname string, value []byte) (*QueueItem, error) {
+	var item *QueueItem
+	err := waitSpace(q.space, chname, q.blockTimeout(chname), func() error {
+		var err error
+		item, err = q.enqueue(chname, value, "")
+		return err
+	})
+	return item, err
+}
+
+func (q *ChanQueue) enqueue(chname string, value []byte, dedupID string) (*QueueItem, error) {
 	q.Lock()
 	defer q.Unlock()
 	if !q.isOpen {
@@ -102,20 +135,68 @@ func (q *ChanQueue) Enqueue(chname string, value []byte) (*QueueItem, error) {
 	if len(value) > q.maxkv {
 		return nil, errors.New("out of len 512M")
 	}
-	if mt, ok := q.mats[chname]; ok {
-		if err := q.db.Put(idToKey(mt.mixName, mt.tail+1), value, nil); err != nil {
+	if dedupID != "" {
+		item, err := findDedup(q.db, chname, dedupID, func(id uint64) []byte {
+			return idToKey(chname, id)
+		})
+		if item != nil || err != nil {
+			return item, err
+		}
+	}
+	batch := new(leveldb.Batch)
+	base := q.matOf(chname)
+	var droppedBytes uint64
+	b, bounded := q.bounds[chname]
+	if bounded {
+		spill := q.spillOf(chname)
+		pending := false
+		if spill != nil {
+			l, _ := spill.Length(chname)
+			pending = l > 0
+		}
+		act, err := b.admit(q.length(chname), 1, uint64(len(value)), pending)
+		if err != nil {
 			return nil, err
 		}
-		mt.tail++
-		return &QueueItem{ID: mt.tail, Key: idToKey(chname, mt.tail), Value: value}, nil
-	} else {
-		item := &QueueItem{ID: 1, Key: idToKey(chname, 1), Value: value}
-		if err := q.db.Put(item.Key, item.Value, nil); err != nil {
+		switch act {
+		case admitSpill:
+			if _, err := spill.Enqueue(chname, value); err != nil {
+				return nil, err
+			}
+			//溢出写入成功后才记录去重，失败时重试不会被当作重复
+			if dedupID != "" {
+				if err := putDedup(q.db, batch, chname, dedupID, 0, q.dedupWindow); err != nil {
+					return nil, err
+				}
+				if err := q.db.Write(batch, nil); err != nil {
+					return nil, err
+				}
+			}
+			return &QueueItem{Value: value}, nil
+		case admitDrop:
+			r := &util.Range{Start: idToKey(chname, base.head+1), Limit: idToKey(chname, base.tail+1)}
+			var dropped uint64
+			if dropped, droppedBytes, err = b.dropOldest(q.db, batch, r, base.count, 1, uint64(len(value))); err != nil {
+				return nil, err
+			}
+			base = base.popped(dropped, droppedBytes)
+		}
+	}
+	done := q.appendBatch(batch, base, [][]byte{value})
+	if dedupID != "" {
+		if err := putDedup(q.db, batch, chname, dedupID, base.tail+1, q.dedupWindow); err != nil {
 			return nil, err
 		}
-		q.mats[chname] = &mat{mixName: chname, tail: item.ID, head: 0}
-		return item, nil
 	}
+	if err := q.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	if droppedBytes > 0 {
+		b.bytes -= droppedBytes
+	}
+	done()
+	mt := q.mats[chname]
+	return &QueueItem{ID: mt.tail, Key: idToKey(chname, mt.tail), Value: value}, nil
 }
 
 func (q *ChanQueue) Dequeue(chname string) (*QueueItem, error) {
@@ -124,26 +205,54 @@ func (q *ChanQueue) Dequeue(chname string) (*QueueItem, error) {
 	if !q.isOpen {
 		return nil, ErrDBClosed
 	}
+	if err := q.promote(chname); err != nil {
+		return nil, err
+	}
 	if mt, ok := q.mats[chname]; ok {
 		item, err := q.getItemByID(chname, mt.head+1)
 		if err != nil {
 			return nil, err
 		}
-		if err := q.db.Delete(item.Key, nil); err != nil {
+		batch := new(leveldb.Batch)
+		batch.Delete(item.Key)
+		if err := q.writeMat(batch, mt.popped(1, uint64(len(item.Value)))); err != nil {
 			return nil, err
 		}
-		mt.head++
-		//当队列取空后重置游标
-		if mt.head == mt.tail {
-			mt.head = 0
-			mt.tail = 0
-		}
+		q.shrank(chname, 1, uint64(len(item.Value)))
 		return item, nil
 	} else {
-		return nil, errors.New("ch not ext")
+		return nil, errChanNotExist
 	}
 }
 
+//阻塞等待直到分组有数据，ctx 结束返回 ctx.Err()，队列关闭返回 ErrDBClosed
+func (q *ChanQueue) DequeueWait(ctx context.Context, chname string) (*QueueItem, error) {
+	var item *QueueItem
+	err := q.waits.block(ctx, chname, func() error {
+		return q.dequeueWait(chname, &item)
+	})
+	return item, err
+}
+
+//阻塞等待直到分组有数据，超时返回 ErrTimeout，timeout 为0时一直等待
+func (q *ChanQueue) DequeueTimeout(chname string, timeout time.Duration) (*QueueItem, error) {
+	var item *QueueItem
+	err := q.waits.blockTimeout(timeout, chname, func() error {
+		return q.dequeueWait(chname, &item)
+	})
+	return item, err
+}
+
+//分组不存在视为空分组继续等待
+func (q *ChanQueue) dequeueWait(chname string, item **QueueItem) error {
+	var err error
+	*item, err = q.Dequeue(chname)
+	if err == errChanNotExist {
+		return ErrEmpty
+	}
+	return err
+}
+
 func (q *ChanQueue) GetMetal(chname string) (uint64, uint64) {
 	q.RLock()
 	defer q.RUnlock()
@@ -170,6 +279,7 @@ func (q *ChanQueue) GetChans() ([]string, error) {
 	return chans, nil
 }
 
+//包含已到期但未移入的延时消息，不移动数据
 func (q *ChanQueue) Length(chname string) (uint64, error) {
 	q.RLock()
 	defer q.RUnlock()
@@ -179,56 +289,189 @@ func (q *ChanQueue) Length(chname string) (uint64, error) {
 	if len(chname) > q.maxkv {
 		return 0, errors.New("out of len")
 	}
+	values, err := q.dueValues(chname)
+	if err != nil {
+		return 0, err
+	}
 	if mt, ok := q.mats[chname]; ok {
-		return mt.tail - mt.head, nil
+		return mt.tail - mt.head + uint64(len(values)), nil
+	} else if len(values) > 0 {
+		return uint64(len(values)), nil
 	} else {
 		return 0, errors.New("ch not ext")
 	}
 }
 
 func (q *ChanQueue) Clear(chname string) error {
-	q.RLock()
-	defer q.RUnlock()
+	q.Lock()
+	defer q.Unlock()
 	if !q.isOpen {
 		return ErrDBClosed
 	}
 	if len(chname) > q.maxkv {
 		return errors.New("out of len")
 	}
-	if mt, ok := q.mats[chname]; ok {
-		mt.head = 0
-		mt.tail = 0
-	} else {
+	mt, ok := q.mats[chname]
+	if !ok {
 		return errors.New("ch not ext")
 	}
+	cleared, size := mt.count, mt.bytes
 	batch := new(leveldb.Batch)
-	iter := q.db.NewIterator(util.BytesPrefix([]byte(chname+"-")), q.iteratorOpts)
+	iter := q.db.NewIterator(util.BytesPrefix(nsPrefix(nsChan, chname)), q.iteratorOpts)
 	for iter.Next() {
 		batch.Delete(iter.Key())
 	}
 	iter.Release()
-	err := q.db.Write(batch, nil)
-	if err != nil {
+	//同时清除未到期的延时消息
+	iter = q.db.NewIterator(util.BytesPrefix(nsPrefix(nsDelay, chname)), q.iteratorOpts)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	if err := q.writeMat(batch, mt.popped(cleared, size)); err != nil {
 		return err
 	}
+	q.shrank(chname, cleared, size)
 	return nil
 }
 
+//已到期但未移入的延时消息接在分组数据之后返回，ID 为0
 func (q *ChanQueue) Peek(chname string) (*QueueItem, error) {
 	q.RLock()
 	defer q.RUnlock()
 	if !q.isOpen {
 		return nil, ErrDBClosed
 	}
+	items, err := q.peekItems(chname, 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &items[0], nil
+}
+
+//从 offset 开始查看分组最多 n 条数据
+func (q *ChanQueue) PeekRange(chname string, offset uint64, n int) ([]QueueItem, error) {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	return q.peekItems(chname, offset, n)
+}
+
+//批量取出分组最多 n 条数据，一次batch删除，n 必须大于0
+func (q *ChanQueue) DequeueBatch(chname string, n int) ([]QueueItem, error) {
+	if n <= 0 {
+		return nil, errors.New("n must be > 0")
+	}
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	if err := q.promote(chname); err != nil {
+		return nil, err
+	}
+	mt, ok := q.mats[chname]
+	if !ok {
+		return nil, errChanNotExist
+	}
+	if mt.count == 0 {
+		return nil, ErrEmpty
+	}
+	items, err := readItems(q.db, q.iteratorOpts, idToKey(chname, mt.head+1), idToKey(chname, mt.tail+1), n, keyToID)
+	if err != nil {
+		return nil, err
+	}
+	batch := new(leveldb.Batch)
+	var size uint64
+	for _, item := range items {
+		batch.Delete(item.Key)
+		size += uint64(len(item.Value))
+	}
+	if err := q.writeMat(batch, mt.popped(uint64(len(items)), size)); err != nil {
+		return nil, err
+	}
+	q.shrank(chname, uint64(len(items)), size)
+	return items, nil
+}
+
+//取出分组调用时已有的全部数据，每次最多 drainBatch 条交给 fn 处理，fn 返回nil时才删除这一块
+//fn 执行时不持有队列锁，可以调用该队列；fn 返回错误时停止，之前的块已删除
+func (q *ChanQueue) DrainTo(chname string, fn func(items []QueueItem) error) error {
+	q.Lock()
+	if !q.isOpen {
+		q.Unlock()
+		return ErrDBClosed
+	}
+	err := q.promote(chname)
+	var end uint64
 	if mt, ok := q.mats[chname]; ok {
-		item, err := q.getItemByID(chname, mt.head+1)
-		if err != nil {
-			return nil, err
+		end = mt.tail
+	}
+	q.Unlock()
+	if err != nil {
+		return err
+	}
+	for {
+		items, err := q.drainChunk(chname, end)
+		if err != nil || len(items) == 0 {
+			return err
 		}
-		return item, nil
-	} else {
-		return nil, errors.New("ch not ext")
+		if err := fn(items); err != nil {
+			return err
+		}
+		if err := q.drainCommit(chname, items[len(items)-1].ID); err != nil {
+			return err
+		}
+	}
+}
+
+func (q *ChanQueue) drainChunk(chname string, end uint64) ([]QueueItem, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	mt, ok := q.mats[chname]
+	if !ok || mt.head >= end {
+		return nil, nil
+	}
+	if mt.tail < end {
+		end = mt.tail
 	}
+	return readItems(q.db, q.iteratorOpts, idToKey(chname, mt.head+1), idToKey(chname, end+1), drainBatch, keyToID)
+}
+
+func (q *ChanQueue) drainCommit(chname string, last uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	mt, ok := q.mats[chname]
+	if !ok || last <= mt.head {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	var n, size uint64
+	iter := q.db.NewIterator(&util.Range{Start: idToKey(chname, mt.head+1), Limit: idToKey(chname, last+1)}, q.iteratorOpts)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		n++
+		size += uint64(len(iter.Value()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	next := mt.popped(n, size)
+	next.head = last
+	if err := q.writeMat(batch, next); err != nil {
+		return err
+	}
+	q.shrank(chname, n, size)
+	return nil
 }
 
 func (q *ChanQueue) PeekStart(chname string) ([]QueueItem, error) {
@@ -240,15 +483,13 @@ func (q *ChanQueue) PeekStart(chname string) ([]QueueItem, error) {
 	if len(chname) > q.maxkv {
 		return nil, errors.New("out of len")
 	}
-	if mt, ok := q.mats[chname]; ok {
-		mt.head = 0
-		mt.tail = 0
-	} else {
+	mt, ok := q.mats[chname]
+	if !ok {
 		return nil, errors.New("ch not ext")
 	}
 	batch := new(leveldb.Batch)
 	result := make([]QueueItem, 0)
-	iter := q.db.NewIterator(util.BytesPrefix([]byte(chname+"-")), q.iteratorOpts)
+	iter := q.db.NewIterator(util.BytesPrefix(nsPrefix(nsChan, chname)), q.iteratorOpts)
 	for iter.Next() {
 		item := QueueItem{}
 		item.ID = keyToID(iter.Key())
@@ -260,16 +501,17 @@ func (q *ChanQueue) PeekStart(chname string) ([]QueueItem, error) {
 		batch.Delete(iter.Key())
 	}
 	iter.Release()
-	err := q.db.Write(batch, nil)
-	if err != nil {
+	cleared, size := mt.count, mt.bytes
+	if err := q.writeMat(batch, mt.popped(cleared, size)); err != nil {
 		return nil, err
 	}
+	q.shrank(chname, cleared, size)
 	return result, nil
 }
 
 func (q *ChanQueue) getItemByID(chname string, id uint64) (*QueueItem, error) {
 	hq := q.mats[chname]
-	if hq.tail-hq.head == 0 {
+	if hq.count == 0 {
 		return nil, ErrEmpty
 	} else if id <= hq.head || id > hq.tail {
 		return nil, ErrOutOfBounds
@@ -282,6 +524,51 @@ func (q *ChanQueue) getItemByID(chname string, id uint64) (*QueueItem, error) {
 	return item, nil
 }
 
+//分组当前游标的副本，分组不存在时为空分组
+func (q *ChanQueue) matOf(chname string) mat {
+	if mt, ok := q.mats[chname]; ok {
+		return *mt
+	}
+	return mat{mixName: chname}
+}
+
+func (q *ChanQueue) setMat(next mat) {
+	if mt, ok := q.mats[next.mixName]; ok {
+		*mt = next
+	} else {
+		q.mats[next.mixName] = &next
+	}
+}
+
+//分组元数据并入 batch 一起写入，成功后更新游标
+func (q *ChanQueue) writeMat(batch *leveldb.Batch, next mat) error {
+	batch.Put(chanMetaKey(next.mixName), next.encode())
+	if err := q.db.Write(batch, nil); err != nil {
+		return err
+	}
+	q.setMat(next)
+	return nil
+}
+
+//把数据追加到 base 尾部的写入放入 batch，返回写入成功后更新游标的函数
+func (q *ChanQueue) appendBatch(batch *leveldb.Batch, base mat, values [][]byte) func() {
+	next := base
+	var size uint64
+	for _, v := range values {
+		next.tail++
+		batch.Put(idToKey(next.mixName, next.tail), v)
+		size += uint64(len(v))
+	}
+	next.count += uint64(len(values))
+	next.bytes += size
+	batch.Put(chanMetaKey(next.mixName), next.encode())
+	return func() {
+		q.setMat(next)
+		q.grew(next.mixName, size)
+		q.waits.notify(next.mixName, len(values))
+	}
+}
+
 func (q *ChanQueue) Drop() {
 	q.Close()
 	os.RemoveAll(q.DataDir)
@@ -293,10 +580,16 @@ func (q *ChanQueue) Close() error {
 	if !q.isOpen {
 		return ErrDBClosed
 	}
+	markClosed(q.db)
 	err := q.db.Close()
 	if err != nil{
 		return err
 	}
 	q.isOpen = false
+	q.waits.close()
+	q.space.close()
+	for _, spill := range q.spills {
+		spill.Close()
+	}
 	return nil
 }
@@ -1,6 +1,8 @@
 package yiyidb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"time"
 	"testing"
@@ -95,6 +97,125 @@ func TestChanQueue_Clear(t *testing.T) {
 	//fmt.Println("deq:",deqItem.ID, string(deqItem.Value))
 }
 
+func TestChanQueue_DequeueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	_, err = q.DequeueTimeout("jac", 50*time.Millisecond)
+	assert.Equal(t, err, ErrTimeout)
+
+	got := make(chan *QueueItem)
+	go func() {
+		item, err := q.DequeueWait(context.Background(), "jac")
+		assert.NoError(t, err)
+		got <- item
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.Enqueue("other", []byte("x"))
+	q.Enqueue("jac", []byte("y"))
+	assert.Equal(t, string((<-got).Value), "y")
+
+	errs := make(chan error)
+	go func() {
+		_, err := q.DequeueWait(context.Background(), "jac")
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.Close()
+	assert.Equal(t, <-errs, ErrDBClosed)
+}
+
+func TestChanQueue_DequeueBatch(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 5; i++ {
+		q.Enqueue("jac", []byte("v"+strconv.Itoa(i)))
+		q.Enqueue("other", []byte("o"+strconv.Itoa(i)))
+	}
+
+	items, err := q.PeekRange("jac", 3, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 2)
+	assert.Equal(t, items[0].ToString(), "v4")
+
+	items, err = q.DequeueBatch("jac", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, items[1].ToString(), "v2")
+	l, _ := q.Length("jac")
+	assert.Equal(t, l, uint64(3))
+
+	err = q.DrainTo("jac", func(items []QueueItem) error {
+		return errors.New("sink down")
+	})
+	assert.Error(t, err)
+	assert.NoError(t, q.DrainTo("jac", func(items []QueueItem) error {
+		assert.Equal(t, items[0].ToString(), "v3")
+		assert.Equal(t, len(items), 3)
+		return nil
+	}))
+	_, err = q.Dequeue("jac")
+	assert.Equal(t, err, ErrEmpty)
+	l, _ = q.Length("other")
+	assert.Equal(t, l, uint64(5))
+	assert.NoError(t, q.DrainTo("none", func(items []QueueItem) error {
+		return nil
+	}))
+	_, err = q.DequeueBatch("other", 0)
+	assert.Error(t, err)
+	l, _ = q.Length("other")
+	assert.Equal(t, l, uint64(5))
+
+	//fn 中可以调用队列，处理期间写入的数据不在本次取出范围
+	assert.NoError(t, q.DrainTo("other", func(items []QueueItem) error {
+		assert.Equal(t, len(items), 5)
+		_, err := q.Enqueue("other", []byte("o6"))
+		return err
+	}))
+	l, _ = q.Length("other")
+	assert.Equal(t, l, uint64(1))
+}
+
+func TestChanQueue_MonotonicID(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.Enqueue("jac", []byte("a"))
+	q.Enqueue("jac", []byte("b"))
+	q.Dequeue("jac")
+	q.Dequeue("jac")
+	item, _ := q.Enqueue("jac", []byte("c"))
+	assert.Equal(t, item.ID, uint64(3))
+	assert.NoError(t, q.Clear("jac"))
+	item, _ = q.Enqueue("jac", []byte("d"))
+	assert.Equal(t, item.ID, uint64(4))
+	q.PeekStart("jac")
+
+	//重启后取空的分组从保存的 ID 继续
+	q.Close()
+	q, err = OpenChanQueue(file, 10)
+	assert.NoError(t, err)
+	l, err := q.Length("jac")
+	assert.NoError(t, err)
+	assert.Equal(t, l, uint64(0))
+	item, _ = q.Enqueue("jac", []byte("e"))
+	assert.Equal(t, item.ID, uint64(5))
+	item, _ = q.Enqueue("other", []byte("x"))
+	assert.Equal(t, item.ID, uint64(1))
+}
+
 func BenchmarkQueueChan_Dequeue(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
@@ -0,0 +1,378 @@
+package yiyidb
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//日志模式队列，读取不删除数据，各消费组独立保存已提交的偏移量
+//数据key为8字节ID，value为8字节写入时间 + 数据
+//元数据 nsLog 保存 tail + 总字节数，消费组偏移量保存在 nsGroup + 组名
+type LogQueue struct {
+	sync.RWMutex
+	DataDir      string
+	db           *leveldb.DB
+	head         uint64
+	tail         uint64
+	bytes        uint64
+	groups       map[string]*logGroup
+	opts         LogOptions
+	isOpen       bool
+	iteratorOpts *opt.ReadOptions
+	maxkv        int
+}
+
+//超过任一限制的旧数据即使未被全部消费组读过也会被删除，0表示不限制
+type LogOptions struct {
+	MaxAge   time.Duration
+	MaxBytes uint64
+	MaxCount uint64
+}
+
+type logGroup struct {
+	pos       uint64
+	committed uint64
+}
+
+var ErrGroupNotFound = errors.New("group not found")
+var ErrGroupExists = errors.New("group exists")
+
+//消费组未读的数据已按保留策略删除，读取位置已移到最早保留的数据之前，再次 Read 继续读取
+//丢失的范围为 已提交偏移量+1 到 Offsets 返回的 first-1
+var ErrLogTrimmed = errors.New("unread data trimmed")
+
+func OpenLogQueue(dataDir string, opts *LogOptions) (*LogQueue, error) {
+	var err error
+
+	q := &LogQueue{
+		DataDir:      dataDir,
+		db:           &leveldb.DB{},
+		groups:       make(map[string]*logGroup),
+		isOpen:       false,
+		iteratorOpts: &opt.ReadOptions{DontFillCache: true},
+		maxkv:        512 * MB,
+	}
+	if opts != nil {
+		q.opts = *opts
+	}
+
+	dbopts := &opt.Options{}
+	dbopts.ErrorIfMissing = false
+	dbopts.BlockCacheCapacity = 4 * MB
+	dbopts.Filter = filter.NewBloomFilter(int(12))
+	dbopts.Compression = opt.SnappyCompression
+	dbopts.BlockSize = 4 * KB
+	dbopts.WriteBuffer = 4 * MB
+	dbopts.OpenFilesCacheCapacity = 1 * KB
+	dbopts.CompactionTableSize = 32 * MB
+	dbopts.WriteL0SlowdownTrigger = 16
+	dbopts.WriteL0PauseTrigger = 64
+
+	q.db, err = leveldb.OpenFile(dataDir, dbopts)
+	if err != nil {
+		return nil, err
+	}
+	q.isOpen = true
+	return q, q.init()
+}
+
+func logMeta(tail, bytes uint64) []byte {
+	return append(IdToKeyPure(tail), IdToKeyPure(bytes)...)
+}
+
+func (q *LogQueue) Append(value []byte) (*QueueItem, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	if len(value) > q.maxkv {
+		return nil, errors.New("out of len 512M")
+	}
+	item := &QueueItem{ID: q.tail + 1, Key: IdToKeyPure(q.tail + 1), Value: value}
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, append(IdToKeyPure(uint64(time.Now().UnixNano())), value...))
+	batch.Put(nsMetaKey(nsLog, ""), logMeta(q.tail+1, q.bytes+uint64(len(value))))
+	if err := q.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	q.tail++
+	q.bytes += uint64(len(value))
+	return item, q.trim()
+}
+
+func (q *LogQueue) AppendString(value string) (*QueueItem, error) {
+	return q.Append([]byte(value))
+}
+
+func (q *LogQueue) AppendObject(value interface{}) (*QueueItem, error) {
+	msg, err := msgpack.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return q.Append(msg)
+}
+
+//创建消费组，从最早保留的数据开始读取，创建后即参与保留判断
+func (q *LogQueue) CreateGroup(group string) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if _, ok := q.groups[group]; ok {
+		return ErrGroupExists
+	}
+	_, err := q.group(group)
+	return err
+}
+
+//未创建的消费组在首次 Read、Commit 或 Seek 时自动创建，从最早的数据开始读取
+func (q *LogQueue) group(name string) (*logGroup, error) {
+	if g, ok := q.groups[name]; ok {
+		return g, nil
+	}
+	g := &logGroup{pos: q.head, committed: q.head}
+	if err := q.db.Put(nsKey(nsGroup, name, nil), IdToKeyPure(g.committed), nil); err != nil {
+		return nil, err
+	}
+	q.groups[name] = g
+	return g, nil
+}
+
+//读取消费组之后的最多 n 条数据并前移读取位置，需 Commit 后位置才会持久化
+//未读数据已被删除时返回 ErrLogTrimmed
+func (q *LogQueue) Read(group string, n int) ([]QueueItem, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	g, err := q.group(group)
+	if err != nil {
+		return nil, err
+	}
+	if g.pos < q.head {
+		g.pos = q.head
+		return nil, ErrLogTrimmed
+	}
+	result := make([]QueueItem, 0)
+	iter := q.db.NewIterator(&util.Range{Start: IdToKeyPure(g.pos + 1), Limit: []byte{nsMarker}}, q.iteratorOpts)
+	defer iter.Release()
+	for len(result) < n && iter.Next() {
+		item := QueueItem{ID: KeyToIDPure(iter.Key())}
+		item.Key = make([]byte, len(iter.Key()))
+		item.Value = make([]byte, len(iter.Value())-8)
+		copy(item.Key, iter.Key())
+		copy(item.Value, iter.Value()[8:])
+		result = append(result, item)
+	}
+	if len(result) > 0 {
+		g.pos = result[len(result)-1].ID
+	}
+	return result, iter.Error()
+}
+
+//提交消费组已处理完的最大ID
+func (q *LogQueue) Commit(group string, offset uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if offset > q.tail {
+		return ErrOutOfBounds
+	}
+	g, err := q.group(group)
+	if err != nil {
+		return err
+	}
+	if err := q.db.Put(nsKey(nsGroup, group, nil), IdToKeyPure(offset), nil); err != nil {
+		return err
+	}
+	g.committed = offset
+	if g.pos < offset {
+		g.pos = offset
+	}
+	return q.trim()
+}
+
+//移动消费组位置，下次 Read 从 offset+1 开始，同时作为已提交偏移量保存
+//offset 早于保留的数据时从最早的数据开始
+func (q *LogQueue) Seek(group string, offset uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if offset > q.tail {
+		return ErrOutOfBounds
+	}
+	if offset < q.head {
+		offset = q.head
+	}
+	g, err := q.group(group)
+	if err != nil {
+		return err
+	}
+	if err := q.db.Put(nsKey(nsGroup, group, nil), IdToKeyPure(offset), nil); err != nil {
+		return err
+	}
+	g.pos = offset
+	g.committed = offset
+	return q.trim()
+}
+
+func (q *LogQueue) Committed(group string) (uint64, error) {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return 0, ErrDBClosed
+	}
+	if g, ok := q.groups[group]; ok {
+		return g.committed, nil
+	}
+	return 0, ErrGroupNotFound
+}
+
+//各消费组已提交的偏移量
+func (q *LogQueue) Groups() map[string]uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	result := make(map[string]uint64)
+	for name, g := range q.groups {
+		result[name] = g.committed
+	}
+	return result
+}
+
+func (q *LogQueue) DelGroup(group string) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if _, ok := q.groups[group]; !ok {
+		return ErrGroupNotFound
+	}
+	if err := q.db.Delete(nsKey(nsGroup, group, nil), nil); err != nil {
+		return err
+	}
+	delete(q.groups, group)
+	return q.trim()
+}
+
+//当前保留的数据条数
+func (q *LogQueue) Length() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	return q.tail - q.head
+}
+
+//当前保留的首尾ID，空时 first > last
+func (q *LogQueue) Offsets() (first, last uint64) {
+	q.RLock()
+	defer q.RUnlock()
+	return q.head + 1, q.tail
+}
+
+//按保留策略删除旧数据，写入及提交时会自动调用
+func (q *LogQueue) Trim() error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	return q.trim()
+}
+
+func (q *LogQueue) trim() error {
+	//所有消费组都已提交的位置，没有消费组时不按此删除
+	var done uint64
+	first := true
+	for _, g := range q.groups {
+		if first || g.committed < done {
+			done = g.committed
+			first = false
+		}
+	}
+	var expire uint64
+	if q.opts.MaxAge > 0 {
+		expire = uint64(time.Now().Add(-q.opts.MaxAge).UnixNano())
+	}
+	head, bytes := q.head, q.bytes
+	batch := new(leveldb.Batch)
+	iter := q.db.NewIterator(&util.Range{Start: IdToKeyPure(head + 1), Limit: []byte{nsMarker}}, q.iteratorOpts)
+	for iter.Next() {
+		id := KeyToIDPure(iter.Key())
+		size := uint64(len(iter.Value()) - 8)
+		//大小限制至少保留最新一条
+		if id > done &&
+			KeyToIDPure(iter.Value()[:8]) >= expire &&
+			(id == q.tail || q.opts.MaxBytes == 0 || bytes <= q.opts.MaxBytes) &&
+			(q.opts.MaxCount == 0 || q.tail-head <= q.opts.MaxCount) {
+			break
+		}
+		batch.Delete(iter.Key())
+		head = id
+		bytes -= size
+	}
+	err := iter.Error()
+	iter.Release()
+	if err != nil || batch.Len() == 0 {
+		return err
+	}
+	batch.Put(nsMetaKey(nsLog, ""), logMeta(q.tail, bytes))
+	if err := q.db.Write(batch, nil); err != nil {
+		return err
+	}
+	q.head, q.bytes = head, bytes
+	return nil
+}
+
+func (q *LogQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return
+	}
+	q.db.Close()
+	q.isOpen = false
+}
+
+func (q *LogQueue) Drop() {
+	q.Close()
+	os.RemoveAll(q.DataDir)
+}
+
+func (q *LogQueue) init() error {
+	q.Lock()
+	defer q.Unlock()
+	if meta, err := q.db.Get(nsMetaKey(nsLog, ""), nil); err == nil && len(meta) == 16 {
+		q.tail = KeyToIDPure(meta[:8])
+		q.bytes = KeyToIDPure(meta[8:])
+	}
+	q.head = q.tail
+	iter := q.db.NewIterator(&util.Range{Limit: []byte{nsMarker}}, q.iteratorOpts)
+	if iter.First() {
+		q.head = KeyToIDPure(iter.Key()) - 1
+	}
+	iter.Release()
+	iter = q.db.NewIterator(util.BytesPrefix([]byte{nsMarker, nsGroup}), q.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		if _, name, _, ok := nsSplit(iter.Key()); ok {
+			committed := KeyToIDPure(iter.Value())
+			q.groups[name] = &logGroup{pos: committed, committed: committed}
+		}
+	}
+	return iter.Error()
+}
@@ -0,0 +1,108 @@
+package yiyidb
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func logValues(items []QueueItem) []string {
+	values := make([]string, len(items))
+	for i, item := range items {
+		values[i] = item.ToString()
+	}
+	return values
+}
+
+func TestLogQueue_Groups(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenLogQueue(file, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 1; i <= 5; i++ {
+		q.AppendString("m" + strconv.Itoa(i))
+	}
+
+	//各消费组独立读取，读取不删除数据
+	items, err := q.Read("billing", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, logValues(items), []string{"m1", "m2"})
+	items, _ = q.Read("audit", 10)
+	assert.Equal(t, logValues(items), []string{"m1", "m2", "m3", "m4", "m5"})
+	items, _ = q.Read("billing", 2)
+	assert.Equal(t, logValues(items), []string{"m3", "m4"})
+	assert.Equal(t, q.Length(), uint64(5))
+
+	//未提交的读取位置重启后回到已提交位置
+	assert.NoError(t, q.Commit("billing", 2))
+	assert.NoError(t, q.Commit("audit", 4))
+	assert.Equal(t, q.Commit("audit", 9), ErrOutOfBounds)
+	q.Close()
+	q, err = OpenLogQueue(file, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Groups(), map[string]uint64{"billing": 2, "audit": 4})
+	items, _ = q.Read("billing", 1)
+	assert.Equal(t, logValues(items), []string{"m3"})
+
+	//所有消费组都提交后才删除
+	first, last := q.Offsets()
+	assert.Equal(t, first, uint64(3))
+	assert.Equal(t, last, uint64(5))
+	assert.NoError(t, q.Seek("audit", 0))
+	items, _ = q.Read("audit", 1)
+	assert.Equal(t, logValues(items), []string{"m3"})
+	assert.NoError(t, q.Commit("billing", 5))
+	assert.NoError(t, q.Commit("audit", 5))
+	assert.Equal(t, q.Length(), uint64(0))
+
+	//ID 不因数据清空而复用
+	item, _ := q.AppendString("m6")
+	assert.Equal(t, item.ID, uint64(6))
+	assert.NoError(t, q.DelGroup("audit"))
+	_, err = q.Committed("audit")
+	assert.Equal(t, err, ErrGroupNotFound)
+	items, _ = q.Read("fresh", 10)
+	assert.Equal(t, logValues(items), []string{"m6"})
+}
+
+func TestLogQueue_Retention(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenLogQueue(file, &LogOptions{MaxCount: 3, MaxBytes: 8})
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	assert.NoError(t, q.CreateGroup("slow"))
+	assert.Equal(t, q.CreateGroup("slow"), ErrGroupExists)
+	c, err := q.Committed("slow")
+	assert.NoError(t, err)
+	assert.Equal(t, c, uint64(0))
+	for i := 1; i <= 5; i++ {
+		q.AppendString("v" + strconv.Itoa(i))
+	}
+	//超过条数限制，未读数据也被删除，读取时先返回 ErrLogTrimmed
+	assert.Equal(t, q.Length(), uint64(3))
+	q.AppendString("long-value")
+	first, last := q.Offsets()
+	assert.Equal(t, first, uint64(6))
+	assert.Equal(t, last, uint64(6))
+	_, err = q.Read("slow", 10)
+	assert.Equal(t, err, ErrLogTrimmed)
+	items, err := q.Read("slow", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, logValues(items), []string{"long-value"})
+
+	q.Close()
+	q, err = OpenLogQueue(file, &LogOptions{MaxAge: 50 * time.Millisecond})
+	assert.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, q.Trim())
+	assert.Equal(t, q.Length(), uint64(0))
+}
@@ -0,0 +1,287 @@
+package yiyidb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//优先级队列，优先级高的先出，同优先级FIFO
+//key为 0 + (255-优先级) + 8字节序号，各优先级独立维护游标，首字节固定为0避免与 0xff 开头的元数据重叠
+type PriorityQueue struct {
+	sync.RWMutex
+	DataDir      string
+	db           *leveldb.DB
+	levels       [256]prioLevel
+	isOpen       bool
+	iteratorOpts *opt.ReadOptions
+	maxkv        int
+	waits        *waitQueue
+}
+
+type prioLevel struct {
+	head uint64
+	tail uint64
+}
+
+type PriorityItem struct {
+	QueueItem
+	Priority uint8
+}
+
+func OpenPriorityQueue(dataDir string) (*PriorityQueue, error) {
+	var err error
+
+	q := &PriorityQueue{
+		DataDir:      dataDir,
+		db:           &leveldb.DB{},
+		isOpen:       false,
+		iteratorOpts: &opt.ReadOptions{DontFillCache: true},
+		maxkv:        512 * MB,
+		waits:        newWaitQueue(),
+	}
+
+	opts := &opt.Options{}
+	opts.ErrorIfMissing = false
+	opts.BlockCacheCapacity = 4 * MB
+	//key固定10个byte
+	opts.Filter = filter.NewBloomFilter(int(13))
+	opts.Compression = opt.SnappyCompression
+	opts.BlockSize = 4 * KB
+	opts.WriteBuffer = 4 * MB
+	opts.OpenFilesCacheCapacity = 1 * KB
+	opts.CompactionTableSize = 32 * MB
+	opts.WriteL0SlowdownTrigger = 16
+	opts.WriteL0PauseTrigger = 64
+
+	q.db, err = leveldb.OpenFile(dataDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	q.isOpen = true
+	return q, q.init()
+}
+
+func prioKey(priority uint8, id uint64) []byte {
+	key := make([]byte, 10)
+	key[1] = 255 - priority
+	copy(key[2:], IdToKeyPure(id))
+	return key
+}
+
+//各优先级已分配的最大序号，保证取空及重启后 ID 不复用
+func prioSeqKey(priority uint8) []byte {
+	return nsKey(nsSeq, "", []byte{priority})
+}
+
+func (q *PriorityQueue) Enqueue(priority uint8, value []byte) (*PriorityItem, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	if len(value) > q.maxkv {
+		return nil, errors.New("out of len 512M")
+	}
+	lv := &q.levels[priority]
+	item := &PriorityItem{QueueItem: QueueItem{ID: lv.tail + 1, Key: prioKey(priority, lv.tail+1), Value: value}, Priority: priority}
+	batch := new(leveldb.Batch)
+	batch.Put(item.Key, item.Value)
+	batch.Put(prioSeqKey(priority), IdToKeyPure(item.ID))
+	if err := q.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	lv.tail++
+	q.waits.notify("", 1)
+	return item, nil
+}
+
+func (q *PriorityQueue) EnqueueString(priority uint8, value string) (*PriorityItem, error) {
+	return q.Enqueue(priority, []byte(value))
+}
+
+func (q *PriorityQueue) EnqueueObject(priority uint8, value interface{}) (*PriorityItem, error) {
+	msg, err := msgpack.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return q.Enqueue(priority, msg)
+}
+
+//取出优先级最高的数据
+func (q *PriorityQueue) Dequeue() (*PriorityItem, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	priority, ok := q.top()
+	if !ok {
+		return nil, ErrEmpty
+	}
+	lv := &q.levels[priority]
+	item, err := q.getItemByID(priority, lv.head+1)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.db.Delete(item.Key, nil); err != nil {
+		return nil, err
+	}
+	lv.head++
+	return item, nil
+}
+
+//阻塞等待直到取得数据，ctx 结束返回 ctx.Err()，队列关闭返回 ErrDBClosed
+func (q *PriorityQueue) DequeueWait(ctx context.Context) (*PriorityItem, error) {
+	var item *PriorityItem
+	err := q.waits.block(ctx, "", func() error {
+		var err error
+		item, err = q.Dequeue()
+		return err
+	})
+	return item, err
+}
+
+//阻塞等待直到取得数据，超时返回 ErrTimeout，timeout 为0时一直等待
+func (q *PriorityQueue) DequeueTimeout(timeout time.Duration) (*PriorityItem, error) {
+	var item *PriorityItem
+	err := q.waits.blockTimeout(timeout, "", func() error {
+		var err error
+		item, err = q.Dequeue()
+		return err
+	})
+	return item, err
+}
+
+func (q *PriorityQueue) Peek() (*PriorityItem, error) {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	priority, ok := q.top()
+	if !ok {
+		return nil, ErrEmpty
+	}
+	return q.getItemByID(priority, q.levels[priority].head+1)
+}
+
+//查看指定优先级的队首数据
+func (q *PriorityQueue) PeekPriority(priority uint8) (*PriorityItem, error) {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	return q.getItemByID(priority, q.levels[priority].head+1)
+}
+
+func (q *PriorityQueue) Length() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	var n uint64
+	for _, lv := range q.levels {
+		n += lv.tail - lv.head
+	}
+	return n
+}
+
+func (q *PriorityQueue) LengthPriority(priority uint8) uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	return q.levels[priority].tail - q.levels[priority].head
+}
+
+//各优先级的数据量，只包含非空优先级
+func (q *PriorityQueue) Lengths() map[uint8]uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	result := make(map[uint8]uint64)
+	for i, lv := range q.levels {
+		if lv.tail > lv.head {
+			result[uint8(i)] = lv.tail - lv.head
+		}
+	}
+	return result
+}
+
+func (q *PriorityQueue) Close() {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return
+	}
+	q.levels = [256]prioLevel{}
+	q.db.Close()
+	q.isOpen = false
+	q.waits.close()
+}
+
+func (q *PriorityQueue) Drop() {
+	q.Close()
+	os.RemoveAll(q.DataDir)
+}
+
+//最高的非空优先级
+func (q *PriorityQueue) top() (uint8, bool) {
+	for i := 255; i >= 0; i-- {
+		if q.levels[i].tail > q.levels[i].head {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+func (q *PriorityQueue) getItemByID(priority uint8, id uint64) (*PriorityItem, error) {
+	lv := q.levels[priority]
+	if lv.tail-lv.head == 0 {
+		return nil, ErrEmpty
+	} else if id <= lv.head || id > lv.tail {
+		return nil, ErrOutOfBounds
+	}
+	var err error
+	item := &PriorityItem{QueueItem: QueueItem{ID: id, Key: prioKey(priority, id)}, Priority: priority}
+	if item.Value, err = q.db.Get(item.Key, nil); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+//每个优先级只需定位首尾key，tail 取保存的序号与最后一个key的较大值
+func (q *PriorityQueue) init() error {
+	q.Lock()
+	defer q.Unlock()
+	iter := q.db.NewIterator(nil, q.iteratorOpts)
+	defer iter.Release()
+	for i := 0; i < 256; i++ {
+		priority := uint8(i)
+		lv := &q.levels[priority]
+		if seq, err := q.db.Get(prioSeqKey(priority), nil); err == nil && len(seq) == 8 {
+			lv.tail = KeyToIDPure(seq)
+		}
+		lv.head = lv.tail
+		r := util.BytesPrefix([]byte{0, 255 - priority})
+		if !iter.Seek(r.Start) || len(iter.Key()) != 10 || !bytes.HasPrefix(iter.Key(), r.Start) {
+			continue
+		}
+		lv.head = KeyToIDPure(iter.Key()[2:]) - 1
+		if iter.Seek(r.Limit) {
+			iter.Prev()
+		} else {
+			iter.Last()
+		}
+		if id := KeyToIDPure(iter.Key()[2:]); id > lv.tail {
+			lv.tail = id
+		}
+	}
+	return iter.Error()
+}
@@ -0,0 +1,106 @@
+package yiyidb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenPriorityQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	_, err = q.Dequeue()
+	assert.Equal(t, err, ErrEmpty)
+
+	q.EnqueueString(1, "bulk-1")
+	q.EnqueueString(1, "bulk-2")
+	q.EnqueueString(200, "ctrl-1")
+	q.EnqueueString(0, "idle")
+	q.EnqueueString(255, "urgent")
+	q.EnqueueString(200, "ctrl-2")
+	assert.Equal(t, q.Length(), uint64(6))
+	assert.Equal(t, q.LengthPriority(200), uint64(2))
+	assert.Equal(t, q.Lengths(), map[uint8]uint64{0: 1, 1: 2, 200: 2, 255: 1})
+
+	item, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "urgent")
+	item, err = q.PeekPriority(1)
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "bulk-1")
+	_, err = q.PeekPriority(2)
+	assert.Equal(t, err, ErrEmpty)
+
+	item, _ = q.Dequeue()
+	assert.Equal(t, item.ToString(), "urgent")
+	assert.Equal(t, item.Priority, uint8(255))
+	item, _ = q.Dequeue()
+	assert.Equal(t, item.ToString(), "ctrl-1")
+
+	//重启后各优先级游标恢复
+	q.Close()
+	q, err = OpenPriorityQueue(file)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Length(), uint64(4))
+	//优先级0的数据key不与 0xff 开头的序号key重叠
+	assert.Equal(t, q.LengthPriority(0), uint64(1))
+	q.EnqueueString(200, "ctrl-3")
+	order := []string{"ctrl-2", "ctrl-3", "bulk-1", "bulk-2", "idle"}
+	for _, v := range order {
+		item, err = q.Dequeue()
+		assert.NoError(t, err)
+		assert.Equal(t, item.ToString(), v)
+	}
+	assert.Equal(t, q.Length(), uint64(0))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.EnqueueString(7, "late")
+	}()
+	item, err = q.DequeueTimeout(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, item.ToString(), "late")
+}
+
+func TestPriorityQueue_MonotonicID(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenPriorityQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.EnqueueString(5, "a")
+	q.EnqueueString(0, "b")
+	q.Dequeue()
+	q.Dequeue()
+	//取空后 ID 不复用
+	item, _ := q.EnqueueString(5, "c")
+	assert.Equal(t, item.ID, uint64(2))
+	q.Dequeue()
+
+	//重启后 ID 不复用
+	q.Close()
+	q, err = OpenPriorityQueue(file)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Length(), uint64(0))
+	item, _ = q.EnqueueString(5, "d")
+	assert.Equal(t, item.ID, uint64(3))
+	item, _ = q.EnqueueString(0, "e")
+	assert.Equal(t, item.ID, uint64(2))
+	q.Close()
+	q, err = OpenPriorityQueue(file)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Lengths(), map[uint8]uint64{0: 1, 5: 1})
+	item, _ = q.Dequeue()
+	assert.Equal(t, item.ToString(), "d")
+	item, _ = q.Dequeue()
+	assert.Equal(t, item.ToString(), "e")
+}
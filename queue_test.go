@@ -1,6 +1,8 @@
 package yiyidb
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"fmt"
 	"time"
@@ -402,6 +404,178 @@ func TestQueue_EnqueueBat(t *testing.T) {
 	q.Drop()
 }
 
+func TestQueueDequeueWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	_, err = q.DequeueTimeout(50 * time.Millisecond)
+	assert.Equal(t, err, ErrTimeout)
+
+	//按等待先后顺序唤醒
+	got := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			item, err := q.DequeueWait(context.Background())
+			assert.NoError(t, err)
+			got <- strconv.Itoa(i) + string(item.Value)
+		}(i)
+		time.Sleep(20 * time.Millisecond)
+	}
+	q.EnqueueString("a")
+	assert.Equal(t, <-got, "0a")
+	q.EnqueueString("b")
+	assert.Equal(t, <-got, "1b")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = q.DequeueWait(ctx)
+	assert.Equal(t, err, context.DeadlineExceeded)
+
+	errs := make(chan error)
+	go func() {
+		_, err := q.DequeueTimeout(0)
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.Close()
+	assert.Equal(t, <-errs, ErrDBClosed)
+}
+
+func TestQueueDequeueBatch(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	_, err = q.DequeueBatch(3)
+	assert.Equal(t, err, ErrEmpty)
+	for i := 1; i <= 10; i++ {
+		q.EnqueueString("v" + strconv.Itoa(i))
+	}
+
+	items, err := q.PeekRange(2, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 3)
+	assert.Equal(t, items[0].ToString(), "v3")
+	assert.Equal(t, items[2].ID, uint64(5))
+	_, err = q.PeekRange(10, 3)
+	assert.Equal(t, err, ErrOutOfBounds)
+
+	items, err = q.DequeueBatch(4)
+	assert.NoError(t, err)
+	assert.Equal(t, len(items), 4)
+	assert.Equal(t, items[3].ToString(), "v4")
+	assert.Equal(t, q.Length(), uint64(6))
+
+	//处理失败时不删除
+	err = q.DrainTo(func(items []QueueItem) error {
+		assert.Equal(t, len(items), 6)
+		return errors.New("sink down")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, q.Length(), uint64(6))
+
+	var drained []QueueItem
+	assert.NoError(t, q.DrainTo(func(items []QueueItem) error {
+		drained = items
+		return nil
+	}))
+	assert.Equal(t, len(drained), 6)
+	assert.Equal(t, drained[0].ToString(), "v5")
+	assert.Equal(t, q.Length(), uint64(0))
+	assert.NoError(t, q.DrainTo(func(items []QueueItem) error {
+		t.Error("drain on empty queue")
+		return nil
+	}))
+
+	//n<=0 时不取出任何数据
+	q.EnqueueString("keep")
+	_, err = q.DequeueBatch(0)
+	assert.Error(t, err)
+	_, err = q.DequeueBatch(-1)
+	assert.Error(t, err)
+	assert.Equal(t, q.Length(), uint64(1))
+}
+
+func TestQueueDrainToChunk(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	for i := 0; i < drainBatch+10; i++ {
+		q.EnqueueString("v" + strconv.Itoa(i))
+	}
+	//分块处理，fn 中可以调用队列，处理期间写入的数据不在本次取出范围
+	var sizes []int
+	assert.NoError(t, q.DrainTo(func(items []QueueItem) error {
+		sizes = append(sizes, len(items))
+		q.Length()
+		_, err := q.EnqueueString("new")
+		return err
+	}))
+	assert.Equal(t, sizes, []int{drainBatch, 10})
+	assert.Equal(t, q.Length(), uint64(2))
+
+	//fn 失败时之前的块已删除，当前块保留
+	for i := 0; i < drainBatch; i++ {
+		q.EnqueueString("w")
+	}
+	calls := 0
+	err = q.DrainTo(func(items []QueueItem) error {
+		calls++
+		if calls == 2 {
+			return errors.New("sink down")
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, q.Length(), uint64(2))
+}
+
+func TestQueueMonotonicID(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.EnqueueString("a")
+	q.EnqueueString("b")
+	q.Dequeue()
+	q.Dequeue()
+	item, err := q.EnqueueString("c")
+	assert.NoError(t, err)
+	assert.Equal(t, item.ID, uint64(3))
+	q.Dequeue()
+
+	//取空后重启不复用 ID
+	q.Close()
+	q, err = OpenQueue(file)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Length(), uint64(0))
+	item, _ = q.EnqueueString("d")
+	assert.Equal(t, item.ID, uint64(4))
+	q.EnqueueBatch([][]byte{[]byte("e"), []byte("f")})
+	q.Close()
+	q, err = OpenQueue(file)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Length(), uint64(3))
+	item, _ = q.Peek()
+	assert.Equal(t, item.ID, uint64(4))
+	item, _ = q.EnqueueString("g")
+	assert.Equal(t, item.ID, uint64(7))
+}
+
 func BenchmarkQueueEnqueue(b *testing.B) {
 	// Open test database
 	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
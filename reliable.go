@@ -0,0 +1,468 @@
+package yiyidb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//可靠消费: Receive 取出的消息移入在途区 f+租约号，到期索引 F+到期时间+租约号
+//Ack 前消息不可见，Nack 或租约到期后重新投递，投递次数达到上限后转入死信 D+死信编号
+const defaultMaxAttempts = 5
+
+var ErrLeaseNotFound = errors.New("lease not found")
+
+type Delivery struct {
+	QueueItem
+	Lease    uint64
+	Attempts int
+	Deadline time.Time
+}
+
+type flightRecord struct {
+	ID       uint64
+	Value    []byte
+	Attempts int
+	Deadline int64
+}
+
+func flightKey(name string, lease uint64) []byte {
+	return nsKey(nsFlight, name, IdToKeyPure(lease))
+}
+
+func flightDueKey(name string, deadline int64, lease uint64) []byte {
+	return nsKey(nsFlightDue, name, append(IdToKeyPure(uint64(deadline)), IdToKeyPure(lease)...))
+}
+
+//最大租约号保存在 seqKey(leaseSeq)，与分配租约的写入在同一batch中，重启后防止时钟回拨导致重复
+const leaseSeq = "lease"
+
+//分配租约号并把最大值写入 batch
+func nextLease(batch *leveldb.Batch, last *uint64) uint64 {
+	lease := nextSeq(last)
+	batch.Put(seqKey(leaseSeq), IdToKeyPure(lease))
+	return lease
+}
+
+//以当前时间为基准的单调递增序号
+func nextSeq(last *uint64) uint64 {
+	seq := uint64(time.Now().UnixNano())
+	if seq <= *last {
+		seq = *last + 1
+	}
+	*last = seq
+	return seq
+}
+
+func getFlight(db *leveldb.DB, name string, lease uint64) (*flightRecord, error) {
+	data, err := db.Get(flightKey(name, lease), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrLeaseNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := &flightRecord{}
+	return rec, msgpack.Unmarshal(data, rec)
+}
+
+func putFlight(batch *leveldb.Batch, name string, lease uint64, rec *flightRecord) error {
+	data, err := msgpack.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	batch.Put(flightKey(name, lease), data)
+	batch.Put(flightDueKey(name, rec.Deadline, lease), nil)
+	return nil
+}
+
+func delFlight(batch *leveldb.Batch, name string, lease uint64, rec *flightRecord) {
+	batch.Delete(flightKey(name, lease))
+	batch.Delete(flightDueKey(name, rec.Deadline, lease))
+}
+
+//最早到期且已到期的在途消息
+func expiredFlight(db *leveldb.DB, name string, now time.Time) (uint64, *flightRecord, bool) {
+	iter := db.NewIterator(util.BytesPrefix(nsPrefix(nsFlightDue, name)), nil)
+	defer iter.Release()
+	if !iter.First() {
+		return 0, nil, false
+	}
+	_, _, sub, ok := nsSplit(iter.Key())
+	if !ok || len(sub) != 16 || int64(KeyToIDPure(sub[:8])) > now.UnixNano() {
+		return 0, nil, false
+	}
+	lease := KeyToIDPure(sub[8:])
+	rec, err := getFlight(db, name, lease)
+	if err != nil {
+		return 0, nil, false
+	}
+	return lease, rec, true
+}
+
+func flightCount(db *leveldb.DB, name string) uint64 {
+	var n uint64
+	iter := db.NewIterator(util.BytesPrefix(nsPrefix(nsFlight, name)), nil)
+	for iter.Next() {
+		n++
+	}
+	iter.Release()
+	return n
+}
+
+//最早到期的在途消息的到期时间，没有时为0
+func firstFlightDue(db *leveldb.DB, name string) int64 {
+	iter := db.NewIterator(util.BytesPrefix(nsPrefix(nsFlightDue, name)), nil)
+	defer iter.Release()
+	if !iter.First() {
+		return 0
+	}
+	_, _, sub, ok := nsSplit(iter.Key())
+	if !ok || len(sub) != 16 {
+		return 0
+	}
+	return int64(KeyToIDPure(sub[:8]))
+}
+
+//死信放在保留的 nsDead 空间，不会与用户分组冲突
+func putDead(batch *leveldb.Batch, name string, last *uint64, rec *flightRecord) {
+	data, _ := msgpack.Marshal(rec)
+	batch.Put(nsKey(nsDead, name, IdToKeyPure(nextLease(batch, last))), data)
+}
+
+//死信列表，Lease 为死信编号
+func deadLetters(db *leveldb.DB, ro *opt.ReadOptions, name string, key func(id uint64) []byte) ([]*Delivery, error) {
+	result := make([]*Delivery, 0)
+	p := nsPrefix(nsDead, name)
+	iter := db.NewIterator(util.BytesPrefix(p), ro)
+	defer iter.Release()
+	for iter.Next() {
+		rec := &flightRecord{}
+		if err := msgpack.Unmarshal(iter.Value(), rec); err != nil {
+			return result, err
+		}
+		result = append(result, newDelivery(key(rec.ID), KeyToIDPure(iter.Key()[len(p):]), rec))
+	}
+	return result, iter.Error()
+}
+
+func newDelivery(key []byte, lease uint64, rec *flightRecord) *Delivery {
+	return &Delivery{
+		QueueItem: QueueItem{ID: rec.ID, Key: key, Value: rec.Value},
+		Lease:     lease,
+		Attempts:  rec.Attempts,
+		Deadline:  time.Unix(0, rec.Deadline),
+	}
+}
+
+//把已到期的在途消息重新投递，超过次数上限的交给 dead 处理，无可投递消息时返回nil
+func redeliver(db *leveldb.DB, name string, visibility time.Duration, maxAttempts int, last *uint64) (uint64, *flightRecord, error) {
+	now := time.Now()
+	for {
+		lease, rec, ok := expiredFlight(db, name, now)
+		if !ok {
+			return 0, nil, nil
+		}
+		batch := new(leveldb.Batch)
+		delFlight(batch, name, lease, rec)
+		if maxAttempts > 0 && rec.Attempts >= maxAttempts {
+			putDead(batch, name, last, rec)
+			if err := db.Write(batch, nil); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		lease = nextLease(batch, last)
+		rec.Attempts++
+		rec.Deadline = now.Add(visibility).UnixNano()
+		if err := putFlight(batch, name, lease, rec); err != nil {
+			return 0, nil, err
+		}
+		return lease, rec, db.Write(batch, nil)
+	}
+}
+
+func ackFlight(db *leveldb.DB, name string, lease uint64) error {
+	rec, err := getFlight(db, name, lease)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	delFlight(batch, name, lease, rec)
+	return db.Write(batch, nil)
+}
+
+//立即到期，下次 Receive 时重新投递
+func nackFlight(db *leveldb.DB, name string, lease uint64) error {
+	rec, err := getFlight(db, name, lease)
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	delFlight(batch, name, lease, rec)
+	rec.Deadline = time.Now().UnixNano()
+	if err := putFlight(batch, name, lease, rec); err != nil {
+		return err
+	}
+	return db.Write(batch, nil)
+}
+
+//设置投递次数上限，<=0 表示不转入死信
+func (q *Queue) SetMaxAttempts(n int) {
+	q.Lock()
+	defer q.Unlock()
+	q.maxAttempts = n
+}
+
+//取出一条消息并在 visibility 内对其它消费者不可见，需 Ack 确认
+func (q *Queue) Receive(visibility time.Duration) (*Delivery, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	d, err := q.receive(visibility)
+	//租约到期时唤醒 ReceiveWait
+	q.waits.leaseAt("", firstFlightDue(q.db, ""))
+	return d, err
+}
+
+//阻塞等待直到取得消息，ctx 结束返回 ctx.Err()，队列关闭返回 ErrDBClosed
+func (q *Queue) ReceiveWait(ctx context.Context, visibility time.Duration) (*Delivery, error) {
+	var d *Delivery
+	err := q.waits.block(ctx, "", func() error {
+		var err error
+		d, err = q.Receive(visibility)
+		return err
+	})
+	return d, err
+}
+
+//阻塞等待直到取得消息，超时返回 ErrTimeout，timeout 为0时一直等待
+func (q *Queue) ReceiveTimeout(timeout, visibility time.Duration) (*Delivery, error) {
+	var d *Delivery
+	err := q.waits.blockTimeout(timeout, "", func() error {
+		var err error
+		d, err = q.Receive(visibility)
+		return err
+	})
+	return d, err
+}
+
+func (q *Queue) receive(visibility time.Duration) (*Delivery, error) {
+	if err := q.promote(); err != nil {
+		return nil, err
+	}
+	lease, rec, err := redeliver(q.db, "", visibility, q.maxAttempts, &q.lease)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		return newDelivery(IdToKeyPure(rec.ID), lease, rec), nil
+	}
+	item, err := q.getItemByID(q.head + 1)
+	if err != nil {
+		return nil, err
+	}
+	batch := new(leveldb.Batch)
+	lease = nextLease(batch, &q.lease)
+	rec = &flightRecord{ID: item.ID, Value: item.Value, Attempts: 1, Deadline: time.Now().Add(visibility).UnixNano()}
+	batch.Delete(item.Key)
+	if err := putFlight(batch, "", lease, rec); err != nil {
+		return nil, err
+	}
+	if err := q.db.Write(batch, nil); err != nil {
+		return nil, err
+	}
+	q.head++
+	q.shrank(1, uint64(len(item.Value)))
+	return newDelivery(item.Key, lease, rec), nil
+}
+
+//确认消费完成，租约已到期并被重新投递时返回 ErrLeaseNotFound
+func (q *Queue) Ack(d *Delivery) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	return ackFlight(q.db, "", d.Lease)
+}
+
+//放弃本次投递，消息立即可被重新取出
+func (q *Queue) Nack(d *Delivery) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if err := nackFlight(q.db, "", d.Lease); err != nil {
+		return err
+	}
+	//DequeueWait 的等待者取不到在途消息，唤醒全部等待者
+	q.waits.notifyAll("")
+	return nil
+}
+
+//在途消息数
+func (q *Queue) InFlight() uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return 0
+	}
+	return flightCount(q.db, "")
+}
+
+//死信列表，Lease 为死信编号
+func (q *Queue) DeadLetters() ([]*Delivery, error) {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	return deadLetters(q.db, q.iteratorOpts, "", IdToKeyPure)
+}
+
+func (q *Queue) DelDeadLetter(lease uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	return q.db.Delete(nsKey(nsDead, "", IdToKeyPure(lease)), nil)
+}
+
+func (q *ChanQueue) SetMaxAttempts(n int) {
+	q.Lock()
+	defer q.Unlock()
+	q.maxAttempts = n
+}
+
+//取出分组的一条消息并在 visibility 内对其它消费者不可见，需 Ack 确认
+func (q *ChanQueue) Receive(chname string, visibility time.Duration) (*Delivery, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	d, err := q.receive(chname, visibility)
+	q.waits.leaseAt(chname, firstFlightDue(q.db, chname))
+	return d, err
+}
+
+//阻塞等待直到取得分组消息，分组不存在时继续等待
+func (q *ChanQueue) ReceiveWait(ctx context.Context, chname string, visibility time.Duration) (*Delivery, error) {
+	var d *Delivery
+	err := q.waits.block(ctx, chname, func() error {
+		return q.receiveWait(chname, visibility, &d)
+	})
+	return d, err
+}
+
+func (q *ChanQueue) ReceiveTimeout(chname string, timeout, visibility time.Duration) (*Delivery, error) {
+	var d *Delivery
+	err := q.waits.blockTimeout(timeout, chname, func() error {
+		return q.receiveWait(chname, visibility, &d)
+	})
+	return d, err
+}
+
+func (q *ChanQueue) receiveWait(chname string, visibility time.Duration, d **Delivery) error {
+	var err error
+	*d, err = q.Receive(chname, visibility)
+	if err == errChanNotExist {
+		return ErrEmpty
+	}
+	return err
+}
+
+func (q *ChanQueue) receive(chname string, visibility time.Duration) (*Delivery, error) {
+	if err := q.promote(chname); err != nil {
+		return nil, err
+	}
+	lease, rec, err := redeliver(q.db, chname, visibility, q.maxAttempts, &q.lease)
+	if err != nil {
+		return nil, err
+	}
+	if rec != nil {
+		return newDelivery(idToKey(chname, rec.ID), lease, rec), nil
+	}
+	mt, ok := q.mats[chname]
+	if !ok {
+		return nil, errChanNotExist
+	}
+	item, err := q.getItemByID(chname, mt.head+1)
+	if err != nil {
+		return nil, err
+	}
+	batch := new(leveldb.Batch)
+	lease = nextLease(batch, &q.lease)
+	rec = &flightRecord{ID: item.ID, Value: item.Value, Attempts: 1, Deadline: time.Now().Add(visibility).UnixNano()}
+	batch.Delete(item.Key)
+	if err := putFlight(batch, chname, lease, rec); err != nil {
+		return nil, err
+	}
+	if err := q.writeMat(batch, mt.popped(1, uint64(len(item.Value)))); err != nil {
+		return nil, err
+	}
+	q.shrank(chname, 1, uint64(len(item.Value)))
+	return newDelivery(item.Key, lease, rec), nil
+}
+
+func (q *ChanQueue) Ack(chname string, d *Delivery) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	return ackFlight(q.db, chname, d.Lease)
+}
+
+func (q *ChanQueue) Nack(chname string, d *Delivery) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	if err := nackFlight(q.db, chname, d.Lease); err != nil {
+		return err
+	}
+	q.waits.notifyAll(chname)
+	return nil
+}
+
+func (q *ChanQueue) InFlight(chname string) uint64 {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return 0
+	}
+	return flightCount(q.db, chname)
+}
+
+//分组的死信列表，Lease 为死信编号
+func (q *ChanQueue) DeadLetters(chname string) ([]*Delivery, error) {
+	q.RLock()
+	defer q.RUnlock()
+	if !q.isOpen {
+		return nil, ErrDBClosed
+	}
+	return deadLetters(q.db, q.iteratorOpts, chname, func(id uint64) []byte {
+		return idToKey(chname, id)
+	})
+}
+
+func (q *ChanQueue) DelDeadLetter(chname string, lease uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.isOpen {
+		return ErrDBClosed
+	}
+	return q.db.Delete(nsKey(nsDead, chname, IdToKeyPure(lease)), nil)
+}
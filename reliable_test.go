@@ -0,0 +1,206 @@
+package yiyidb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_Receive(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.EnqueueString("a")
+	q.EnqueueString("b")
+
+	d, err := q.Receive(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, d.ToString(), "a")
+	assert.Equal(t, d.Attempts, 1)
+	assert.Equal(t, q.Length(), uint64(1))
+	assert.Equal(t, q.InFlight(), uint64(1))
+
+	//Nack 后立即重新投递，租约号变化
+	assert.NoError(t, q.Nack(d))
+	d2, err := q.Receive(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, d2.ToString(), "a")
+	assert.Equal(t, d2.Attempts, 2)
+	assert.Equal(t, q.Ack(d), ErrLeaseNotFound)
+	assert.NoError(t, q.Ack(d2))
+	assert.Equal(t, q.InFlight(), uint64(0))
+
+	//租约到期重新投递，重启后在途状态保持
+	d, _ = q.Receive(100 * time.Millisecond)
+	assert.Equal(t, d.ToString(), "b")
+	q.Close()
+	q, err = OpenQueue(file)
+	assert.NoError(t, err)
+	assert.Equal(t, q.Length(), uint64(0))
+	assert.Equal(t, q.InFlight(), uint64(1))
+	time.Sleep(150 * time.Millisecond)
+	d2, err = q.Receive(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, d2.ToString(), "b")
+	assert.True(t, d2.Lease > d.Lease)
+	assert.NoError(t, q.Ack(d2))
+	_, err = q.Receive(time.Minute)
+	assert.Equal(t, err, ErrEmpty)
+
+	//超过投递次数转入死信
+	q.SetMaxAttempts(2)
+	q.EnqueueString("c")
+	for i := 0; i < 2; i++ {
+		d, err = q.Receive(time.Minute)
+		assert.NoError(t, err)
+		q.Nack(d)
+	}
+	_, err = q.Receive(time.Minute)
+	assert.Equal(t, err, ErrEmpty)
+	dead, err := q.DeadLetters()
+	assert.NoError(t, err)
+	assert.Equal(t, len(dead), 1)
+	assert.Equal(t, dead[0].ToString(), "c")
+	assert.Equal(t, dead[0].Attempts, 2)
+	assert.NoError(t, q.DelDeadLetter(dead[0].Lease))
+	dead, _ = q.DeadLetters()
+	assert.Equal(t, len(dead), 0)
+}
+
+func TestChanQueue_Receive(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	_, err = q.Receive("jobs", time.Minute)
+	assert.Error(t, err)
+	q.Enqueue("jobs", []byte("j1"))
+	q.Enqueue("other", []byte("o1"))
+	q.SetMaxAttempts(2)
+
+	d, err := q.Receive("jobs", 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, d.ToString(), "j1")
+	_, err = q.Receive("jobs", time.Minute)
+	assert.Equal(t, err, ErrEmpty)
+	assert.Equal(t, q.InFlight("jobs"), uint64(1))
+	assert.Equal(t, q.InFlight("other"), uint64(0))
+
+	//重启后租约到期重新投递
+	q.Close()
+	q, err = OpenChanQueue(file, 10)
+	assert.NoError(t, err)
+	q.SetMaxAttempts(2)
+	time.Sleep(100 * time.Millisecond)
+	d, err = q.Receive("jobs", 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, d.ToString(), "j1")
+	assert.Equal(t, d.Attempts, 2)
+
+	//达到上限后进入死信，不影响名为 jobs.dlq 的用户分组
+	q.Enqueue("jobs.dlq", []byte("user"))
+	time.Sleep(100 * time.Millisecond)
+	_, err = q.Receive("jobs", time.Minute)
+	assert.Error(t, err)
+	assert.Equal(t, q.InFlight("jobs"), uint64(0))
+	dead, err := q.DeadLetters("jobs")
+	assert.NoError(t, err)
+	assert.Equal(t, len(dead), 1)
+	assert.Equal(t, dead[0].ToString(), "j1")
+	assert.Equal(t, dead[0].Key, idToKey("jobs", 1))
+	assert.NoError(t, q.DelDeadLetter("jobs", dead[0].Lease))
+	dead, _ = q.DeadLetters("jobs")
+	assert.Equal(t, len(dead), 0)
+	l, _ := q.Length("jobs.dlq")
+	assert.Equal(t, l, uint64(1))
+
+	d, _ = q.Receive("other", time.Minute)
+	assert.NoError(t, q.Ack("other", d))
+	assert.Equal(t, q.Ack("other", d), ErrLeaseNotFound)
+}
+
+func TestQueue_LeaseSeq(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+
+	q.EnqueueString("a")
+	q.EnqueueString("b")
+	d, err := q.Receive(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, loadSeq(q.db, leaseSeq), d.Lease)
+
+	//重启后从保存的租约号继续，不依赖时钟
+	future := uint64(time.Now().Add(time.Hour).UnixNano())
+	q.db.Put(seqKey(leaseSeq), IdToKeyPure(future), nil)
+	q.Close()
+	q, err = OpenQueue(file)
+	assert.NoError(t, err)
+	defer q.Drop()
+	d, err = q.Receive(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, d.Lease, future+1)
+}
+
+func TestQueue_ReceiveWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenQueue(file)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	q.EnqueueString("a")
+	d, err := q.Receive(time.Minute)
+	assert.NoError(t, err)
+
+	//Nack 后唤醒阻塞的消费者，DequeueWait 的等待者排在前面也不影响
+	go q.DequeueTimeout(300 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Nack(d)
+	}()
+	d, err = q.ReceiveTimeout(time.Second, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, d.ToString(), "a")
+	assert.Equal(t, d.Attempts, 2)
+
+	//租约到期时唤醒
+	start := time.Now()
+	d, err = q.ReceiveTimeout(time.Second, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, d.Attempts, 3)
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestChanQueue_ReceiveWait(t *testing.T) {
+	file := fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	q, err := OpenChanQueue(file, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	defer q.Drop()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Enqueue("jobs", []byte("j1"))
+	}()
+	d, err := q.ReceiveTimeout("jobs", time.Second, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, d.ToString(), "j1")
+	d, err = q.ReceiveTimeout("jobs", time.Second, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, d.Attempts, 2)
+}
@@ -0,0 +1,325 @@
+package yiyidb
+
+import (
+	"bytes"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//集合: 每个成员一条记录 m+member -> 空，成员按字节序存放，集合运算按序归并不整体载入内存
+const sMemberSub byte = 'm'
+
+func sMemberPrefix(set string) []byte {
+	return nsKey(nsSet, set, []byte{sMemberSub})
+}
+
+func sMemberKey(set, member string) []byte {
+	return append(sMemberPrefix(set), member...)
+}
+
+//添加成员，返回新增数
+func (k *Kvdb) SAdd(set string, members ...string) (int, error) {
+	k.Lock()
+	defer k.Unlock()
+	batch := new(leveldb.Batch)
+	added := make(map[string]bool)
+	for _, m := range members {
+		mk := sMemberKey(set, m)
+		if ok, _ := k.db.Has(mk, nil); !ok && !added[m] {
+			batch.Put(mk, nil)
+			added[m] = true
+		}
+	}
+	if len(added) == 0 {
+		return 0, nil
+	}
+	k.nsSetCount(batch, nsSet, set, k.nsCount(nsSet, set)+uint64(len(added)))
+	return len(added), k.db.Write(batch, nil)
+}
+
+//删除成员，返回实际删除数
+func (k *Kvdb) SRem(set string, members ...string) (int, error) {
+	k.Lock()
+	defer k.Unlock()
+	batch := new(leveldb.Batch)
+	removed := make(map[string]bool)
+	for _, m := range members {
+		mk := sMemberKey(set, m)
+		if ok, _ := k.db.Has(mk, nil); ok && !removed[m] {
+			batch.Delete(mk)
+			removed[m] = true
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	k.nsSetCount(batch, nsSet, set, k.nsCount(nsSet, set)-uint64(len(removed)))
+	return len(removed), k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) SIsMember(set, member string) bool {
+	ok, _ := k.db.Has(sMemberKey(set, member), k.iteratorOpts)
+	return ok
+}
+
+func (k *Kvdb) SCard(set string) uint64 {
+	return k.nsCount(nsSet, set)
+}
+
+func (k *Kvdb) SMembers(set string) ([]string, error) {
+	return k.sCollect([]string{set}, k.SUnionEach)
+}
+
+func (k *Kvdb) SInter(sets ...string) ([]string, error) {
+	return k.sCollect(sets, k.SInterEach)
+}
+
+func (k *Kvdb) SUnion(sets ...string) ([]string, error) {
+	return k.sCollect(sets, k.SUnionEach)
+}
+
+func (k *Kvdb) SDiff(sets ...string) ([]string, error) {
+	return k.sCollect(sets, k.SDiffEach)
+}
+
+func (k *Kvdb) SInterStore(dest string, sets ...string) (uint64, error) {
+	return k.sStore(dest, sets, k.SInterEach)
+}
+
+func (k *Kvdb) SUnionStore(dest string, sets ...string) (uint64, error) {
+	return k.sStore(dest, sets, k.SUnionEach)
+}
+
+func (k *Kvdb) SDiffStore(dest string, sets ...string) (uint64, error) {
+	return k.sStore(dest, sets, k.SDiffEach)
+}
+
+func (k *Kvdb) SClear(set string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsSet, set)
+}
+
+//设置整个集合的超时秒数，<0 取消超时
+func (k *Kvdb) SSetTTL(set string, ttl int) error {
+	return k.expireNs(nsSet, set, ttl)
+}
+
+func (k *Kvdb) SGetTTL(set string) (float64, error) {
+	return k.ttlNs(nsSet, set)
+}
+
+type setEach func(sets []string, fn func(member string) error) error
+
+func (k *Kvdb) sCollect(sets []string, each setEach) ([]string, error) {
+	result := make([]string, 0)
+	err := each(sets, func(member string) error {
+		result = append(result, member)
+		return nil
+	})
+	return result, err
+}
+
+//结果与 dest 原有成员按序归并，按批写入变化的成员，每批同时写入当前成员数
+//中途失败时 dest 为部分结果但成员数与实际一致，dest 原有的ttl被清除
+func (k *Kvdb) sStore(dest string, sets []string, each setEach) (uint64, error) {
+	k.Lock()
+	defer k.Unlock()
+	snap, err := k.db.GetSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+	prefix := sMemberPrefix(dest)
+	old := snap.NewIterator(util.BytesPrefix(prefix), k.iteratorOpts)
+	defer old.Release()
+	ok := old.First()
+	count := k.nsCount(nsSet, dest)
+	if k.enableTtl {
+		k.ttldb.DelTTL(nsMetaKey(nsSet, dest))
+	}
+	var n uint64
+	batch := new(leveldb.Batch)
+	flush := func(force bool) error {
+		if !force && batch.Len() < migrateBatch {
+			return nil
+		}
+		k.nsSetCount(batch, nsSet, dest, count)
+		if err := k.db.Write(batch, nil); err != nil {
+			return err
+		}
+		batch.Reset()
+		return nil
+	}
+	err = each(sets, func(member string) error {
+		m := []byte(member)
+		for ; ok && bytes.Compare(old.Key()[len(prefix):], m) < 0; ok = old.Next() {
+			batch.Delete(old.Key())
+			count--
+			if err := flush(false); err != nil {
+				return err
+			}
+		}
+		if ok && bytes.Equal(old.Key()[len(prefix):], m) {
+			ok = old.Next()
+		} else {
+			batch.Put(sMemberKey(dest, member), nil)
+			count++
+		}
+		n++
+		return flush(false)
+	})
+	if err != nil {
+		return 0, err
+	}
+	for ; ok; ok = old.Next() {
+		batch.Delete(old.Key())
+		count--
+		if err := flush(false); err != nil {
+			return 0, err
+		}
+	}
+	if err := old.Error(); err != nil {
+		return 0, err
+	}
+	return n, flush(true)
+}
+
+//同一快照上的各集合游标
+type setCursor struct {
+	iter   iterator.Iterator
+	prefix []byte
+	ok     bool
+}
+
+func (c *setCursor) member() []byte {
+	return c.iter.Key()[len(c.prefix):]
+}
+
+func (c *setCursor) seek(member []byte) {
+	c.ok = c.iter.Seek(append(append([]byte{}, c.prefix...), member...))
+}
+
+func (k *Kvdb) sCursors(sets []string) ([]*setCursor, func(), error) {
+	snap, err := k.db.GetSnapshot()
+	if err != nil {
+		return nil, nil, err
+	}
+	cursors := make([]*setCursor, len(sets))
+	for i, s := range sets {
+		p := sMemberPrefix(s)
+		iter := snap.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+		cursors[i] = &setCursor{iter: iter, prefix: p, ok: iter.First()}
+	}
+	release := func() {
+		for _, c := range cursors {
+			c.iter.Release()
+		}
+		snap.Release()
+	}
+	return cursors, release, nil
+}
+
+//按序流式输出交集，每轮把落后的游标直接定位到当前最大成员
+func (k *Kvdb) SInterEach(sets []string, fn func(member string) error) error {
+	if len(sets) == 0 {
+		return nil
+	}
+	cursors, release, err := k.sCursors(sets)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for {
+		max := make([]byte, 0)
+		for _, c := range cursors {
+			if !c.ok {
+				return nil
+			}
+			if m := c.member(); bytes.Compare(m, max) > 0 {
+				max = append(max[:0], m...)
+			}
+		}
+		equal := true
+		for _, c := range cursors {
+			if !bytes.Equal(c.member(), max) {
+				c.seek(max)
+				equal = false
+			}
+		}
+		if !equal {
+			continue
+		}
+		if err := fn(string(max)); err != nil {
+			return err
+		}
+		for _, c := range cursors {
+			c.ok = c.iter.Next()
+		}
+	}
+}
+
+//多路归并输出并集
+func (k *Kvdb) SUnionEach(sets []string, fn func(member string) error) error {
+	cursors, release, err := k.sCursors(sets)
+	if err != nil {
+		return err
+	}
+	defer release()
+	for {
+		var min []byte
+		found := false
+		for _, c := range cursors {
+			if c.ok {
+				if m := c.member(); !found || bytes.Compare(m, min) < 0 {
+					min = append(min[:0], m...)
+					found = true
+				}
+			}
+		}
+		if !found {
+			return nil
+		}
+		if err := fn(string(min)); err != nil {
+			return err
+		}
+		for _, c := range cursors {
+			if c.ok && bytes.Equal(c.member(), min) {
+				c.ok = c.iter.Next()
+			}
+		}
+	}
+}
+
+//输出第一个集合中不属于其它集合的成员
+func (k *Kvdb) SDiffEach(sets []string, fn func(member string) error) error {
+	if len(sets) == 0 {
+		return nil
+	}
+	cursors, release, err := k.sCursors(sets)
+	if err != nil {
+		return err
+	}
+	defer release()
+	first := cursors[0]
+	for ; first.ok; first.ok = first.iter.Next() {
+		m := first.member()
+		found := false
+		for _, c := range cursors[1:] {
+			if c.ok && bytes.Compare(c.member(), m) < 0 {
+				c.seek(m)
+			}
+			if c.ok && bytes.Equal(c.member(), m) {
+				found = true
+			}
+		}
+		if !found {
+			if err := fn(string(m)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_Set(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	n, err := kv.SAdd("g1", "a", "b", "c", "d", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, n, 4)
+	kv.SAdd("g2", "b", "d", "e")
+	kv.SAdd("g3", "d", "b", "x", "y", "z")
+	assert.Equal(t, kv.SCard("g1"), uint64(4))
+	assert.True(t, kv.SIsMember("g2", "e"))
+	assert.False(t, kv.SIsMember("g2", "a"))
+
+	inter, err := kv.SInter("g1", "g2", "g3")
+	assert.NoError(t, err)
+	assert.Equal(t, inter, []string{"b", "d"})
+
+	union, err := kv.SUnion("g1", "g2")
+	assert.NoError(t, err)
+	assert.Equal(t, union, []string{"a", "b", "c", "d", "e"})
+
+	diff, err := kv.SDiff("g1", "g2", "g3")
+	assert.NoError(t, err)
+	assert.Equal(t, diff, []string{"a", "c"})
+
+	inter, err = kv.SInter("g1", "none")
+	assert.NoError(t, err)
+	assert.Equal(t, len(inter), 0)
+
+	//目标为源集合之一
+	cnt, err := kv.SInterStore("g1", "g1", "g3")
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, uint64(2))
+	members, err := kv.SMembers("g1")
+	assert.NoError(t, err)
+	assert.Equal(t, members, []string{"b", "d"})
+	assert.Equal(t, kv.SCard("g1"), uint64(2))
+
+	n, err = kv.SRem("g2", "b", "q")
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	assert.Equal(t, kv.SCard("g2"), uint64(2))
+
+	assert.NoError(t, kv.SClear("g3"))
+	assert.Equal(t, kv.SCard("g3"), uint64(0))
+
+	kv.Drop()
+}
+
+func TestKvdb_SInterLarge(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	evens := make([]string, 0)
+	threes := make([]string, 0)
+	for i := 0; i < 3000; i++ {
+		if i%2 == 0 {
+			evens = append(evens, fmt.Sprintf("%06d", i))
+		}
+		if i%3 == 0 {
+			threes = append(threes, fmt.Sprintf("%06d", i))
+		}
+	}
+	kv.SAdd("evens", evens...)
+	kv.SAdd("threes", threes...)
+
+	count := 0
+	err = kv.SInterEach([]string{"evens", "threes"}, func(member string) error {
+		count++
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, count, 500)
+
+	cnt, err := kv.SUnionStore("all", "evens", "threes")
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, uint64(2000))
+
+	kv.Drop()
+}
+
+func TestKvdb_SStoreReplace(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, true, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	old := make([]string, 0)
+	for i := 0; i < 2500; i++ {
+		old = append(old, fmt.Sprintf("%06d", i))
+	}
+	src := make([]string, 0)
+	for i := 0; i < 5000; i += 5 {
+		src = append(src, fmt.Sprintf("%06d", i))
+	}
+	kv.SAdd("dst", old...)
+	kv.SAdd("src", src...)
+	assert.NoError(t, kv.SSetTTL("dst", 100))
+
+	//dest 原有成员被替换，ttl被清除
+	cnt, err := kv.SUnionStore("dst", "src")
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, uint64(1000))
+	assert.Equal(t, kv.SCard("dst"), uint64(1000))
+	members, _ := kv.SMembers("dst")
+	assert.Equal(t, members, src)
+	_, err = kv.SGetTTL("dst")
+	assert.Error(t, err)
+
+	//dest 同时是源集合
+	cnt, err = kv.SDiffStore("dst", "dst", "evens")
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, uint64(1000))
+	cnt, err = kv.SInterStore("dst", "dst", "src")
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, uint64(1000))
+	assert.Equal(t, kv.SCard("dst"), uint64(1000))
+
+	kv.Drop()
+}
@@ -0,0 +1,363 @@
+package yiyidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//时序: 数据点 p+时间戳(纳秒) -> float64，配置 o -> 保留时长，降采样规则 r+目标序列 -> 桶宽+聚合方式
+const (
+	tsPointSub  byte = 'p'
+	tsOptionSub byte = 'o'
+	tsRuleSub   byte = 'r'
+)
+
+type Aggregation byte
+
+const (
+	AggAvg Aggregation = iota + 1
+	AggMin
+	AggMax
+	AggSum
+	AggCount
+	AggFirst
+	AggLast
+)
+
+type TSPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+type TSRule struct {
+	Dest   string
+	Bucket time.Duration
+	Agg    Aggregation
+}
+
+func tsPointPrefix(series string) []byte {
+	return nsKey(nsTS, series, []byte{tsPointSub})
+}
+
+func tsPointKey(series string, ts int64) []byte {
+	return append(tsPointPrefix(series), IdToKeyPure(uint64(ts)^1<<63)...)
+}
+
+func tsRulePrefix(series string) []byte {
+	return nsKey(nsTS, series, []byte{tsRuleSub})
+}
+
+func tsPointFromKV(prefixLen int, key, value []byte) TSPoint {
+	ts := int64(KeyToIDPure(key[prefixLen:]) ^ 1<<63)
+	return TSPoint{Time: time.Unix(0, ts), Value: math.Float64frombits(binary.BigEndian.Uint64(value))}
+}
+
+func tsValue(v float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(v))
+	return b
+}
+
+//桶起始时间按 bucket 的整数倍对齐
+func tsBucketStart(ts int64, bucket time.Duration) int64 {
+	b := int64(bucket)
+	start := ts - ts%b
+	if ts < 0 && ts%b != 0 {
+		start -= b
+	}
+	return start
+}
+
+type tsAggregator struct {
+	agg                        Aggregation
+	count                      int
+	sum, min, max, first, last float64
+}
+
+func (a *tsAggregator) add(v float64) {
+	if a.count == 0 {
+		a.min, a.max, a.first = v, v, v
+	}
+	a.count++
+	a.sum += v
+	a.min = math.Min(a.min, v)
+	a.max = math.Max(a.max, v)
+	a.last = v
+}
+
+func (a *tsAggregator) value() float64 {
+	switch a.agg {
+	case AggMin:
+		return a.min
+	case AggMax:
+		return a.max
+	case AggSum:
+		return a.sum
+	case AggCount:
+		return float64(a.count)
+	case AggFirst:
+		return a.first
+	case AggLast:
+		return a.last
+	default:
+		return a.sum / float64(a.count)
+	}
+}
+
+//写入数据点，同一时间戳覆盖旧值，并按保留时长清理旧数据、更新降采样序列
+func (k *Kvdb) TSAdd(series string, ts time.Time, value float64) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.tsAdd(series, ts.UnixNano(), value, 0)
+}
+
+func (k *Kvdb) tsAdd(series string, ts int64, value float64, depth int) error {
+	if depth > 8 {
+		return errors.New("ts rule depth out of range")
+	}
+	last, hasLast := k.tsLastTime(series)
+	batch := new(leveldb.Batch)
+	pk := tsPointKey(series, ts)
+	count := k.nsCount(nsTS, series)
+	if ok, _ := k.db.Has(pk, nil); !ok {
+		count++
+	}
+	batch.Put(pk, tsValue(value))
+	if retention := k.tsRetention(series); retention > 0 {
+		newest := ts
+		if hasLast && last > ts {
+			newest = last
+		}
+		if newest-ts >= retention {
+			return errors.New("ts older than retention")
+		}
+		count -= k.tsTrim(batch, series, newest-retention)
+	}
+	k.nsSetCount(batch, nsTS, series, count)
+	if err := k.db.Write(batch, nil); err != nil {
+		return err
+	}
+	for _, r := range k.tsRules(series) {
+		bucket := tsBucketStart(ts, r.Bucket)
+		if hasLast {
+			lastBucket := tsBucketStart(last, r.Bucket)
+			if bucket > lastBucket {
+				//新桶开始，上一个桶已完整
+				bucket = lastBucket
+			} else if bucket == lastBucket {
+				continue
+			}
+		} else {
+			continue
+		}
+		if err := k.tsRollup(series, r, bucket, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//重新计算源序列一个桶的聚合值写入目标序列
+func (k *Kvdb) tsRollup(series string, r TSRule, bucket int64, depth int) error {
+	a := &tsAggregator{agg: r.Agg}
+	p := tsPointPrefix(series)
+	iter := k.db.NewIterator(&util.Range{Start: tsPointKey(series, bucket), Limit: tsPointKey(series, bucket+int64(r.Bucket))}, k.iteratorOpts)
+	for iter.Next() {
+		a.add(tsPointFromKV(len(p), iter.Key(), iter.Value()).Value)
+	}
+	iter.Release()
+	if a.count == 0 {
+		return nil
+	}
+	return k.tsAdd(r.Dest, bucket, a.value(), depth+1)
+}
+
+//删除早于 before 的数据点，返回删除数
+func (k *Kvdb) tsTrim(batch *leveldb.Batch, series string, before int64) uint64 {
+	var n uint64
+	iter := k.db.NewIterator(&util.Range{Start: tsPointPrefix(series), Limit: tsPointKey(series, before)}, k.iteratorOpts)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+		n++
+	}
+	iter.Release()
+	return n
+}
+
+func (k *Kvdb) tsLastTime(series string) (int64, bool) {
+	p := tsPointPrefix(series)
+	iter := k.db.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+	defer iter.Release()
+	if !iter.Last() {
+		return 0, false
+	}
+	return tsPointFromKV(len(p), iter.Key(), iter.Value()).Time.UnixNano(), true
+}
+
+func (k *Kvdb) tsRetention(series string) int64 {
+	val, err := k.db.Get(nsKey(nsTS, series, []byte{tsOptionSub}), nil)
+	if err != nil || len(val) < 8 {
+		return 0
+	}
+	return int64(KeyToIDPure(val))
+}
+
+func (k *Kvdb) tsRules(series string) []TSRule {
+	rules := make([]TSRule, 0)
+	p := tsRulePrefix(series)
+	iter := k.db.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		if len(iter.Value()) < 9 {
+			continue
+		}
+		rules = append(rules, TSRule{
+			Dest:   string(iter.Key()[len(p):]),
+			Bucket: time.Duration(KeyToIDPure(iter.Value())),
+			Agg:    Aggregation(iter.Value()[8]),
+		})
+	}
+	return rules
+}
+
+//设置保留时长，早于最新数据点 retention 的数据会被删除，0 表示永久保留
+func (k *Kvdb) TSSetRetention(series string, retention time.Duration) error {
+	k.Lock()
+	defer k.Unlock()
+	ok := nsKey(nsTS, series, []byte{tsOptionSub})
+	if retention <= 0 {
+		return k.db.Delete(ok, nil)
+	}
+	batch := new(leveldb.Batch)
+	batch.Put(ok, IdToKeyPure(uint64(retention)))
+	if last, has := k.tsLastTime(series); has {
+		n := k.tsTrim(batch, series, last-int64(retention))
+		k.nsSetCount(batch, nsTS, series, k.nsCount(nsTS, series)-n)
+	}
+	return k.db.Write(batch, nil)
+}
+
+//删除早于 before 的数据点
+func (k *Kvdb) TSTrim(series string, before time.Time) (uint64, error) {
+	k.Lock()
+	defer k.Unlock()
+	batch := new(leveldb.Batch)
+	n := k.tsTrim(batch, series, before.UnixNano())
+	if n == 0 {
+		return 0, nil
+	}
+	k.nsSetCount(batch, nsTS, series, k.nsCount(nsTS, series)-n)
+	return n, k.db.Write(batch, nil)
+}
+
+//新增降采样规则，写入 src 的数据按 bucket 聚合后写入 dest
+func (k *Kvdb) TSCreateRule(src, dest string, bucket time.Duration, agg Aggregation) error {
+	if bucket <= 0 {
+		return errors.New("bucket must > 0")
+	}
+	if src == dest {
+		return errors.New("src equal dest")
+	}
+	k.Lock()
+	defer k.Unlock()
+	val := append(IdToKeyPure(uint64(bucket)), byte(agg))
+	return k.db.Put(append(tsRulePrefix(src), dest...), val, nil)
+}
+
+func (k *Kvdb) TSDeleteRule(src, dest string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.db.Delete(append(tsRulePrefix(src), dest...), nil)
+}
+
+func (k *Kvdb) TSRules(series string) []TSRule {
+	return k.tsRules(series)
+}
+
+func (k *Kvdb) TSLen(series string) uint64 {
+	return k.nsCount(nsTS, series)
+}
+
+//按时间闭区间返回数据点
+func (k *Kvdb) TSRange(series string, from, to time.Time) ([]TSPoint, error) {
+	result := make([]TSPoint, 0)
+	err := k.tsScan(series, from.UnixNano(), to.UnixNano(), func(p TSPoint) {
+		result = append(result, p)
+	})
+	return result, err
+}
+
+func (k *Kvdb) tsScan(series string, from, to int64, fn func(p TSPoint)) error {
+	p := tsPointPrefix(series)
+	limit := util.BytesPrefix(p).Limit
+	if to < math.MaxInt64 {
+		limit = tsPointKey(series, to+1)
+	}
+	iter := k.db.NewIterator(&util.Range{Start: tsPointKey(series, from), Limit: limit}, k.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		fn(tsPointFromKV(len(p), iter.Key(), iter.Value()))
+	}
+	return iter.Error()
+}
+
+//返回最新的 n 个数据点，按时间升序
+func (k *Kvdb) TSLast(series string, n int) ([]TSPoint, error) {
+	result := make([]TSPoint, 0, n)
+	p := tsPointPrefix(series)
+	iter := k.db.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+	defer iter.Release()
+	for ok := iter.Last(); ok && len(result) < n; ok = iter.Prev() {
+		result = append(result, tsPointFromKV(len(p), iter.Key(), iter.Value()))
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result, iter.Error()
+}
+
+//按 bucket 降采样，每个非空桶返回一个以桶起始时间为时间戳的聚合点
+func (k *Kvdb) TSAggregate(series string, from, to time.Time, bucket time.Duration, agg Aggregation) ([]TSPoint, error) {
+	if bucket <= 0 {
+		return nil, errors.New("bucket must > 0")
+	}
+	result := make([]TSPoint, 0)
+	var cur int64
+	var a *tsAggregator
+	err := k.tsScan(series, from.UnixNano(), to.UnixNano(), func(p TSPoint) {
+		b := tsBucketStart(p.Time.UnixNano(), bucket)
+		if a != nil && b != cur {
+			result = append(result, TSPoint{Time: time.Unix(0, cur), Value: a.value()})
+			a = nil
+		}
+		if a == nil {
+			a = &tsAggregator{agg: agg}
+			cur = b
+		}
+		a.add(p.Value)
+	})
+	if a != nil {
+		result = append(result, TSPoint{Time: time.Unix(0, cur), Value: a.value()})
+	}
+	return result, err
+}
+
+func (k *Kvdb) TSClear(series string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsTS, series)
+}
+
+//设置整个序列的超时秒数，<0 取消超时
+func (k *Kvdb) TSSetTTL(series string, ttl int) error {
+	return k.expireNs(nsTS, series, ttl)
+}
+
+func (k *Kvdb) TSGetTTL(series string) (float64, error) {
+	return k.ttlNs(nsTS, series)
+}
@@ -0,0 +1,100 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_TimeSeries(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Drop()
+
+	base := time.Unix(1600000000, 0)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, kv.TSAdd("cpu", base.Add(time.Duration(i)*time.Second), float64(i)))
+	}
+	//同一时间戳覆盖
+	assert.NoError(t, kv.TSAdd("cpu", base.Add(9*time.Second), 90))
+	assert.Equal(t, kv.TSLen("cpu"), uint64(10))
+
+	points, err := kv.TSRange("cpu", base.Add(2*time.Second), base.Add(4*time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, len(points), 3)
+	assert.Equal(t, points[0].Value, float64(2))
+	assert.True(t, points[2].Time.Equal(base.Add(4*time.Second)))
+
+	last, err := kv.TSLast("cpu", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, last[0].Value, float64(8))
+	assert.Equal(t, last[1].Value, float64(90))
+
+	agg, err := kv.TSAggregate("cpu", base, base.Add(time.Minute), 5*time.Second, AggAvg)
+	assert.NoError(t, err)
+	assert.Equal(t, len(agg), 2)
+	assert.Equal(t, agg[0].Value, float64(2))
+	assert.True(t, agg[1].Time.Equal(base.Add(5*time.Second)))
+	agg, _ = kv.TSAggregate("cpu", base, base.Add(time.Minute), 5*time.Second, AggMax)
+	assert.Equal(t, agg[1].Value, float64(90))
+
+	assert.NoError(t, kv.TSSetRetention("cpu", 5*time.Second))
+	assert.Equal(t, kv.TSLen("cpu"), uint64(6))
+	assert.Error(t, kv.TSAdd("cpu", base, 1))
+	assert.NoError(t, kv.TSAdd("cpu", base.Add(12*time.Second), 12))
+	points, _ = kv.TSRange("cpu", base, base.Add(time.Minute))
+	assert.True(t, points[0].Time.Equal(base.Add(7*time.Second)))
+	assert.Equal(t, kv.TSLen("cpu"), uint64(4))
+
+	assert.NoError(t, kv.TSClear("cpu"))
+	assert.Equal(t, kv.TSLen("cpu"), uint64(0))
+}
+
+func TestKvdb_TimeSeriesRule(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Drop()
+
+	assert.NoError(t, kv.TSCreateRule("raw", "minute", time.Minute, AggSum))
+	assert.NoError(t, kv.TSCreateRule("minute", "hour", time.Hour, AggMax))
+	assert.Equal(t, len(kv.TSRules("raw")), 1)
+
+	base := time.Unix(1600000000, 0).Truncate(time.Hour)
+	for i := 0; i < 180; i++ {
+		kv.TSAdd("raw", base.Add(time.Duration(i)*30*time.Second), 1)
+	}
+	//最后一个桶未结束不写入
+	minute, err := kv.TSRange("minute", base, base.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, len(minute), 89)
+	assert.Equal(t, minute[0].Value, float64(2))
+	hour, _ := kv.TSRange("hour", base, base.Add(2*time.Hour))
+	assert.Equal(t, len(hour), 1)
+	assert.Equal(t, hour[0].Value, float64(2))
+
+	//迟到的数据重算已结束的桶
+	kv.TSAdd("raw", base.Add(10*time.Second), 5)
+	minute, _ = kv.TSRange("minute", base, base)
+	assert.Equal(t, minute[0].Value, float64(7))
+
+	assert.NoError(t, kv.TSDeleteRule("raw", "minute"))
+	assert.Equal(t, len(kv.TSRules("raw")), 0)
+}
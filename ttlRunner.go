@@ -4,9 +4,11 @@ import (
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
 	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/util"
 	"time"
 	"gopkg.in/vmihailenco/msgpack.v2"
 	"fmt"
+	"sync"
 )
 
 type ttlRunner struct {
@@ -14,7 +16,13 @@ type ttlRunner struct {
 	db            *leveldb.DB
 	iteratorOpts  *opt.ReadOptions
 	quit          chan struct{}
+	done          chan struct{}
+	closeOnce     sync.Once
 	HandleExpirse func(key, value []byte)
+	//返回超时key需一并删除的前缀，用于复合类型整体超时
+	DelPrefix     func(key []byte) []byte
+	//替代直接写主库，用于同步清理超时key的附属数据
+	WriteExpired  func(batch *leveldb.Batch, keys [][]byte) error
 	IsWorking     bool
 }
 
@@ -88,15 +96,45 @@ func (t *ttlRunner) DelTTL(key []byte) error {
 	return t.db.Delete(key, nil)
 }
 
+//把ttl记录从旧key转到新key，保留原超时时间
+func (t *ttlRunner) moveTTL(oldKey, newKey []byte) error {
+	val, err := t.db.Get(oldKey, t.iteratorOpts)
+	if err == leveldb.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(oldKey)
+	var it TtlItem
+	if err := msgpack.Unmarshal(val, &it); err == nil {
+		it.Dkey = newKey
+		ttlitem, _ := msgpack.Marshal(&it)
+		batch.Put(newKey, ttlitem)
+	}
+	return t.db.Write(batch, nil)
+}
+
+func (t *ttlRunner) delPrefix(batch *leveldb.Batch, prefix []byte) {
+	iter := t.masterdb.NewIterator(util.BytesPrefix(prefix), t.iteratorOpts)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+}
+
 func (t *ttlRunner) Run() {
 	ticker := time.NewTicker(1 * time.Second)
+	t.done = make(chan struct{})
 	go func() {
+		defer close(t.done)
 		for {
 			select {
 			case <-ticker.C:
 				if !t.IsWorking {
 					t.IsWorking = true
 					batch := new(leveldb.Batch)
+					expired := make([][]byte, 0)
 					iter := t.db.NewIterator(nil, t.iteratorOpts)
 					for iter.Next() {
 						var it TtlItem
@@ -105,6 +143,12 @@ func (t *ttlRunner) Run() {
 						} else {
 							if it.expired() {
 								batch.Delete(it.Dkey)
+								expired = append(expired, it.Dkey)
+								if t.DelPrefix != nil {
+									if p := t.DelPrefix(it.Dkey); p != nil {
+										t.delPrefix(batch, p)
+									}
+								}
 								val, err := t.masterdb.Get(iter.Key(), t.iteratorOpts)
 								if err == nil && t.HandleExpirse != nil {
 									t.HandleExpirse(iter.Key(), val)
@@ -114,10 +158,20 @@ func (t *ttlRunner) Run() {
 					}
 					iter.Release()
 					if batch.Len() > 0 {
-						if err := t.masterdb.Write(batch, nil); err != nil {
+						tbatch := new(leveldb.Batch)
+						for _, key := range expired {
+							tbatch.Delete(key)
+						}
+						var err error
+						if t.WriteExpired != nil {
+							err = t.WriteExpired(batch, expired)
+						} else {
+							err = t.masterdb.Write(batch, nil)
+						}
+						if err != nil {
 							fmt.Println(err)
 						}
-						if err := t.db.Write(batch, nil); err != nil {
+						if err := t.db.Write(tbatch, nil); err != nil {
 							fmt.Println(err)
 						}
 					}
@@ -131,6 +185,13 @@ func (t *ttlRunner) Run() {
 	}()
 }
 
+//等待正在执行的清理结束后再关闭ttl库
 func (t *ttlRunner) Close() {
-	close(t.quit)
+	t.closeOnce.Do(func() {
+		close(t.quit)
+		if t.done != nil {
+			<-t.done
+		}
+		t.db.Close()
+	})
 }
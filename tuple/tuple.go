@@ -0,0 +1,321 @@
+//有序元组主键编码，编码后的字节序与元组各元素的自然顺序一致
+//编码格式参照 FoundationDB tuple layer
+package tuple
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+type Tuple []interface{}
+
+const (
+	nilCode    byte = 0x00
+	bytesCode  byte = 0x01
+	stringCode byte = 0x02
+	nestedCode byte = 0x05
+	intZero    byte = 0x14
+	floatCode  byte = 0x20
+	doubleCode byte = 0x21
+	falseCode  byte = 0x26
+	trueCode   byte = 0x27
+	timeCode   byte = 0x40
+)
+
+var (
+	ErrInvalid = errors.New("tuple: invalid encoding")
+)
+
+//Pack 编码元组，不支持的元素类型会 panic
+func (t Tuple) Pack() []byte {
+	buf := new(bytes.Buffer)
+	t.encode(buf, false)
+	return buf.Bytes()
+}
+
+//用于 Kvdb.KeyStart/IterStartWith 的前缀
+func (t Tuple) Prefix() []byte {
+	return t.Pack()
+}
+
+//用于 Kvdb.KeyRange 的闭区间，包含以 t 为前缀的所有元组
+func (t Tuple) Range() (min, max []byte) {
+	min = t.Pack()
+	max = make([]byte, len(min)+1)
+	copy(max, min)
+	max[len(min)] = 0xff
+	return min, max
+}
+
+func (t Tuple) encode(buf *bytes.Buffer, nested bool) {
+	for _, e := range t {
+		switch v := e.(type) {
+		case nil:
+			buf.WriteByte(nilCode)
+			if nested {
+				buf.WriteByte(0xff)
+			}
+		case []byte:
+			buf.WriteByte(bytesCode)
+			writeEscaped(buf, v)
+		case string:
+			buf.WriteByte(stringCode)
+			writeEscaped(buf, []byte(v))
+		case Tuple:
+			buf.WriteByte(nestedCode)
+			v.encode(buf, true)
+			buf.WriteByte(0x00)
+		case bool:
+			if v {
+				buf.WriteByte(trueCode)
+			} else {
+				buf.WriteByte(falseCode)
+			}
+		case int:
+			encodeInt(buf, int64(v))
+		case int8:
+			encodeInt(buf, int64(v))
+		case int16:
+			encodeInt(buf, int64(v))
+		case int32:
+			encodeInt(buf, int64(v))
+		case int64:
+			encodeInt(buf, v)
+		case uint:
+			encodeUint(buf, uint64(v))
+		case uint8:
+			encodeUint(buf, uint64(v))
+		case uint16:
+			encodeUint(buf, uint64(v))
+		case uint32:
+			encodeUint(buf, uint64(v))
+		case uint64:
+			encodeUint(buf, v)
+		case float32:
+			buf.WriteByte(floatCode)
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, math.Float32bits(v))
+			adjustFloat(b, true)
+			buf.Write(b)
+		case float64:
+			buf.WriteByte(doubleCode)
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, math.Float64bits(v))
+			adjustFloat(b, true)
+			buf.Write(b)
+		case time.Time:
+			buf.WriteByte(timeCode)
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, uint64(v.UnixNano())^1<<63)
+			buf.Write(b)
+		default:
+			panic(fmt.Sprintf("tuple: unsupported type %T", e))
+		}
+	}
+}
+
+//0x00 转义为 0x00 0xff 并以 0x00 结尾
+func writeEscaped(buf *bytes.Buffer, b []byte) {
+	for _, c := range b {
+		buf.WriteByte(c)
+		if c == 0x00 {
+			buf.WriteByte(0xff)
+		}
+	}
+	buf.WriteByte(0x00)
+}
+
+func encodeUint(buf *bytes.Buffer, v uint64) {
+	if v == 0 {
+		buf.WriteByte(intZero)
+		return
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	n := bytesLen(v)
+	buf.WriteByte(intZero + byte(n))
+	buf.Write(b[8-n:])
+}
+
+func encodeInt(buf *bytes.Buffer, v int64) {
+	if v >= 0 {
+		encodeUint(buf, uint64(v))
+		return
+	}
+	//负数按字节长度取反码，长度越大排序越靠前
+	u := uint64(-v)
+	if v == math.MinInt64 {
+		u = 1 << 63
+	}
+	n := bytesLen(u)
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, ^u)
+	buf.WriteByte(intZero - byte(n))
+	buf.Write(b[8-n:])
+}
+
+func bytesLen(v uint64) int {
+	n := 0
+	for v > 0 {
+		n++
+		v >>= 8
+	}
+	return n
+}
+
+func adjustFloat(b []byte, encode bool) {
+	if (encode && b[0]&0x80 != 0) || (!encode && b[0]&0x80 == 0) {
+		for i := range b {
+			b[i] = ^b[i]
+		}
+	} else {
+		b[0] ^= 0x80
+	}
+}
+
+//Unpack 解码，整数在 int64 范围内返回 int64，否则返回 uint64
+func Unpack(b []byte) (Tuple, error) {
+	t, _, err := decode(b, false)
+	return t, err
+}
+
+func decode(b []byte, nested bool) (Tuple, int, error) {
+	t := make(Tuple, 0)
+	i := 0
+	for i < len(b) {
+		code := b[i]
+		switch {
+		case code == nilCode:
+			if !nested {
+				t = append(t, nil)
+				i++
+			} else if i+1 < len(b) && b[i+1] == 0xff {
+				t = append(t, nil)
+				i += 2
+			} else {
+				return t, i + 1, nil
+			}
+		case code == bytesCode || code == stringCode:
+			v, n, err := readEscaped(b[i+1:])
+			if err != nil {
+				return nil, 0, err
+			}
+			if code == bytesCode {
+				t = append(t, v)
+			} else {
+				t = append(t, string(v))
+			}
+			i += n + 1
+		case code == nestedCode:
+			v, n, err := decode(b[i+1:], true)
+			if err != nil {
+				return nil, 0, err
+			}
+			t = append(t, v)
+			i += n + 1
+		case code >= intZero-8 && code <= intZero+8:
+			v, n, err := decodeInt(b[i:])
+			if err != nil {
+				return nil, 0, err
+			}
+			t = append(t, v)
+			i += n
+		case code == floatCode:
+			if i+5 > len(b) {
+				return nil, 0, ErrInvalid
+			}
+			f := make([]byte, 4)
+			copy(f, b[i+1:i+5])
+			adjustFloat(f, false)
+			t = append(t, math.Float32frombits(binary.BigEndian.Uint32(f)))
+			i += 5
+		case code == doubleCode:
+			if i+9 > len(b) {
+				return nil, 0, ErrInvalid
+			}
+			f := make([]byte, 8)
+			copy(f, b[i+1:i+9])
+			adjustFloat(f, false)
+			t = append(t, math.Float64frombits(binary.BigEndian.Uint64(f)))
+			i += 9
+		case code == falseCode:
+			t = append(t, false)
+			i++
+		case code == trueCode:
+			t = append(t, true)
+			i++
+		case code == timeCode:
+			if i+9 > len(b) {
+				return nil, 0, ErrInvalid
+			}
+			n := int64(binary.BigEndian.Uint64(b[i+1:i+9]) ^ 1<<63)
+			t = append(t, time.Unix(0, n).UTC())
+			i += 9
+		default:
+			return nil, 0, ErrInvalid
+		}
+	}
+	if nested {
+		return nil, 0, ErrInvalid
+	}
+	return t, i, nil
+}
+
+func readEscaped(b []byte) ([]byte, int, error) {
+	v := make([]byte, 0)
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0x00 {
+			if i+1 < len(b) && b[i+1] == 0xff {
+				v = append(v, 0x00)
+				i++
+				continue
+			}
+			return v, i + 1, nil
+		}
+		v = append(v, b[i])
+	}
+	return nil, 0, ErrInvalid
+}
+
+func decodeInt(b []byte) (interface{}, int, error) {
+	code := b[0]
+	if code == intZero {
+		return int64(0), 1, nil
+	}
+	neg := code < intZero
+	n := int(code) - int(intZero)
+	if neg {
+		n = -n
+	}
+	if len(b) < n+1 {
+		return nil, 0, ErrInvalid
+	}
+	buf := make([]byte, 8)
+	copy(buf[8-n:], b[1:n+1])
+	u := binary.BigEndian.Uint64(buf)
+	if neg {
+		//还原取反码
+		u = ^u
+		if n < 8 {
+			u &= 1<<(uint(n)*8) - 1
+		}
+		if u > 1<<63 {
+			return nil, 0, ErrInvalid
+		}
+		return -int64(u), n + 1, nil
+	}
+	if u > math.MaxInt64 {
+		return u, n + 1, nil
+	}
+	return int64(u), n + 1, nil
+}
+
+//实现 yiyidb.KeyEncoder[tuple.Tuple]，用于 NewCollection
+type Keys struct{}
+
+func (Keys) EncodeKey(key Tuple) []byte           { return key.Pack() }
+func (Keys) DecodeKey(data []byte) (Tuple, error) { return Unpack(data) }
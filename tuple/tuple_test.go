@@ -0,0 +1,56 @@
+package tuple
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTuple_PackUnpack(t *testing.T) {
+	now := time.Unix(1500000000, 123).UTC()
+	tp := Tuple{"dev", []byte{0x00, 0x01}, int64(-300), uint64(math.MaxUint64), 3.5, float32(-1.5), true, nil, now, Tuple{"a", nil}}
+	out, err := Unpack(tp.Pack())
+	assert.NoError(t, err)
+	assert.Equal(t, out, Tuple{"dev", []byte{0x00, 0x01}, int64(-300), uint64(math.MaxUint64), 3.5, float32(-1.5), true, nil, now, Tuple{"a", nil}})
+
+	_, err = Unpack([]byte{0x02, 'a'})
+	assert.Equal(t, err, ErrInvalid)
+}
+
+func TestTuple_Order(t *testing.T) {
+	ints := []int64{math.MinInt64, -70000, -256, -255, -1, 0, 1, 255, 256, 70000, math.MaxInt64}
+	for i := 1; i < len(ints); i++ {
+		a := Tuple{"k", ints[i-1]}.Pack()
+		b := Tuple{"k", ints[i]}.Pack()
+		assert.True(t, bytes.Compare(a, b) < 0, "%d < %d", ints[i-1], ints[i])
+	}
+
+	floats := []float64{math.Inf(-1), -10.5, -0.1, 0, 0.1, 2, math.Inf(1)}
+	for i := 1; i < len(floats); i++ {
+		assert.True(t, bytes.Compare(Tuple{floats[i-1]}.Pack(), Tuple{floats[i]}.Pack()) < 0)
+	}
+
+	strs := []string{"a", "a\x00", "a\x00b", "ab", "b"}
+	packed := make([][]byte, 0)
+	for _, s := range strs {
+		packed = append(packed, Tuple{s}.Pack())
+	}
+	assert.True(t, sort.SliceIsSorted(packed, func(i, j int) bool { return bytes.Compare(packed[i], packed[j]) < 0 }))
+
+	t1 := Tuple{time.Unix(-10, 0)}.Pack()
+	t2 := Tuple{time.Unix(10, 0)}.Pack()
+	assert.True(t, bytes.Compare(t1, t2) < 0)
+}
+
+func TestTuple_Range(t *testing.T) {
+	min, max := Tuple{"user", int64(7)}.Range()
+	in := Tuple{"user", int64(7), "name"}.Pack()
+	out := Tuple{"user", int64(8)}.Pack()
+	assert.True(t, bytes.Compare(in, min) >= 0 && bytes.Compare(in, max) <= 0)
+	assert.True(t, bytes.Compare(out, max) > 0)
+	assert.True(t, bytes.HasPrefix(in, Tuple{"user", int64(7)}.Prefix()))
+}
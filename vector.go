@@ -0,0 +1,654 @@
+package yiyidb
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+//向量索引: 配置 c，向量 e+key -> float32小端序，HNSW 节点 n+key -> 层数+各层邻居，入口 p -> 层数+key
+const (
+	vecConfSub  byte = 'c'
+	vecEmbSub   byte = 'e'
+	vecNodeSub  byte = 'n'
+	vecEntrySub byte = 'p'
+	vecMaxLevel      = 16
+)
+
+type VecMetric byte
+
+const (
+	VecCosine VecMetric = iota + 1
+	VecL2
+	VecDot
+)
+
+var ErrVecIndexNotFound = errors.New("vector index not found")
+
+type VecIndexOptions struct {
+	Metric VecMetric
+	//false 为精确检索，true 为 HNSW 近似检索
+	HNSW           bool
+	M              int
+	EfConstruction int
+	EfSearch       int
+}
+
+type vecConfig struct {
+	Dim            int
+	Metric         VecMetric
+	HNSW           bool
+	M              int
+	EfConstruction int
+	EfSearch       int
+}
+
+//Distance 越小越相近: 余弦为 1-cos，L2 为欧氏距离，点积为负内积
+type VecHit struct {
+	Key      string
+	Distance float64
+}
+
+func vecKey(index string, sub byte, key string) []byte {
+	return append(nsKey(nsVec, index, []byte{sub}), key...)
+}
+
+func vecEncode(v []float32) []byte {
+	data := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(f))
+	}
+	return data
+}
+
+func vecDecode(data []byte) []float32 {
+	v := make([]float32, len(data)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return v
+}
+
+func vecDistance(m VecMetric, a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		switch m {
+		case VecL2:
+			dot += (x - y) * (x - y)
+		default:
+			dot += x * y
+			na += x * x
+			nb += y * y
+		}
+	}
+	switch m {
+	case VecL2:
+		return math.Sqrt(dot)
+	case VecDot:
+		return -dot
+	}
+	if na == 0 || nb == 0 {
+		return 1
+	}
+	return 1 - dot/math.Sqrt(na*nb)
+}
+
+type vecCand struct {
+	key  string
+	dist float64
+}
+
+//max 为true时堆顶为最远的候选
+type vecHeap struct {
+	items []vecCand
+	max   bool
+}
+
+func (h *vecHeap) Len() int { return len(h.items) }
+func (h *vecHeap) Less(i, j int) bool {
+	if h.max {
+		return h.items[i].dist > h.items[j].dist
+	}
+	return h.items[i].dist < h.items[j].dist
+}
+func (h *vecHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *vecHeap) Push(x interface{}) { h.items = append(h.items, x.(vecCand)) }
+func (h *vecHeap) Pop() interface{} {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
+
+func (h *vecHeap) sorted() []vecCand {
+	result := append([]vecCand{}, h.items...)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].dist < result[j].dist
+	})
+	return result
+}
+
+//*leveldb.DB 与 *leveldb.Snapshot 均满足
+type vecReader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+type vecNode struct {
+	level int
+	links [][]string
+}
+
+func (n *vecNode) encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	data := []byte{byte(n.level)}
+	for _, list := range n.links {
+		data = append(data, buf[:binary.PutUvarint(buf, uint64(len(list)))]...)
+		for _, key := range list {
+			data = append(data, buf[:binary.PutUvarint(buf, uint64(len(key)))]...)
+			data = append(data, key...)
+		}
+	}
+	return data
+}
+
+func vecDecodeNode(data []byte) *vecNode {
+	if len(data) == 0 {
+		return nil
+	}
+	n := &vecNode{level: int(data[0]), links: make([][]string, int(data[0])+1)}
+	i := 1
+	for lc := range n.links {
+		cnt, l := binary.Uvarint(data[i:])
+		if l <= 0 {
+			return n
+		}
+		i += l
+		for j := uint64(0); j < cnt; j++ {
+			kl, l := binary.Uvarint(data[i:])
+			if l <= 0 || i+l+int(kl) > len(data) {
+				return n
+			}
+			i += l
+			n.links[lc] = append(n.links[lc], string(data[i:i+int(kl)]))
+			i += int(kl)
+		}
+	}
+	return n
+}
+
+//一次操作中读到及修改过的图数据，修改在 flush 时写入 batch
+type vecGraph struct {
+	index string
+	conf  vecConfig
+	r     vecReader
+	vecs  map[string][]float32
+	nodes map[string]*vecNode
+	dirty map[string]bool
+	//入口节点，entryLevel<0 表示图为空
+	entryKey    string
+	entryLevel  int
+	entryLoaded bool
+	entryDirty  bool
+}
+
+func newVecGraph(index string, conf vecConfig, r vecReader) *vecGraph {
+	return &vecGraph{index: index, conf: conf, r: r, vecs: make(map[string][]float32), nodes: make(map[string]*vecNode), dirty: make(map[string]bool)}
+}
+
+func (g *vecGraph) vec(key string) []float32 {
+	if v, ok := g.vecs[key]; ok {
+		return v
+	}
+	data, err := g.r.Get(vecKey(g.index, vecEmbSub, key), nil)
+	var v []float32
+	if err == nil {
+		v = vecDecode(data)
+	}
+	g.vecs[key] = v
+	return v
+}
+
+func (g *vecGraph) node(key string) *vecNode {
+	if n, ok := g.nodes[key]; ok {
+		return n
+	}
+	var n *vecNode
+	if data, err := g.r.Get(vecKey(g.index, vecNodeSub, key), nil); err == nil {
+		n = vecDecodeNode(data)
+	}
+	g.nodes[key] = n
+	return n
+}
+
+func (g *vecGraph) entry() (string, int, bool) {
+	if !g.entryLoaded {
+		g.entryLoaded = true
+		g.entryLevel = -1
+		data, err := g.r.Get(nsKey(nsVec, g.index, []byte{vecEntrySub}), nil)
+		if err == nil && len(data) > 0 {
+			g.entryKey, g.entryLevel = string(data[1:]), int(data[0])
+		}
+	}
+	return g.entryKey, g.entryLevel, g.entryLevel >= 0
+}
+
+func (g *vecGraph) setEntry(key string, level int) {
+	g.entryKey, g.entryLevel = key, level
+	g.entryLoaded, g.entryDirty = true, true
+}
+
+func (g *vecGraph) dist(q []float32, key string) (float64, bool) {
+	v := g.vec(key)
+	if v == nil {
+		return 0, false
+	}
+	return vecDistance(g.conf.Metric, q, v), true
+}
+
+func (g *vecGraph) maxLinks(lc int) int {
+	if lc == 0 {
+		return 2 * g.conf.M
+	}
+	return g.conf.M
+}
+
+//在第 lc 层贪心扩展，返回按距离升序的最多 ef 个结果，accept 为nil时接受全部节点
+func (g *vecGraph) searchLayer(q []float32, eps []vecCand, ef, lc int, accept func(key string) bool) []vecCand {
+	visited := make(map[string]bool)
+	cand := &vecHeap{}
+	res := &vecHeap{max: true}
+	for _, e := range eps {
+		visited[e.key] = true
+		heap.Push(cand, e)
+		if accept == nil || accept(e.key) {
+			heap.Push(res, e)
+		}
+	}
+	for cand.Len() > 0 {
+		c := heap.Pop(cand).(vecCand)
+		if res.Len() >= ef && c.dist > res.items[0].dist {
+			break
+		}
+		n := g.node(c.key)
+		if n == nil || lc >= len(n.links) {
+			continue
+		}
+		for _, key := range n.links[lc] {
+			if visited[key] {
+				continue
+			}
+			visited[key] = true
+			d, ok := g.dist(q, key)
+			if !ok {
+				continue
+			}
+			if res.Len() < ef || d < res.items[0].dist {
+				heap.Push(cand, vecCand{key: key, dist: d})
+				if accept == nil || accept(key) {
+					heap.Push(res, vecCand{key: key, dist: d})
+					if res.Len() > ef {
+						heap.Pop(res)
+					}
+				}
+			}
+		}
+	}
+	return res.sorted()
+}
+
+//从候选中选出距 key 最近的 max 个
+func (g *vecGraph) closest(key string, keys []string, max int) []string {
+	base := g.vec(key)
+	cands := make([]vecCand, 0, len(keys))
+	seen := map[string]bool{key: true}
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if d, ok := g.dist(base, k); ok {
+			cands = append(cands, vecCand{key: k, dist: d})
+		}
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		return cands[i].dist < cands[j].dist
+	})
+	if len(cands) > max {
+		cands = cands[:max]
+	}
+	result := make([]string, len(cands))
+	for i, c := range cands {
+		result[i] = c.key
+	}
+	return result
+}
+
+func (g *vecGraph) insert(key string, q []float32, level int) {
+	entry, top, ok := g.entry()
+	g.vecs[key] = q
+	n := &vecNode{level: level, links: make([][]string, level+1)}
+	g.nodes[key] = n
+	g.dirty[key] = true
+	if !ok {
+		g.setEntry(key, level)
+		return
+	}
+	d, _ := g.dist(q, entry)
+	eps := []vecCand{{key: entry, dist: d}}
+	for lc := top; lc > level; lc-- {
+		eps = g.searchLayer(q, eps, 1, lc, nil)
+	}
+	for lc := minInt(top, level); lc >= 0; lc-- {
+		w := g.searchLayer(q, eps, g.conf.EfConstruction, lc, nil)
+		keys := make([]string, len(w))
+		for i, c := range w {
+			keys[i] = c.key
+		}
+		n.links[lc] = g.closest(key, keys, g.conf.M)
+		for _, nb := range n.links[lc] {
+			nn := g.node(nb)
+			if nn == nil || lc >= len(nn.links) {
+				continue
+			}
+			nn.links[lc] = append(nn.links[lc], key)
+			if len(nn.links[lc]) > g.maxLinks(lc) {
+				nn.links[lc] = g.closest(nb, nn.links[lc], g.maxLinks(lc))
+			}
+			g.dirty[nb] = true
+		}
+		eps = w
+	}
+	if level > top {
+		g.setEntry(key, level)
+	}
+}
+
+//删除节点，用被删节点的邻居修补各邻居的连接
+func (g *vecGraph) remove(batch *leveldb.Batch, key string) {
+	n := g.node(key)
+	if n == nil {
+		return
+	}
+	for lc, list := range n.links {
+		for _, nb := range list {
+			nn := g.node(nb)
+			if nn == nil || lc >= len(nn.links) {
+				continue
+			}
+			cands := make([]string, 0, len(nn.links[lc])+len(list))
+			for _, k := range nn.links[lc] {
+				if k != key {
+					cands = append(cands, k)
+				}
+			}
+			for _, k := range list {
+				if k != key {
+					cands = append(cands, k)
+				}
+			}
+			nn.links[lc] = g.closest(nb, cands, g.maxLinks(lc))
+			g.dirty[nb] = true
+		}
+	}
+	g.nodes[key] = nil
+	g.vecs[key] = nil
+	delete(g.dirty, key)
+	batch.Delete(vecKey(g.index, vecNodeSub, key))
+	if entry, _, _ := g.entry(); entry != key {
+		return
+	}
+	//入口被删时选层数最高的节点作为新入口
+	newEntry, top := "", -1
+	p := vecKey(g.index, vecNodeSub, "")
+	iter := g.r.NewIterator(util.BytesPrefix(p), nil)
+	for iter.Next() {
+		k := string(iter.Key()[len(p):])
+		if k != key && len(iter.Value()) > 0 && int(iter.Value()[0]) > top {
+			newEntry, top = k, int(iter.Value()[0])
+		}
+	}
+	iter.Release()
+	g.setEntry(newEntry, top)
+}
+
+func (g *vecGraph) flush(batch *leveldb.Batch) {
+	for key := range g.dirty {
+		if n := g.nodes[key]; n != nil {
+			batch.Put(vecKey(g.index, vecNodeSub, key), n.encode())
+		}
+	}
+	ek := nsKey(nsVec, g.index, []byte{vecEntrySub})
+	switch {
+	case !g.entryDirty:
+	case g.entryLevel < 0:
+		batch.Delete(ek)
+	default:
+		batch.Put(ek, append([]byte{byte(g.entryLevel)}, g.entryKey...))
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (k *Kvdb) vecConfig(r vecReader, index string) (vecConfig, error) {
+	var conf vecConfig
+	data, err := r.Get(nsKey(nsVec, index, []byte{vecConfSub}), nil)
+	if err == leveldb.ErrNotFound {
+		return conf, ErrVecIndexNotFound
+	}
+	if err != nil {
+		return conf, err
+	}
+	return conf, msgpack.Unmarshal(data, &conf)
+}
+
+//新建向量索引，dim 为向量维数
+func (k *Kvdb) CreateVecIndex(index string, dim int, opts *VecIndexOptions) error {
+	if dim <= 0 {
+		return errors.New("dim must > 0")
+	}
+	conf := vecConfig{Dim: dim, Metric: VecCosine, M: 16, EfConstruction: 200, EfSearch: 64}
+	if opts != nil {
+		if opts.Metric != 0 {
+			conf.Metric = opts.Metric
+		}
+		conf.HNSW = opts.HNSW
+		if opts.M > 0 {
+			conf.M = opts.M
+		}
+		if opts.EfConstruction > 0 {
+			conf.EfConstruction = opts.EfConstruction
+		}
+		if opts.EfSearch > 0 {
+			conf.EfSearch = opts.EfSearch
+		}
+	}
+	if conf.Metric < VecCosine || conf.Metric > VecDot {
+		return errors.New("vector metric unknown")
+	}
+	k.Lock()
+	defer k.Unlock()
+	ck := nsKey(nsVec, index, []byte{vecConfSub})
+	if ok, _ := k.db.Has(ck, nil); ok {
+		return errors.New("vector index exists")
+	}
+	data, err := msgpack.Marshal(&conf)
+	if err != nil {
+		return err
+	}
+	return k.db.Put(ck, data, nil)
+}
+
+//添加或更新向量
+func (k *Kvdb) VecAdd(index, key string, vec []float32) error {
+	k.Lock()
+	defer k.Unlock()
+	conf, err := k.vecConfig(k.db, index)
+	if err != nil {
+		return err
+	}
+	if len(vec) != conf.Dim {
+		return errors.New("vector dim mismatch")
+	}
+	batch := new(leveldb.Batch)
+	ek := vecKey(index, vecEmbSub, key)
+	exists, _ := k.db.Has(ek, nil)
+	batch.Put(ek, vecEncode(vec))
+	if conf.HNSW {
+		g := newVecGraph(index, conf, k.db)
+		if exists {
+			g.remove(batch, key)
+		}
+		//层数按 1/ln(M) 的指数分布随机
+		level := int(-math.Log(1-rand.Float64()) / math.Log(float64(conf.M)))
+		if level > vecMaxLevel {
+			level = vecMaxLevel
+		}
+		g.insert(key, append([]float32{}, vec...), level)
+		g.flush(batch)
+	}
+	if !exists {
+		k.nsSetCount(batch, nsVec, index, k.nsCount(nsVec, index)+1)
+	}
+	return k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) VecDel(index, key string) error {
+	k.Lock()
+	defer k.Unlock()
+	conf, err := k.vecConfig(k.db, index)
+	if err != nil {
+		return err
+	}
+	ek := vecKey(index, vecEmbSub, key)
+	if ok, _ := k.db.Has(ek, nil); !ok {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	batch.Delete(ek)
+	if conf.HNSW {
+		g := newVecGraph(index, conf, k.db)
+		g.remove(batch, key)
+		g.flush(batch)
+	}
+	k.nsSetCount(batch, nsVec, index, k.nsCount(nsVec, index)-1)
+	return k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) VecGet(index, key string) ([]float32, error) {
+	data, err := k.db.Get(vecKey(index, vecEmbSub, key), nil)
+	if err != nil {
+		return nil, err
+	}
+	return vecDecode(data), nil
+}
+
+func (k *Kvdb) VecLen(index string) uint64 {
+	return k.nsCount(nsVec, index)
+}
+
+//删除整个索引及其配置
+func (k *Kvdb) VecDrop(index string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsVec, index)
+}
+
+//返回与 query 最相近的 n 个向量
+func (k *Kvdb) VecSearch(index string, query []float32, n int) ([]VecHit, error) {
+	return k.VecSearchPrefix(index, query, n, "")
+}
+
+//只在 key 以 prefix 开头的向量中检索，HNSW 结果不足时退回对前缀区间的精确检索
+func (k *Kvdb) VecSearchPrefix(index string, query []float32, n int, prefix string) ([]VecHit, error) {
+	snap, err := k.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+	conf, err := k.vecConfig(snap, index)
+	if err != nil {
+		return nil, err
+	}
+	if len(query) != conf.Dim {
+		return nil, errors.New("vector dim mismatch")
+	}
+	if n <= 0 {
+		return []VecHit{}, nil
+	}
+	if conf.HNSW {
+		hits := k.vecSearchHNSW(snap, index, conf, query, n, prefix)
+		if len(hits) >= n || prefix == "" {
+			return hits, nil
+		}
+	}
+	return k.vecSearchExact(snap, index, conf, query, n, prefix)
+}
+
+func (k *Kvdb) vecSearchExact(snap *leveldb.Snapshot, index string, conf vecConfig, query []float32, n int, prefix string) ([]VecHit, error) {
+	p := vecKey(index, vecEmbSub, "")
+	res := &vecHeap{max: true}
+	iter := snap.NewIterator(util.BytesPrefix(vecKey(index, vecEmbSub, prefix)), k.iteratorOpts)
+	defer iter.Release()
+	for iter.Next() {
+		d := vecDistance(conf.Metric, query, vecDecode(iter.Value()))
+		if res.Len() < n || d < res.items[0].dist {
+			heap.Push(res, vecCand{key: string(iter.Key()[len(p):]), dist: d})
+			if res.Len() > n {
+				heap.Pop(res)
+			}
+		}
+	}
+	return vecHits(res.sorted()), iter.Error()
+}
+
+func (k *Kvdb) vecSearchHNSW(snap *leveldb.Snapshot, index string, conf vecConfig, query []float32, n int, prefix string) []VecHit {
+	g := newVecGraph(index, conf, snap)
+	entry, top, ok := g.entry()
+	if !ok {
+		return []VecHit{}
+	}
+	d, _ := g.dist(query, entry)
+	eps := []vecCand{{key: entry, dist: d}}
+	for lc := top; lc > 0; lc-- {
+		eps = g.searchLayer(query, eps, 1, lc, nil)
+	}
+	var accept func(key string) bool
+	if prefix != "" {
+		accept = func(key string) bool {
+			return bytes.HasPrefix([]byte(key), []byte(prefix))
+		}
+	}
+	ef := conf.EfSearch
+	if ef < n {
+		ef = n
+	}
+	res := g.searchLayer(query, eps, ef, 0, accept)
+	if len(res) > n {
+		res = res[:n]
+	}
+	return vecHits(res)
+}
+
+func vecHits(cands []vecCand) []VecHit {
+	hits := make([]VecHit, len(cands))
+	for i, c := range cands {
+		hits[i] = VecHit{Key: c.key, Distance: c.dist}
+	}
+	return hits
+}
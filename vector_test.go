@@ -0,0 +1,141 @@
+package yiyidb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_Vector(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Drop()
+
+	assert.NoError(t, kv.CreateVecIndex("l2", 2, &VecIndexOptions{Metric: VecL2}))
+	assert.Error(t, kv.CreateVecIndex("l2", 2, nil))
+	kv.VecAdd("l2", "a", []float32{0, 0})
+	kv.VecAdd("l2", "b", []float32{3, 4})
+	kv.VecAdd("l2", "c", []float32{1, 1})
+	assert.Error(t, kv.VecAdd("l2", "d", []float32{1}))
+	assert.Equal(t, kv.VecAdd("none", "d", []float32{1}), ErrVecIndexNotFound)
+
+	hits, err := kv.VecSearch("l2", []float32{0, 0}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, hits[0], VecHit{Key: "a", Distance: 0})
+	assert.Equal(t, hits[1].Key, "c")
+	hits, _ = kv.VecSearch("l2", []float32{3, 3}, 3)
+	assert.Equal(t, hits[0].Key, "b")
+	assert.Equal(t, hits[0].Distance, float64(1))
+
+	kv.CreateVecIndex("cos", 2, nil)
+	kv.VecAdd("cos", "x", []float32{1, 0})
+	kv.VecAdd("cos", "y", []float32{0, 5})
+	hits, _ = kv.VecSearch("cos", []float32{0, 1}, 1)
+	assert.Equal(t, hits[0].Key, "y")
+	assert.InDelta(t, 0, hits[0].Distance, 1e-9)
+
+	kv.CreateVecIndex("dot", 2, &VecIndexOptions{Metric: VecDot})
+	kv.VecAdd("dot", "small", []float32{1, 1})
+	kv.VecAdd("dot", "big", []float32{5, 5})
+	hits, _ = kv.VecSearch("dot", []float32{1, 1}, 1)
+	assert.Equal(t, hits[0].Key, "big")
+	assert.Equal(t, hits[0].Distance, float64(-10))
+
+	assert.NoError(t, kv.VecDel("l2", "a"))
+	assert.Equal(t, kv.VecLen("l2"), uint64(2))
+	v, err := kv.VecGet("l2", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, v, []float32{3, 4})
+	assert.NoError(t, kv.VecDrop("l2"))
+	_, err = kv.VecSearch("l2", []float32{0, 0}, 1)
+	assert.Equal(t, err, ErrVecIndexNotFound)
+}
+
+func TestKvdb_VectorHNSW(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+
+	const dim, total = 8, 500
+	r := rand.New(rand.NewSource(1))
+	randVec := func() []float32 {
+		v := make([]float32, dim)
+		for i := range v {
+			v[i] = r.Float32()*2 - 1
+		}
+		return v
+	}
+	kv.CreateVecIndex("exact", dim, &VecIndexOptions{Metric: VecL2})
+	kv.CreateVecIndex("hnsw", dim, &VecIndexOptions{Metric: VecL2, HNSW: true, M: 8, EfConstruction: 64})
+	for i := 0; i < total; i++ {
+		v := randVec()
+		key := fmt.Sprintf("%s-%03d", []string{"cam", "door"}[i%2], i)
+		assert.NoError(t, kv.VecAdd("exact", key, v))
+		assert.NoError(t, kv.VecAdd("hnsw", key, v))
+	}
+	//覆盖与删除后图仍可用
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("%s-%03d", []string{"cam", "door"}[i%2], i)
+		v := randVec()
+		kv.VecAdd("exact", key, v)
+		kv.VecAdd("hnsw", key, v)
+		if i%5 == 0 {
+			kv.VecDel("exact", key)
+			kv.VecDel("hnsw", key)
+		}
+	}
+	assert.Equal(t, kv.VecLen("hnsw"), uint64(total-10))
+
+	//重新打开后图数据保持
+	kv.Close()
+	kv, err = OpenKvdb(dir, false, false, 10)
+	assert.NoError(t, err)
+	defer kv.Drop()
+
+	found, want := 0, 0
+	for q := 0; q < 20; q++ {
+		query := randVec()
+		exact, err := kv.VecSearch("exact", query, 10)
+		assert.NoError(t, err)
+		approx, err := kv.VecSearch("hnsw", query, 10)
+		assert.NoError(t, err)
+		keys := make(map[string]bool)
+		for _, h := range approx {
+			keys[h.Key] = true
+		}
+		for _, h := range exact {
+			want++
+			if keys[h.Key] {
+				found++
+			}
+		}
+	}
+	assert.True(t, float64(found)/float64(want) > 0.9)
+
+	query := randVec()
+	exact, _ := kv.VecSearchPrefix("exact", query, 5, "door-")
+	approx, _ := kv.VecSearchPrefix("hnsw", query, 5, "door-")
+	assert.Equal(t, len(approx), 5)
+	for _, h := range approx {
+		assert.Equal(t, h.Key[:5], "door-")
+	}
+	assert.Equal(t, approx[0], exact[0])
+}
@@ -0,0 +1,285 @@
+package yiyidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+//有序集合: 成员索引 m+member -> score，分值索引 s+score+member -> 空
+const (
+	zMemberSub byte = 'm'
+	zScoreSub  byte = 's'
+)
+
+type ZItem struct {
+	Member string
+	Score  float64
+}
+
+//浮点数转为可按字节排序的8字节
+func floatToKey(f float64) []byte {
+	b := make([]byte, 8)
+	u := math.Float64bits(f)
+	if u&(1<<63) != 0 {
+		u = ^u
+	} else {
+		u |= 1 << 63
+	}
+	binary.BigEndian.PutUint64(b, u)
+	return b
+}
+
+func keyToFloat(b []byte) float64 {
+	u := binary.BigEndian.Uint64(b)
+	if u&(1<<63) != 0 {
+		u &^= 1 << 63
+	} else {
+		u = ^u
+	}
+	return math.Float64frombits(u)
+}
+
+func zMemberKey(set, member string) []byte {
+	return nsKey(nsZset, set, append([]byte{zMemberSub}, member...))
+}
+
+func zScorePrefix(set string) []byte {
+	return nsKey(nsZset, set, []byte{zScoreSub})
+}
+
+func zScoreKey(set string, score float64, member string) []byte {
+	return append(append(zScorePrefix(set), floatToKey(score)...), member...)
+}
+
+func zItemFromKey(prefixLen int, key []byte) ZItem {
+	return ZItem{Score: keyToFloat(key[prefixLen : prefixLen+8]), Member: string(key[prefixLen+8:])}
+}
+
+//同批次内成员的最新分值，用于批量写入时判断是否已存在
+type zPending map[string]float64
+
+func (k *Kvdb) zScore(set, member string, pending zPending) (float64, bool, error) {
+	if s, ok := pending[member]; ok {
+		return s, true, nil
+	}
+	val, err := k.db.Get(zMemberKey(set, member), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return keyToFloat(val), true, nil
+}
+
+//写入成员两条索引，返回成员是否为新增
+func (k *Kvdb) zPut(batch *leveldb.Batch, set, member string, score float64, pending zPending) (bool, error) {
+	old, exists, err := k.zScore(set, member, pending)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		if old == score {
+			return false, nil
+		}
+		batch.Delete(zScoreKey(set, old, member))
+	}
+	batch.Put(zMemberKey(set, member), floatToKey(score))
+	batch.Put(zScoreKey(set, score, member), nil)
+	pending[member] = score
+	return !exists, nil
+}
+
+//添加或更新成员分值，返回新增成员数
+func (k *Kvdb) ZAdd(set string, items ...ZItem) (int, error) {
+	k.Lock()
+	defer k.Unlock()
+	batch := new(leveldb.Batch)
+	pending := make(zPending)
+	added := 0
+	for _, v := range items {
+		if math.IsNaN(v.Score) {
+			return 0, errors.New("score is NaN")
+		}
+		isNew, err := k.zPut(batch, set, v.Member, v.Score, pending)
+		if err != nil {
+			return 0, err
+		}
+		if isNew {
+			added++
+		}
+	}
+	if added > 0 {
+		k.nsSetCount(batch, nsZset, set, k.nsCount(nsZset, set)+uint64(added))
+	}
+	return added, k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) ZIncrBy(set string, incr float64, member string) (float64, error) {
+	k.Lock()
+	defer k.Unlock()
+	old, _, err := k.zScore(set, member, nil)
+	if err != nil {
+		return 0, err
+	}
+	score := old + incr
+	if math.IsNaN(score) {
+		return 0, errors.New("score is NaN")
+	}
+	batch := new(leveldb.Batch)
+	isNew, err := k.zPut(batch, set, member, score, make(zPending))
+	if err != nil {
+		return 0, err
+	}
+	if isNew {
+		k.nsSetCount(batch, nsZset, set, k.nsCount(nsZset, set)+1)
+	}
+	return score, k.db.Write(batch, nil)
+}
+
+//删除成员，返回实际删除数
+func (k *Kvdb) ZRem(set string, members ...string) (int, error) {
+	k.Lock()
+	defer k.Unlock()
+	batch := new(leveldb.Batch)
+	removed := make(map[string]bool)
+	for _, m := range members {
+		if removed[m] {
+			continue
+		}
+		score, exists, err := k.zScore(set, m, nil)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			batch.Delete(zMemberKey(set, m))
+			batch.Delete(zScoreKey(set, score, m))
+			removed[m] = true
+		}
+	}
+	if len(removed) == 0 {
+		return 0, nil
+	}
+	k.nsSetCount(batch, nsZset, set, k.nsCount(nsZset, set)-uint64(len(removed)))
+	return len(removed), k.db.Write(batch, nil)
+}
+
+func (k *Kvdb) ZScore(set, member string) (float64, error) {
+	val, err := k.db.Get(zMemberKey(set, member), nil)
+	if err != nil {
+		return 0, err
+	}
+	return keyToFloat(val), nil
+}
+
+func (k *Kvdb) ZCard(set string) uint64 {
+	return k.nsCount(nsZset, set)
+}
+
+//按排名范围(含)返回，负数表示从末尾倒数
+func (k *Kvdb) ZRange(set string, start, stop int64) ([]ZItem, error) {
+	return k.zRange(set, start, stop, false)
+}
+
+func (k *Kvdb) ZRevRange(set string, start, stop int64) ([]ZItem, error) {
+	return k.zRange(set, start, stop, true)
+}
+
+func (k *Kvdb) zRange(set string, start, stop int64, rev bool) ([]ZItem, error) {
+	card := int64(k.nsCount(nsZset, set))
+	if start < 0 {
+		start += card
+	}
+	if stop < 0 {
+		stop += card
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= card {
+		stop = card - 1
+	}
+	result := make([]ZItem, 0)
+	if start > stop {
+		return result, nil
+	}
+	p := zScorePrefix(set)
+	iter := k.db.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+	defer iter.Release()
+	next := iter.Next
+	ok := iter.First()
+	if rev {
+		next = iter.Prev
+		ok = iter.Last()
+	}
+	for i := int64(0); ok && i <= stop; i++ {
+		if i >= start {
+			result = append(result, zItemFromKey(len(p), iter.Key()))
+		}
+		ok = next()
+	}
+	return result, iter.Error()
+}
+
+//按分值闭区间返回，count<0 表示不限数量
+func (k *Kvdb) ZRangeByScore(set string, min, max float64, offset, count int) ([]ZItem, error) {
+	result := make([]ZItem, 0)
+	p := zScorePrefix(set)
+	iter := k.db.NewIterator(util.BytesPrefix(p), k.iteratorOpts)
+	defer iter.Release()
+	for ok := iter.Seek(append(p, floatToKey(min)...)); ok && count != 0; ok = iter.Next() {
+		item := zItemFromKey(len(p), iter.Key())
+		if item.Score > max {
+			break
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		result = append(result, item)
+		count--
+	}
+	return result, iter.Error()
+}
+
+//返回成员升序排名(从0开始)，需遍历排名之前的索引
+func (k *Kvdb) ZRank(set, member string) (int64, error) {
+	score, err := k.ZScore(set, member)
+	if err != nil {
+		return -1, err
+	}
+	p := zScorePrefix(set)
+	iter := k.db.NewIterator(&util.Range{Start: p, Limit: zScoreKey(set, score, member)}, k.iteratorOpts)
+	defer iter.Release()
+	var rank int64
+	for iter.Next() {
+		rank++
+	}
+	return rank, iter.Error()
+}
+
+func (k *Kvdb) ZRevRank(set, member string) (int64, error) {
+	rank, err := k.ZRank(set, member)
+	if err != nil {
+		return -1, err
+	}
+	return int64(k.ZCard(set)) - rank - 1, nil
+}
+
+func (k *Kvdb) ZClear(set string) error {
+	k.Lock()
+	defer k.Unlock()
+	return k.delNs(nsZset, set)
+}
+
+//设置整个集合的超时秒数，<0 取消超时
+func (k *Kvdb) ZSetTTL(set string, ttl int) error {
+	return k.expireNs(nsZset, set, ttl)
+}
+
+func (k *Kvdb) ZGetTTL(set string) (float64, error) {
+	return k.ttlNs(nsZset, set)
+}
@@ -0,0 +1,100 @@
+package yiyidb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKvdb_ZSet(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, false, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	n, err := kv.ZAdd("board", ZItem{"jac", 10}, ZItem{"yum", -2.5}, ZItem{"tom", 30}, ZItem{"ann", 10})
+	assert.NoError(t, err)
+	assert.Equal(t, n, 4)
+	n, err = kv.ZAdd("board", ZItem{"jac", 20})
+	assert.NoError(t, err)
+	assert.Equal(t, n, 0)
+	assert.Equal(t, kv.ZCard("board"), uint64(4))
+
+	all, err := kv.ZRange("board", 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, all, []ZItem{{"yum", -2.5}, {"ann", 10}, {"jac", 20}, {"tom", 30}})
+
+	top, err := kv.ZRevRange("board", 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, top, []ZItem{{"tom", 30}, {"jac", 20}})
+
+	rg, err := kv.ZRangeByScore("board", 0, 25, 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, rg, []ZItem{{"ann", 10}, {"jac", 20}})
+
+	rank, err := kv.ZRank("board", "jac")
+	assert.NoError(t, err)
+	assert.Equal(t, rank, int64(2))
+	rank, err = kv.ZRevRank("board", "jac")
+	assert.NoError(t, err)
+	assert.Equal(t, rank, int64(1))
+
+	score, err := kv.ZIncrBy("board", 15, "ann")
+	assert.NoError(t, err)
+	assert.Equal(t, score, float64(25))
+	top, err = kv.ZRevRange("board", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, top[0].Member, "tom")
+	rank, err = kv.ZRank("board", "ann")
+	assert.NoError(t, err)
+	assert.Equal(t, rank, int64(2))
+
+	n, err = kv.ZRem("board", "tom", "nobody")
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	_, err = kv.ZScore("board", "tom")
+	assert.Error(t, err)
+	assert.Equal(t, kv.ZCard("board"), uint64(3))
+
+	assert.NoError(t, kv.ZClear("board"))
+	assert.Equal(t, kv.ZCard("board"), uint64(0))
+	assert.Equal(t, len(kv.AllKeys()), 0)
+
+	kv.Drop()
+}
+
+func TestKvdb_ZSetTTL(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		panic(err)
+	}
+	dir = dir + "/" + fmt.Sprintf("test_db_%d", time.Now().UnixNano())
+	kv, err := OpenKvdb(dir, false, true, 10)
+	if err != nil {
+		panic(err)
+	}
+	defer kv.Close()
+
+	kv.ZAdd("delay", ZItem{"job1", 1}, ZItem{"job2", 2})
+	kv.ZAdd("keep", ZItem{"job1", 1})
+	assert.NoError(t, kv.ZSetTTL("delay", 1))
+
+	time.Sleep(3 * time.Second)
+
+	assert.Equal(t, kv.ZCard("delay"), uint64(0))
+	_, err = kv.ZScore("delay", "job1")
+	assert.Error(t, err)
+	assert.Equal(t, kv.ZCard("keep"), uint64(1))
+
+	kv.Drop()
+}